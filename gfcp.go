@@ -15,6 +15,7 @@ import (
 	"encoding/binary"
 	"math"
 	"runtime/debug"
+	"sort"
 	"sync/atomic"
 
 	gfcpLegal "go4.org/legal"
@@ -226,12 +227,21 @@ type GFCP struct {
 	nocwnd, stream                      int32
 	sndQueue                            []Segment
 	rcvQueue                            []Segment
-	SndBuf                              []Segment
-	rcvBuf                              []Segment
+	sndBuf                              segmentRing
+	rcvBuf                              segmentRing
+	sndBytes                            int    // data in sndQueue and sndBuf
+	rcvBytes                            int    // data in rcvBuf and rcvQueue
+	sndHeld, rcvHeld                    int    // capacity of the buffers of that data
+	rcvCap                              uint32 // receive window under memory pressure, 0 for none
 	acklist                             []ackItem
+	fastacks                            []ackItem // acks since the last flush, for applyFastacks
+	fastackTs                           []uint32  // the ts of fastacks, sorted, for applyFastacks
+	fastackTree                         []int32   // Fenwick tree over fastackTs
 	buffer                              []byte
 	reserved                            int
 	output                              outputCallback
+	clock                               Clock
+	xmitSegs, resentSegs                uint64 // sent and resent segments, for adaptive FEC
 }
 
 type ackItem struct {
@@ -264,9 +274,30 @@ func NewGFCP(
 	GFcp.ssthresh = GfcpThreshInit
 	GFcp.deadLink = GfcpDeadLink
 	GFcp.output = output
+	GFcp.clock = SystemClock
 	return GFcp
 }
 
+// SetClock makes GFcp read time from c instead of the system clock.
+func (
+	GFcp *GFCP,
+) SetClock(
+	c Clock,
+) {
+	if c == nil {
+		c = SystemClock
+	}
+	GFcp.clock = c
+}
+
+func (
+	GFcp *GFCP,
+) currentMs() uint32 {
+	return clockMs(
+		GFcp.clock,
+	)
+}
+
 func (
 	GFcp *GFCP,
 ) newSegment(
@@ -274,7 +305,9 @@ func (
 ) (
 	GFcpSeg Segment,
 ) {
-	GFcpSeg.data = KxmitBuf.Get().([]byte)[:size]
+	GFcpSeg.data = xmitBuf.Get(
+		size,
+	)
 	return
 }
 
@@ -284,8 +317,7 @@ func (
 	GFcpSeg *Segment,
 ) {
 	if GFcpSeg.data != nil {
-		KxmitBuf.Put(
-			// TODO(jhj): Switch to pointer to avoid allocation
+		xmitBuf.Put(
 			GFcpSeg.data,
 		)
 		GFcpSeg.data = nil
@@ -373,7 +405,7 @@ func (
 	if len(
 		GFcp.rcvQueue,
 	) >= int(
-		GFcp.rcvWnd,
+		GFcp.rcvWindow(),
 	) {
 		fastRecovery = true
 	}
@@ -391,6 +423,9 @@ func (
 			GFcpSeg.data,
 		)
 		count++
+		GFcp.rcvHeld -= cap(
+			GFcpSeg.data,
+		)
 		GFcp.delSegment(
 			GFcpSeg,
 		)
@@ -398,44 +433,108 @@ func (
 			break
 		}
 	}
-	if count > 0 {
-		GFcp.rcvQueue = GFcp.removeFront(
-			GFcp.rcvQueue,
-			count,
-		)
+	GFcp.recvDone(
+		count,
+		n,
+		fastRecovery,
+	)
+	return
+}
+
+// RecvBuffers hands over the data of the next message without copying,
+// appended to bufs segment by segment, and returns its size, or -1 if
+// no whole message is queued. The caller owns the buffers afterwards.
+func (
+	GFcp *GFCP,
+) RecvBuffers(
+	bufs [][]byte,
+) (
+	[][]byte,
+	int,
+) {
+	peeksize := GFcp.PeekSize()
+	if peeksize < 0 {
+		return bufs, -1
 	}
-	count = 0
-	for k := range GFcp.rcvBuf {
-		GFcpSeg := &GFcp.rcvBuf[k]
-		if GFcpSeg.sn == GFcp.rcvNxt && len(
-			GFcp.rcvQueue,
-		) < int(
-			GFcp.rcvWnd,
-		) {
-			GFcp.rcvNxt++
-			count++
-		} else {
+	fastRecovery := len(
+		GFcp.rcvQueue,
+	) >= int(
+		GFcp.rcvWindow(),
+	)
+	count := 0
+	for k := range GFcp.rcvQueue {
+		GFcpSeg := &GFcp.rcvQueue[k]
+		bufs = append(
+			bufs,
+			GFcpSeg.data,
+		)
+		GFcp.rcvHeld -= cap(
+			GFcpSeg.data,
+		)
+		GFcpSeg.data = nil
+		count++
+		if GFcpSeg.frg == 0 {
 			break
 		}
 	}
+	GFcp.recvDone(
+		count,
+		peeksize,
+		fastRecovery,
+	)
+	return bufs, peeksize
+}
+
+// recvDone drops the count segments of a message of size bytes read,
+// refills the receive queue, and tells the peer when the window reopens.
+func (
+	GFcp *GFCP,
+) recvDone(
+	count,
+	size int,
+	fastRecovery bool,
+) {
 	if count > 0 {
-		GFcp.rcvQueue = append(
+		GFcp.rcvQueue = GFcp.removeFront(
 			GFcp.rcvQueue,
-			GFcp.rcvBuf[:count]...,
-		)
-		GFcp.rcvBuf = GFcp.removeFront(
-			GFcp.rcvBuf,
 			count,
 		)
 	}
+	GFcp.rcvBytes -= size
+	GFcp.moveRcvBuf()
 	if len(
 		GFcp.rcvQueue,
 	) < int(
-		GFcp.rcvWnd,
+		GFcp.rcvWindow(),
 	) && fastRecovery {
 		GFcp.probe |= GfcpAskTell
 	}
-	return
+}
+
+// rcvWindow returns the receive window, shrunk under memory pressure.
+func (
+	GFcp *GFCP,
+) rcvWindow() uint32 {
+	if GFcp.rcvCap != 0 && GFcp.rcvCap < GFcp.rcvWnd {
+		return GFcp.rcvCap
+	}
+	return GFcp.rcvWnd
+}
+
+// capRcvWnd caps the receive window at wnd segments, or lifts the cap
+// if wnd is 0; the peer is told when the window grows again.
+func (
+	GFcp *GFCP,
+) capRcvWnd(
+	wnd uint32,
+) {
+	if wnd == GFcp.rcvCap {
+		return
+	}
+	if GFcp.rcvCap != 0 && (wnd == 0 || wnd > GFcp.rcvCap) {
+		GFcp.probe |= GfcpAskTell
+	}
+	GFcp.rcvCap = wnd
 }
 
 // Send is upper level sender, returns <0 on error.
@@ -477,12 +576,34 @@ func (
 				oldlen := len(
 					GFcpSeg.data,
 				)
+				if cap(
+					GFcpSeg.data,
+				) < oldlen+extend {
+					// pooled buffers fit their first write only
+					data := xmitBuf.Get(
+						int(GFcp.mss),
+					)[:oldlen]
+					copy(
+						data,
+						GFcpSeg.data,
+					)
+					GFcp.sndHeld += cap(
+						data,
+					) - cap(
+						GFcpSeg.data,
+					)
+					xmitBuf.Put(
+						GFcpSeg.data,
+					)
+					GFcpSeg.data = data
+				}
 				GFcpSeg.data = GFcpSeg.data[:oldlen+extend]
 				copy(
 					GFcpSeg.data[oldlen:],
 					buffer,
 				)
 				buffer = buffer[extend:]
+				GFcp.sndBytes += extend
 			}
 		}
 		if len(
@@ -545,11 +666,47 @@ func (
 			GFcp.sndQueue,
 			GFcpSeg,
 		)
+		GFcp.sndBytes += size
+		GFcp.sndHeld += cap(
+			GFcpSeg.data,
+		)
 		buffer = buffer[size:]
 	}
 	return 0
 }
 
+// SendBuffer queues buf as a whole message of one segment, without
+// copying; GFCP takes buf over, and recycles it once acknowledged. It
+// returns <0 if buf is empty or larger than the mss.
+func (
+	GFcp *GFCP,
+) SendBuffer(
+	buf []byte,
+) int {
+	if len(
+		buf,
+	) == 0 || len(
+		buf,
+	) > int(
+		GFcp.mss,
+	) {
+		return -1
+	}
+	GFcp.sndQueue = append(
+		GFcp.sndQueue,
+		Segment{
+			data: buf,
+		},
+	)
+	GFcp.sndBytes += len(
+		buf,
+	)
+	GFcp.sndHeld += cap(
+		buf,
+	)
+	return 0
+}
+
 func (
 	GFcp *GFCP,
 ) updateAck(
@@ -588,10 +745,7 @@ func (
 func (
 	GFcp *GFCP,
 ) shrinkBuf() {
-	if len(
-		GFcp.SndBuf,
-	) > 0 {
-		GFcpSeg := &GFcp.SndBuf[0]
+	if GFcpSeg := GFcp.sndBuf.front(); GFcpSeg != nil {
 		GFcp.sndUna = GFcpSeg.sn
 	} else {
 		GFcp.sndUna = GFcp.sndNxt
@@ -613,21 +767,19 @@ func (
 		return
 	}
 
-	for k := range GFcp.SndBuf {
-		GFcpSeg := &GFcp.SndBuf[k]
-		if sn == GFcpSeg.sn {
-			GFcpSeg.acked = 1
-			GFcp.delSegment(
-				GFcpSeg,
-			)
-			break
-		}
-		if _itimediff(
-			sn,
-			GFcpSeg.sn,
-		) < 0 {
-			break
-		}
+	if GFcpSeg := GFcp.sndBuf.at(
+		sn,
+	); GFcpSeg != nil {
+		GFcpSeg.acked = 1
+		GFcp.sndBytes -= len(
+			GFcpSeg.data,
+		)
+		GFcp.sndHeld -= cap(
+			GFcpSeg.data,
+		)
+		GFcp.delSegment(
+			GFcpSeg,
+		)
 	}
 }
 
@@ -645,19 +797,139 @@ func (
 	) >= 0 {
 		return
 	}
-	for k := range GFcp.SndBuf {
-		GFcpSeg := &GFcp.SndBuf[k]
-		if _itimediff(
+	// counted by the next flush, which walks the window anyway
+	GFcp.fastacks = append(
+		GFcp.fastacks,
+		ackItem{
 			sn,
+			ts,
+		},
+	)
+	if len(
+		GFcp.fastacks,
+	) >= len(
+		GFcp.sndBuf.segs,
+	) {
+		GFcp.applyFastacks()
+	}
+}
+
+// applyFastacks adds the acks logged by parseFastack to the fastack of
+// each segment before them sent no later than the segment they ack.
+// The window is walked down once, adding the acks of higher sn to a
+// Fenwick tree over their ts, which counts those not older than each
+// segment.
+func (
+	GFcp *GFCP,
+) applyFastacks() {
+	acks := GFcp.fastacks
+	if len(
+		acks,
+	) == 0 {
+		return
+	}
+	GFcp.fastacks = acks[:0]
+	buf := &GFcp.sndBuf
+	sort.Slice(
+		acks,
+		func(
+			i,
+			j int,
+		) bool {
+			return _itimediff(
+				acks[i].sn,
+				acks[j].sn,
+			) > 0
+		},
+	)
+	ts := GFcp.fastackTs[:0]
+	for _, ack := range acks {
+		ts = append(
+			ts,
+			ack.ts,
+		)
+	}
+	sort.Slice(
+		ts,
+		func(
+			i,
+			j int,
+		) bool {
+			return _itimediff(
+				ts[i],
+				ts[j],
+			) < 0
+		},
+	)
+	// rank returns how many acks are older than t
+	rank := func(
+		t uint32,
+	) int {
+		return sort.Search(
+			len(ts),
+			func(
+				i int,
+			) bool {
+				return _itimediff(
+					ts[i],
+					t,
+				) >= 0
+			},
+		)
+	}
+	tree := GFcp.fastackTree[:0]
+	for i := 0; i <= len(
+		ts,
+	); i++ {
+		tree = append(
+			tree,
+			0,
+		)
+	}
+	GFcp.fastackTs, GFcp.fastackTree = ts, tree
+	if buf.n == 0 || _itimediff(
+		acks[0].sn,
+		buf.head,
+	) <= 0 {
+		return
+	}
+	added := 0
+	top := acks[0].sn - buf.head
+	if top > buf.span {
+		top = buf.span
+	}
+	for k := top; k > 0; k-- {
+		GFcpSeg := buf.slot(
+			k - 1,
+		)
+		if GFcpSeg == nil {
+			continue
+		}
+		for ; added < len(
+			acks,
+		) && _itimediff(
+			acks[added].sn,
 			GFcpSeg.sn,
-		) < 0 {
-			break
-		} else if sn != GFcpSeg.sn && _itimediff(
+		) > 0; added++ {
+			for i := rank(
+				acks[added].ts,
+			) + 1; i < len(
+				tree,
+			); i += i & -i {
+				tree[i]++
+			}
+		}
+		older := 0
+		for i := rank(
 			GFcpSeg.ts,
-			ts,
-		) <= 0 {
-			GFcpSeg.fastack++
+		); i > 0; i -= i & -i {
+			older += int(
+				tree[i],
+			)
 		}
+		GFcpSeg.fastack += uint32(
+			added - older,
+		)
 	}
 }
 
@@ -666,26 +938,24 @@ func (
 ) parseUna(
 	una uint32,
 ) {
-	count := 0
-	for k := range GFcp.SndBuf {
-		GFcpSeg := &GFcp.SndBuf[k]
-		if _itimediff(
+	for {
+		GFcpSeg := GFcp.sndBuf.front()
+		if GFcpSeg == nil || _itimediff(
 			una,
 			GFcpSeg.sn,
-		) > 0 {
-			GFcp.delSegment(
-				GFcpSeg,
-			)
-			count++
-		} else {
+		) <= 0 {
 			break
 		}
-	}
-	if count > 0 {
-		GFcp.SndBuf = GFcp.removeFront(
-			GFcp.SndBuf,
-			count,
+		GFcp.sndBytes -= len(
+			GFcpSeg.data,
+		)
+		GFcp.sndHeld -= cap(
+			GFcpSeg.data,
+		)
+		GFcp.delSegment(
+			GFcpSeg,
 		)
+		GFcp.sndBuf.popFront()
 	}
 }
 
@@ -711,7 +981,7 @@ func (
 	sn := newGFcpSeg.sn
 	if _itimediff(
 		sn,
-		GFcp.rcvNxt+GFcp.rcvWnd,
+		GFcp.rcvNxt+GFcp.rcvWindow(),
 	) >= 0 ||
 		_itimediff(
 			sn,
@@ -720,76 +990,53 @@ func (
 		return true
 	}
 
-	n := len(
-		GFcp.rcvBuf,
-	) - 1
-	insertIdx := 0
-	repeat := false
-	for i := n; i >= 0; i-- {
-		GFcpSeg := &GFcp.rcvBuf[i]
-		if GFcpSeg.sn == sn {
-			repeat = true
-			break
-		}
-		if _itimediff(
-			sn,
-			GFcpSeg.sn,
-		) > 0 {
-			insertIdx = i + 1
-			break
-		}
-	}
-
+	repeat := GFcp.rcvBuf.at(
+		sn,
+	) != nil
 	if !repeat {
-		dataCopy := KxmitBuf.Get().([]byte)[:len(newGFcpSeg.data)]
+		dataCopy := xmitBuf.Get(
+			len(newGFcpSeg.data),
+		)
 		copy(
 			dataCopy,
 			newGFcpSeg.data,
 		)
 		newGFcpSeg.data = dataCopy
-
-		if insertIdx == n+1 {
-			GFcp.rcvBuf = append(
-				GFcp.rcvBuf,
-				newGFcpSeg,
-			)
-		} else {
-			GFcp.rcvBuf = append(
-				GFcp.rcvBuf,
-				Segment{},
-			)
-			copy(
-				GFcp.rcvBuf[insertIdx+1:],
-				GFcp.rcvBuf[insertIdx:],
-			)
-			GFcp.rcvBuf[insertIdx] = newGFcpSeg
-		}
+		GFcp.rcvBuf.insert(
+			newGFcpSeg,
+		)
+		GFcp.rcvBytes += len(
+			dataCopy,
+		)
+		GFcp.rcvHeld += cap(
+			dataCopy,
+		)
 	}
-	count := 0
-	for k := range GFcp.rcvBuf {
-		GFcpSeg := &GFcp.rcvBuf[k]
-		if GFcpSeg.sn == GFcp.rcvNxt && len(
-			GFcp.rcvQueue,
-		) < int(
-			GFcp.rcvWnd,
-		) {
-			GFcp.rcvNxt++
-			count++
-		} else {
+	GFcp.moveRcvBuf()
+	return repeat
+}
+
+// moveRcvBuf moves the segments received in order to the receive
+// queue, as far as the window allows.
+func (
+	GFcp *GFCP,
+) moveRcvBuf() {
+	for len(
+		GFcp.rcvQueue,
+	) < int(
+		GFcp.rcvWindow(),
+	) {
+		GFcpSeg := GFcp.rcvBuf.front()
+		if GFcpSeg == nil || GFcpSeg.sn != GFcp.rcvNxt {
 			break
 		}
-	}
-	if count > 0 {
 		GFcp.rcvQueue = append(
 			GFcp.rcvQueue,
-			GFcp.rcvBuf[:count]...,
-		)
-		GFcp.rcvBuf = GFcp.removeFront(
-			GFcp.rcvBuf,
-			count,
+			*GFcpSeg,
 		)
+		GFcp.rcvBuf.popFront()
+		GFcp.rcvNxt++
 	}
-	return repeat
 }
 
 // Input receives a (low-level) UDP packet, and determinines if
@@ -895,7 +1142,7 @@ func (
 			repeat := true
 			if _itimediff(
 				sn,
-				GFcp.rcvNxt+GFcp.rcvWnd,
+				GFcp.rcvNxt+GFcp.rcvWindow(),
 			) < 0 {
 				GFcp.ackPush(
 					sn,
@@ -940,7 +1187,7 @@ func (
 		inSegs,
 	)
 	if flag != 0 && regular {
-		current := CurrentMs()
+		current := GFcp.currentMs()
 		if _itimediff(
 			current,
 			latest,
@@ -992,12 +1239,13 @@ func (
 func (
 	GFcp *GFCP,
 ) wndUnused() uint16 {
+	wnd := GFcp.rcvWindow()
 	if len(
 		GFcp.rcvQueue,
-	) < int(GFcp.rcvWnd) {
+	) < int(wnd) {
 		return uint16(
 			int(
-				GFcp.rcvWnd,
+				wnd,
 			) - len(
 				GFcp.rcvQueue,
 			),
@@ -1071,7 +1319,7 @@ func (
 		return GFcp.interval
 	}
 	if GFcp.rmtWnd == 0 {
-		current := CurrentMs()
+		current := GFcp.currentMs()
 		if GFcp.probeWait == 0 {
 			GFcp.probeWait = GfcpProbeInit
 			GFcp.tsProbe = current + GFcp.probeWait
@@ -1089,9 +1337,10 @@ func (
 			GFcp.tsProbe = current + GFcp.probeWait
 			GFcp.probe |= GfcpAskSend
 		}
+	} else {
+		GFcp.tsProbe = 0
+		GFcp.probeWait = 0
 	}
-	GFcp.tsProbe = 0
-	GFcp.probeWait = 0
 	if (GFcp.probe & GfcpAskSend) != 0 {
 		GFcpSeg.cmd = GfcpCmdWask
 		makeSpace(
@@ -1133,8 +1382,7 @@ func (
 		newGFcpSeg.conv = GFcp.conv
 		newGFcpSeg.cmd = GfcpCmdPush
 		newGFcpSeg.sn = GFcp.sndNxt
-		GFcp.SndBuf = append(
-			GFcp.SndBuf,
+		GFcp.sndBuf.insert(
 			newGFcpSeg,
 		)
 		GFcp.sndNxt++
@@ -1152,7 +1400,8 @@ func (
 	if GFcp.fastresend <= 0 {
 		resent = 0xFFFFFFFF
 	}
-	current := CurrentMs()
+	GFcp.applyFastacks()
+	current := GFcp.currentMs()
 	var change,
 		lostSegs,
 		fastGFcpRestransmittedSegments,
@@ -1160,11 +1409,13 @@ func (
 	minrto := int32(
 		GFcp.interval,
 	)
-	ref := GFcp.SndBuf[:len(
-		GFcp.SndBuf,
-	)]
-	for k := range ref {
-		Segment := &ref[k]
+	for k := uint32(0); k < GFcp.sndBuf.span; k++ {
+		Segment := GFcp.sndBuf.slot(
+			k,
+		)
+		if Segment == nil {
+			continue
+		}
 		needsend := false
 		if Segment.acked == 1 {
 			continue
@@ -1201,7 +1452,8 @@ func (
 			earlyGFcpRestransmittedSegments++
 		}
 		if needsend {
-			current = CurrentMs()
+			current = GFcp.currentMs()
+			GFcp.xmitSegs++
 			Segment.Kxmit++
 			Segment.ts = current
 			Segment.wnd = GFcpSeg.wnd
@@ -1260,6 +1512,7 @@ func (
 			&DefaultSnsi.GFcpRestransmittedSegments,
 			sum,
 		)
+		GFcp.resentSegs += sum
 	}
 	if GFcp.nocwnd == 0 {
 		if change > 0 {
@@ -1296,7 +1549,7 @@ func (
 	GFcp *GFCP,
 ) Update() {
 	var slap int32
-	current := CurrentMs()
+	current := GFcp.currentMs()
 	if GFcp.updated == 0 {
 		GFcp.updated = 1
 		GFcp.tsFlush = current
@@ -1333,7 +1586,7 @@ func (
 func (
 	GFcp *GFCP,
 ) Check() uint32 {
-	current := CurrentMs()
+	current := GFcp.currentMs()
 	tsFlush := GFcp.tsFlush
 	tmFlush := int32(
 		math.MaxInt32,
@@ -1367,8 +1620,13 @@ func (
 		tsFlush,
 		current,
 	)
-	for k := range GFcp.SndBuf {
-		GFcpSeg := &GFcp.SndBuf[k]
+	for k := uint32(0); k < GFcp.sndBuf.span; k++ {
+		GFcpSeg := GFcp.sndBuf.slot(
+			k,
+		)
+		if GFcpSeg == nil || GFcpSeg.acked == 1 {
+			continue
+		}
 		diff := _itimediff(
 			GFcpSeg.GFcpResendTs,
 			current,
@@ -1492,17 +1750,58 @@ func (
 	return 0
 }
 
+// idle reports whether a flush has nothing to send, and no timers
+// to run, until the next input or send.
+func (
+	GFcp *GFCP,
+) idle() bool {
+	return GFcp.sndBuf.size() == 0 && len(
+		GFcp.sndQueue,
+	) == 0 && len(
+		GFcp.acklist,
+	) == 0 && GFcp.probe == 0 && GFcp.rmtWnd != 0
+}
+
 // WaitSnd shows how many packets are queued to be sent
 func (
 	GFcp *GFCP,
 ) WaitSnd() int {
-	return len(
-		GFcp.SndBuf,
-	) + len(
+	return GFcp.sndBuf.size() + len(
 		GFcp.sndQueue,
 	)
 }
 
+// SndBuf returns copies of the segments sent and not yet
+// acknowledged, in sequence order
+func (
+	GFcp *GFCP,
+) SndBuf() []Segment {
+	segs := make(
+		[]Segment,
+		0,
+		GFcp.sndBuf.size(),
+	)
+	for k := uint32(0); k < GFcp.sndBuf.span; k++ {
+		if seg := GFcp.sndBuf.slot(
+			k,
+		); seg != nil {
+			segs = append(
+				segs,
+				*seg,
+			)
+		}
+	}
+	return segs
+}
+
+// WaitSndBytes shows how many bytes of data are queued to be sent or
+// not yet acknowledged
+func (
+	GFcp *GFCP,
+) WaitSndBytes() int {
+	return GFcp.sndBytes
+}
+
 func (
 	GFcp *GFCP,
 ) removeFront(
@@ -0,0 +1,107 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"sort"
+	"sync"
+)
+
+// BufferPool hands out byte slices from size classes. Each class is a
+// sync.Pool of pointers to its buffers, and the pointers themselves
+// are recycled, so that neither Get nor Put allocates once the pool
+// is warm.
+type BufferPool struct {
+	classes []int       // buffer sizes, ascending
+	pools   []sync.Pool // *[]byte of each class
+	refs    sync.Pool   // spare *[]byte, for Put
+}
+
+// NewBufferPool returns a BufferPool with buffers of the given sizes.
+func NewBufferPool(
+	classes ...int,
+) *BufferPool {
+	p := &BufferPool{
+		classes: append(
+			[]int(nil),
+			classes...,
+		),
+	}
+	sort.Ints(
+		p.classes,
+	)
+	p.pools = make(
+		[]sync.Pool,
+		len(p.classes),
+	)
+	return p
+}
+
+// Get returns a buffer of length size, from the smallest class it fits
+// in; larger buffers are allocated, and never pooled.
+func (
+	p *BufferPool,
+) Get(
+	size int,
+) []byte {
+	c := sort.SearchInts(
+		p.classes,
+		size,
+	)
+	if c == len(
+		p.classes,
+	) {
+		return make(
+			[]byte,
+			size,
+		)
+	}
+	ref, _ := p.pools[c].Get().(*[]byte)
+	if ref == nil {
+		return make(
+			[]byte,
+			size,
+			p.classes[c],
+		)
+	}
+	buf := *ref
+	*ref = nil
+	p.refs.Put(
+		ref,
+	)
+	return buf[:size]
+}
+
+// Put returns buf to the largest class its capacity can serve; buf
+// must not be used afterwards.
+func (
+	p *BufferPool,
+) Put(
+	buf []byte,
+) {
+	c := sort.SearchInts(
+		p.classes,
+		cap(buf)+1,
+	) - 1
+	if c < 0 {
+		return
+	}
+	ref, _ := p.refs.Get().(*[]byte)
+	if ref == nil {
+		ref = new(
+			[]byte,
+		)
+	}
+	*ref = buf[:p.classes[c]]
+	p.pools[c].Put(
+		ref,
+	)
+}
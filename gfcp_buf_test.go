@@ -0,0 +1,192 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+func TestBufferPool(
+	t *testing.T,
+) {
+	p := gfcp.NewBufferPool(
+		1500,
+		128,
+	)
+	for _, tc := range []struct {
+		size,
+		cap int
+	}{
+		{
+			0,
+			128,
+		},
+		{
+			128,
+			128,
+		},
+		{
+			129,
+			1500,
+		},
+		{
+			1501,
+			1501,
+		},
+	} {
+		buf := p.Get(
+			tc.size,
+		)
+		if len(
+			buf,
+		) != tc.size || cap(
+			buf,
+		) != tc.cap {
+			t.Fatalf(
+				"Get(%v): len %v cap %v, want cap %v",
+				tc.size,
+				len(buf),
+				cap(buf),
+				tc.cap,
+			)
+		}
+		p.Put(
+			buf,
+		)
+	}
+	// a returned buffer serves the largest class it can
+	p.Put(
+		make(
+			[]byte,
+			1000,
+		),
+	)
+	if buf := p.Get(
+		100,
+	); cap(
+		buf,
+	) < 128 {
+		t.Fatalf(
+			"Get(100): cap %v",
+			cap(buf),
+		)
+	}
+	if allocs := testing.AllocsPerRun(
+		100,
+		func() {
+			p.Put(
+				p.Get(
+					1400,
+				),
+			)
+		},
+	); allocs != 0 {
+		t.Fatalf(
+			"%v allocations per Get and Put",
+			allocs,
+		)
+	}
+}
+
+func BenchmarkBufferPool(
+	b *testing.B,
+) {
+	p := gfcp.NewBufferPool(
+		128,
+		512,
+		1536,
+		gfcp.GFcpMtuLimit,
+	)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Put(
+			p.Get(
+				1400,
+			),
+		)
+	}
+}
+
+// TestStreamSmallWrites grows stream segments past the pool class of
+// their first write.
+func TestStreamSmallWrites(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(
+		true,
+	)
+	cli.SetWriteDelay(
+		true,
+	)
+	msg := make(
+		[]byte,
+		100,
+	)
+	for i := 0; i < 100; i++ {
+		if _, err := cli.Write(
+			msg,
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if _, err := io.ReadFull(
+		s,
+		make(
+			[]byte,
+			100*len(msg),
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"time"
+)
+
+// Clock is a source of time for GFCP state machines and Updaters.
+// The default is the system clock; tests may substitute a virtual one,
+// such as gfcptest.ManualClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(
+		d time.Duration,
+	) Timer
+}
+
+// Timer is the part of *time.Timer that an Updater relies on.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(
+		d time.Duration,
+	) bool
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by package time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (
+	systemClock,
+) Now() time.Time {
+	return time.Now()
+}
+
+func (
+	systemClock,
+) NewTimer(
+	d time.Duration,
+) Timer {
+	return systemTimer{
+		time.NewTimer(
+			d,
+		),
+	}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (
+	t systemTimer,
+) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+var refTime = time.Now()
+
+// CurrentMs returns the system clock in milliseconds, as used by GFCP.
+func CurrentMs() uint32 {
+	return clockMs(
+		SystemClock,
+	)
+}
+
+func clockMs(
+	c Clock,
+) uint32 {
+	return uint32(
+		c.Now().Sub(
+			refTime,
+		) / time.Millisecond,
+	)
+}
+
+// setClock makes the session, its GFCP and its FEC decoder read time
+// from c; s.mu must be held.
+func (
+	s *UDPSession,
+) setClock(
+	c Clock,
+) {
+	s.GFcp.SetClock(
+		c,
+	)
+	if s.FecDecoder != nil {
+		s.FecDecoder.SetClock(
+			c,
+		)
+	}
+}
+
+// now returns the time on the clock of the session; s.mu must be held.
+func (
+	s *UDPSession,
+) now() time.Time {
+	return s.GFcp.clock.Now()
+}
+
+// clock returns the clock of the Updater that sessions accepted by the
+// Listener are scheduled on.
+func (
+	l *Listener,
+) clock() Clock {
+	if u, ok := l.updater.Load().(*Updater); ok {
+		return u.clock
+	}
+	return DefaultUpdater().clock
+}
@@ -0,0 +1,214 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+type sentSegment struct {
+	at  time.Duration
+	cmd byte
+	sn  uint32
+	wnd uint16
+}
+
+// clockedGFCP returns a GFCP on a manual clock that records every
+// segment it outputs, stamped with the virtual time since start.
+func clockedGFCP(
+	clock *gfcptest.ManualClock,
+	sent *[]sentSegment,
+) *gfcp.GFCP {
+	start := clock.Now()
+	GFcp := gfcp.NewGFCP(
+		0x11223344,
+		func(
+			buf []byte,
+			size int,
+		) {
+			buf = buf[:size]
+			for len(
+				buf,
+			) >= gfcp.GfcpOverhead {
+				length := binary.LittleEndian.Uint32(
+					buf[20:],
+				)
+				*sent = append(
+					*sent,
+					sentSegment{
+						at: clock.Now().Sub(
+							start,
+						),
+						cmd: buf[4],
+						sn: binary.LittleEndian.Uint32(
+							buf[12:],
+						),
+						wnd: binary.LittleEndian.Uint16(
+							buf[6:],
+						),
+					},
+				)
+				buf = buf[gfcp.GfcpOverhead+int(length):]
+			}
+		},
+	)
+	GFcp.SetClock(
+		clock,
+	)
+	return GFcp
+}
+
+func TestClockRetransmit(
+	t *testing.T,
+) {
+	clock := gfcptest.NewManualClock(
+		time.Unix(
+			0,
+			0,
+		),
+	)
+	var sent []sentSegment
+	GFcp := clockedGFCP(
+		clock,
+		&sent,
+	)
+	GFcp.NoDelay(
+		0,
+		10,
+		0,
+		0,
+	)
+	GFcp.Send(
+		[]byte(
+			"lost",
+		),
+	)
+	for i := 0; i <= 1100; i += 10 {
+		GFcp.Update()
+		clock.Advance(
+			10 * time.Millisecond,
+		)
+	}
+	// The congestion window opens on the first flush, so the segment
+	// first leaves on the second one, 10ms in. The initial RTO is
+	// GfcpRtoDef, and without nodelay each timeout adds another RTO.
+	first := 10 * time.Millisecond
+	want := []time.Duration{
+		first,
+		first + gfcp.GfcpRtoDef*time.Millisecond,
+		first + 3*gfcp.GfcpRtoDef*time.Millisecond,
+	}
+	if len(
+		sent,
+	) != len(
+		want,
+	) {
+		t.Fatalf(
+			"sent %v segments, want %v: %v",
+			len(sent),
+			len(want),
+			sent,
+		)
+	}
+	for k := range want {
+		if sent[k].cmd != gfcp.GfcpCmdPush || sent[k].at != want[k] {
+			t.Errorf(
+				"transmission %v: got %+v, want push at %v",
+				k,
+				sent[k],
+				want[k],
+			)
+		}
+	}
+}
+
+func TestClockWindowProbe(
+	t *testing.T,
+) {
+	clock := gfcptest.NewManualClock(
+		time.Unix(
+			0,
+			0,
+		),
+	)
+	var sent []sentSegment
+	GFcp := clockedGFCP(
+		clock,
+		&sent,
+	)
+	GFcp.NoDelay(
+		0,
+		100,
+		0,
+		0,
+	)
+	// a zero window advertisement from the peer
+	wins := make(
+		[]byte,
+		gfcp.GfcpOverhead,
+	)
+	binary.LittleEndian.PutUint32(
+		wins,
+		0x11223344,
+	)
+	wins[4] = gfcp.GfcpCmdWask
+	GFcp.Input(
+		wins,
+		true,
+		false,
+	)
+	for i := 0; i <= 20000; i += 100 {
+		GFcp.Update()
+		clock.Advance(
+			100 * time.Millisecond,
+		)
+	}
+	var probes []time.Duration
+	for _, seg := range sent {
+		if seg.cmd == gfcp.GfcpCmdWask {
+			probes = append(
+				probes,
+				seg.at,
+			)
+		}
+	}
+	// first probe after GfcpProbeInit, then backing off by half again
+	want := []time.Duration{
+		gfcp.GfcpProbeInit * time.Millisecond,
+		(gfcp.GfcpProbeInit + gfcp.GfcpProbeInit*3/2) * time.Millisecond,
+	}
+	if len(
+		probes,
+	) != len(
+		want,
+	) {
+		t.Fatalf(
+			"probes at %v, want %v",
+			probes,
+			want,
+		)
+	}
+	for k := range want {
+		if probes[k] != want[k] {
+			t.Errorf(
+				"probe %v at %v, want %v",
+				k,
+				probes[k],
+				want[k],
+			)
+		}
+	}
+}
@@ -13,8 +13,10 @@ package gfcp
 import (
 	"encoding/binary"
 	"sync/atomic"
+	"time"
 
 	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -24,8 +26,112 @@ const (
 	KTypeData = 0xf1
 	// KTypeParity ...
 	KTypeParity = 0xf2
+
+	// The low byte of the FEC flag is the packet type, and the high
+	// byte the header version. Version 0 headers are seqid and flag
+	// only, and both ends must agree on the shard layout. Version 1
+	// headers extend them with the layout of the packet's group, so
+	// the layout may change from one group to the next.
+	fecVersion0 = 0
+	fecVersion1 = 1
+
+	// fecHeaderSizeV1 adds data shards, parity shards, codec and the
+	// count of data shards actually in the group.
+	fecHeaderSizeV1      = fecHeaderSize + 4
+	fecHeaderSizeV1Plus2 = fecHeaderSizeV1 + 2
+
+	// FECCodecReedSolomon is the default, and the codec of version 0.
+	FECCodecReedSolomon = 0
+
+	// fecMaxShards bounds data and parity shards, which a version 1
+	// header stores in a byte each, and Reed-Solomon limits to 256.
+	fecMaxShards = 128
+	// fecMaxAge is how long, by default, a decoder keeps shards of
+	// groups that do not complete
+	fecMaxAge = 3 * time.Second
+	// fecMaxInterleave bounds the FEC groups an encoder fills at once
+	fecMaxInterleave = 16
+	// fecMaxCodecs bounds the codecs a decoder keeps for version 1
+	// layouts.
+	fecMaxCodecs = 16
 )
 
+// FECConfig describes versioned FEC, whose packets carry the shard
+// layout of their group. Sessions using it can change the layout as
+// they go, and receivers need no out-of-band agreement on it.
+type FECConfig struct {
+	DataShards   int // data shards per group
+	ParityShards int // initial parity shards per group
+	// Adaptive lets the session tune the parity shards between
+	// MinParityShards and MaxParityShards to the loss it measures.
+	Adaptive        bool
+	MinParityShards int
+	MaxParityShards int
+	// FlushDelay, if set, is how long a session waits for more data
+	// before it sends the parity of groups it could not fill. Only
+	// versioned FEC can flush: sessions dialed with data and parity
+	// shards but no FECConfig use version 0 headers, which cannot tell
+	// decoders that a group was cut short, so the last packets of a
+	// burst stay unprotected until more data fills their group.
+	FlushDelay time.Duration
+	// RxLimit is how many shards the decoder keeps, by default three
+	// times the groups in flight; AutoRxLimit, if larger, lets it grow
+	// that up to AutoRxLimit on links that reorder more.
+	// See FecDecoder.SetRxLimit.
+	RxLimit     int
+	AutoRxLimit int
+	// Interleave is the number of groups consecutive packets are
+	// spread over, 1 if zero; see FecEncoder.SetInterleave.
+	Interleave int
+	// Codec is FECCodecReedSolomon, FECCodecXOR or FECCodec2DXOR.
+	// Only Reed-Solomon can be adaptive, as the XOR codecs fix the
+	// parity shards for a number of data shards.
+	Codec byte
+}
+
+// validate fills in the parity bounds, and checks the layout.
+func (
+	cfg *FECConfig,
+) validate() (
+	FECConfig,
+	error,
+) {
+	c := *cfg
+	if !c.Adaptive {
+		c.MinParityShards = c.ParityShards
+		c.MaxParityShards = c.ParityShards
+	}
+	if c.MinParityShards <= 0 {
+		c.MinParityShards = 1
+	}
+	if c.Interleave <= 0 {
+		c.Interleave = 1
+	}
+	if c.MaxParityShards < c.ParityShards {
+		c.MaxParityShards = c.ParityShards
+	}
+	if c.ParityShards < c.MinParityShards {
+		c.ParityShards = c.MinParityShards
+	}
+	if c.DataShards <= 0 || c.DataShards > fecMaxShards ||
+		c.MaxParityShards > fecMaxShards ||
+		c.MinParityShards > c.MaxParityShards ||
+		c.Interleave > fecMaxInterleave ||
+		(c.Adaptive && c.Codec != FECCodecReedSolomon) {
+		return c, errors.New(
+			"invalid FEC shard layout",
+		)
+	}
+	if _, err := newFECCodec(
+		c.Codec,
+		c.DataShards,
+		c.ParityShards,
+	); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
 // FecPacket ...
 type FecPacket []byte
 
@@ -37,31 +143,99 @@ func (
 	)
 }
 
+// flag returns the packet type, without the header version.
 func (
 	bts FecPacket,
 ) flag() uint16 {
-	return binary.LittleEndian.Uint16(
-		bts[4:],
+	return uint16(
+		bts[4],
 	)
 }
 
+func (
+	bts FecPacket,
+) version() byte {
+	return bts[5]
+}
+
+// headerLen returns the size of the FEC header, 0 if unknown.
+func (
+	bts FecPacket,
+) headerLen() int {
+	switch bts.version() {
+	case fecVersion0:
+		return fecHeaderSize
+	case fecVersion1:
+		if len(
+			bts,
+		) >= fecHeaderSizeV1 {
+			return fecHeaderSizeV1
+		}
+	}
+	return 0
+}
+
+// layout returns the shard layout of a version 1 packet.
+func (
+	bts FecPacket,
+) layout() (
+	dataShards,
+	parityShards int,
+	codec byte,
+) {
+	return int(
+			bts[6],
+		), int(
+			bts[7],
+		),
+		bts[8]
+}
+
+// count returns the data shards of the packet's group, which a
+// version 1 parity shard of a group flushed early tells.
+func (
+	bts FecPacket,
+) count(
+	dataShards int,
+) int {
+	if bts.version() == fecVersion1 && bts[9] > 0 &&
+		int(bts[9]) < dataShards {
+		return int(
+			bts[9],
+		)
+	}
+	return dataShards
+}
+
 func (
 	bts FecPacket,
 ) data() []byte {
-	return bts[6:]
+	return bts[bts.headerLen():]
 }
 
 // FecDecoder ...
 type FecDecoder struct {
 	rxlimit      int
-	dataShards   int
+	dataShards   int // layout of version 0 packets
 	parityShards int
 	shardSize    int
 	rx           []FecPacket
+	held         int // capacity of the packets in rx
 	DecodeCache  [][]byte
 	flagCache    []bool
 	zeros        []byte
-	codec        reedsolomon.Encoder
+	codec        FECCodec
+	codecs       map[[3]int]FECCodec // for version 1 layouts
+	rxTs         []int64             // arrival of each rx entry, by now()
+	rxbase       int                 // rxlimit when not auto-sized
+	rxauto       int                 // bound of the auto-sized rxlimit, 0 if fixed
+	highest      uint32              // highest seqid seen
+	reorder      int                 // estimated reordering distance
+	arrivals     int                 // packets since the estimate last decayed
+	clock        Clock
+	epoch        time.Time     // of now(), on clock
+	maxAge       time.Duration // for expire
+	swept        int64         // last expire sweep
 }
 
 // NewFECDecoder ...
@@ -81,6 +255,7 @@ func NewFECDecoder(
 		FecDecoder,
 	)
 	dec.rxlimit = rxlimit
+	dec.rxbase = rxlimit
 	dec.dataShards = dataShards
 	dec.parityShards = parityShards
 	dec.shardSize = dataShards + parityShards
@@ -92,6 +267,12 @@ func NewFECDecoder(
 		return nil
 	}
 	dec.codec = codec
+	dec.codecs = make(
+		map[[3]int]FECCodec,
+	)
+	dec.clock = SystemClock
+	dec.epoch = dec.clock.Now()
+	dec.maxAge = fecMaxAge
 	dec.DecodeCache = make(
 		[][]byte,
 		dec.shardSize,
@@ -115,6 +296,17 @@ func (
 ) (
 	recovered [][]byte,
 ) {
+	dataShards, parityShards, codec := dec.layout(
+		in,
+	)
+	if codec == nil {
+		return nil
+	}
+	shardSize := dataShards + parityShards
+	dec.measureReorder(
+		in.seqid(),
+		shardSize,
+	)
 	n := len(
 		dec.rx,
 	) - 1
@@ -132,17 +324,29 @@ func (
 	}
 
 	// make a copy
-	pkt := FecPacket(KxmitBuf.Get().([]byte)[:len(in)])
+	pkt := FecPacket(
+		xmitBuf.Get(
+			len(in),
+		),
+	)
 	copy(
 		pkt,
 		in,
 	)
+	dec.held += cap(
+		pkt,
+	)
 
+	now := dec.now()
 	if insertIdx == n+1 {
 		dec.rx = append(
 			dec.rx,
 			pkt,
 		)
+		dec.rxTs = append(
+			dec.rxTs,
+			now,
+		)
 	} else {
 		dec.rx = append(
 			dec.rx,
@@ -153,16 +357,25 @@ func (
 			dec.rx[insertIdx:],
 		)
 		dec.rx[insertIdx] = pkt
+		dec.rxTs = append(
+			dec.rxTs,
+			0,
+		)
+		copy(
+			dec.rxTs[insertIdx+1:],
+			dec.rxTs[insertIdx:],
+		)
+		dec.rxTs[insertIdx] = now
 	}
 
-	shardBegin := pkt.seqid() - pkt.seqid()%uint32(dec.shardSize)
-	shardEnd := shardBegin + uint32(dec.shardSize) - 1
+	shardBegin := pkt.seqid() - pkt.seqid()%uint32(shardSize)
+	shardEnd := shardBegin + uint32(shardSize) - 1
 
-	searchBegin := insertIdx - int(pkt.seqid()%uint32(dec.shardSize))
+	searchBegin := insertIdx - int(pkt.seqid()%uint32(shardSize))
 	if searchBegin < 0 {
 		searchBegin = 0
 	}
-	searchEnd := searchBegin + dec.shardSize - 1
+	searchEnd := searchBegin + shardSize - 1
 	if searchEnd >= len(
 		dec.rx,
 	) {
@@ -171,84 +384,148 @@ func (
 		) - 1
 	}
 
-	if searchEnd-searchBegin+1 >= dec.dataShards {
-		var numshard, numDataShard, first, maxlen int
+	var numshard, numDataShard, first, maxlen int
 
-		shards := dec.DecodeCache
-		shardsflag := dec.flagCache
-		for k := range dec.DecodeCache {
-			shards[k] = nil
-			shardsflag[k] = false
-		}
+	if cap(
+		dec.DecodeCache,
+	) < shardSize {
+		dec.DecodeCache = make(
+			[][]byte,
+			shardSize,
+		)
+		dec.flagCache = make(
+			[]bool,
+			shardSize,
+		)
+	}
+	shards := dec.DecodeCache[:shardSize]
+	shardsflag := dec.flagCache[:shardSize]
+	for k := range shards {
+		shards[k] = nil
+		shardsflag[k] = false
+	}
 
-		for i := searchBegin; i <= searchEnd; i++ {
-			seqid := dec.rx[i].seqid()
-			if _itimediff(
-				seqid,
-				shardEnd,
-			) > 0 {
-				break
-			} else if _itimediff(
-				seqid,
-				shardBegin,
-			) >= 0 {
-				shards[seqid%uint32(
-					dec.shardSize,
-				)] = dec.rx[i].data()
-				shardsflag[seqid%uint32(
-					dec.shardSize,
-				)] = true
-				numshard++
-				if dec.rx[i].flag() == KTypeData {
-					numDataShard++
-				}
-				if numshard == 1 {
-					first = i
-				}
-				if len(
+	// a group flushed early holds count data shards, as its parity
+	// tells; the others are zeros, and are never sent
+	count := dataShards
+	for i := searchBegin; i <= searchEnd; i++ {
+		seqid := dec.rx[i].seqid()
+		if _itimediff(
+			seqid,
+			shardEnd,
+		) > 0 {
+			break
+		} else if _itimediff(
+			seqid,
+			shardBegin,
+		) >= 0 {
+			shards[seqid%uint32(
+				shardSize,
+			)] = dec.rx[i].data()
+			shardsflag[seqid%uint32(
+				shardSize,
+			)] = true
+			numshard++
+			if dec.rx[i].flag() == KTypeData {
+				numDataShard++
+			}
+			if numshard == 1 {
+				first = i
+			}
+			if len(
+				dec.rx[i].data(),
+			) > maxlen {
+				maxlen = len(
 					dec.rx[i].data(),
-				) > maxlen {
-					maxlen = len(
-						dec.rx[i].data(),
-					)
-				}
+				)
+			}
+			if c := dec.rx[i].count(
+				dataShards,
+			); c < count {
+				count = c
 			}
 		}
+	}
+	virtual := dataShards - count
 
-		if numDataShard == dec.dataShards {
-			dec.rx = dec.freeRange(
-				first,
-				numshard,
-				dec.rx,
+	if numDataShard+virtual >= dataShards {
+		dec.freeRange(
+			first,
+			numshard,
+		)
+	} else if numshard+virtual >= dataShards {
+		// shards are padded to the longest in place, so grow any
+		// buffer too small for that
+		for i := first; i < first+numshard; i++ {
+			if cap(
+				dec.rx[i],
+			) >= dec.rx[i].headerLen()+maxlen {
+				continue
+			}
+			grown := FecPacket(
+				xmitBuf.Get(
+					dec.rx[i].headerLen() + maxlen,
+				)[:len(dec.rx[i])],
 			)
-		} else if numshard >= dec.dataShards {
-			for k := range shards {
-				if shards[k] != nil {
-					dlen := len(
+			copy(
+				grown,
+				dec.rx[i],
+			)
+			dec.held += cap(
+				grown,
+			) - cap(
+				dec.rx[i],
+			)
+			xmitBuf.Put(
+				dec.rx[i],
+			)
+			dec.rx[i] = grown
+			shards[grown.seqid()%uint32(
+				shardSize,
+			)] = grown.data()
+		}
+		for k := range shards {
+			if shards[k] != nil {
+				dlen := len(
+					shards[k],
+				)
+				shards[k] = shards[k][:maxlen]
+				copy(shards[k][dlen:], dec.zeros)
+			} else if k >= count && k < dataShards {
+				shards[k] = dec.zeros[:maxlen]
+				shardsflag[k] = true
+			} else if k < dataShards {
+				shards[k] = xmitBuf.Get(
+					maxlen,
+				)[:0]
+			}
+		}
+		err := codec.ReconstructData(
+			shards,
+		)
+		if err == nil {
+			for k := range shards[:dataShards] {
+				if !shardsflag[k] {
+					recovered = append(
+						recovered,
 						shards[k],
 					)
-					shards[k] = shards[k][:maxlen]
-					copy(shards[k][dlen:], dec.zeros)
-				} else if k < dec.dataShards {
-					shards[k] = KxmitBuf.Get().([]byte)[:0]
 				}
 			}
-			if err := dec.codec.ReconstructData(
-				shards,
-			); err == nil {
-				for k := range shards[:dec.dataShards] {
-					if !shardsflag[k] {
-						recovered = append(
-							recovered,
-							shards[k],
-						)
-					}
+		} else {
+			for k := range shards[:dataShards] {
+				if !shardsflag[k] {
+					xmitBuf.Put(
+						shards[k][:cap(shards[k])],
+					)
 				}
 			}
-			dec.rx = dec.freeRange(
+		}
+		// XOR codecs may repair the group once more shards arrive
+		if err != reedsolomon.ErrTooFewShards {
+			dec.freeRange(
 				first,
 				numshard,
-				dec.rx,
 			)
 		}
 	}
@@ -260,25 +537,90 @@ func (
 				1,
 			)
 		}
-		dec.rx = dec.freeRange(
+		dec.freeRange(
 			0,
 			1,
-			dec.rx,
 		)
 	}
+	dec.expire(
+		now,
+	)
 	return
 }
 
+// layout returns the shard layout and codec of the packet's group, or
+// a nil codec if the packet can not be decoded.
+func (
+	dec *FecDecoder,
+) layout(
+	in FecPacket,
+) (
+	dataShards,
+	parityShards int,
+	codec FECCodec,
+) {
+	switch in.version() {
+	case fecVersion0:
+		return dec.dataShards, dec.parityShards, dec.codec
+	case fecVersion1:
+		if len(
+			in,
+		) < fecHeaderSizeV1 {
+			return 0, 0, nil
+		}
+		var id byte
+		dataShards, parityShards, id = in.layout()
+		if dataShards <= 0 || parityShards <= 0 ||
+			dataShards > fecMaxShards || parityShards > fecMaxShards {
+			return 0, 0, nil
+		}
+		key := [3]int{
+			dataShards,
+			parityShards,
+			int(
+				id,
+			),
+		}
+		codec = dec.codecs[key]
+		if codec == nil {
+			var err error
+			codec, err = newFECCodec(
+				id,
+				dataShards,
+				parityShards,
+			)
+			if err != nil {
+				return 0, 0, nil
+			}
+			if len(
+				dec.codecs,
+			) >= fecMaxCodecs {
+				for k := range dec.codecs {
+					delete(
+						dec.codecs,
+						k,
+					)
+				}
+			}
+			dec.codecs[key] = codec
+		}
+		return dataShards, parityShards, codec
+	}
+	return 0, 0, nil
+}
+
 func (
 	dec *FecDecoder,
 ) freeRange(
 	first,
 	n int,
-	q []FecPacket,
-) []FecPacket {
+) {
+	q := dec.rx
 	for i := first; i < first+n; i++ {
-		// TODO(jhj): Switch to pointer to avoid allocation.
-		KxmitBuf.Put(
+		dec.held -= cap(
+			q[i],
+		)
+		xmitBuf.Put(
 			[]byte(
 				q[i],
 			),
@@ -286,15 +628,183 @@ func (
 	}
 
 	if first == 0 && n < (cap(q)/2) {
-		return q[n:]
+		dec.rx = q[n:]
+		dec.rxTs = dec.rxTs[n:]
+		return
 	}
 	copy(
 		q[first:],
 		q[first+n:],
 	)
-	return q[:len(
+	dec.rx = q[:len(
 		q,
 	)-n]
+	copy(
+		dec.rxTs[first:],
+		dec.rxTs[first+n:],
+	)
+	dec.rxTs = dec.rxTs[:len(
+		dec.rxTs,
+	)-n]
+}
+
+// SetClock makes the decoder age shards by c instead of the system
+// clock; the ages of the shards it holds carry over.
+func (
+	dec *FecDecoder,
+) SetClock(
+	c Clock,
+) {
+	if c == nil {
+		c = SystemClock
+	}
+	now := dec.now()
+	dec.clock = c
+	dec.epoch = c.Now().Add(
+		-time.Duration(
+			now,
+		),
+	)
+}
+
+// now returns the decoder's monotonic clock, in nanoseconds.
+func (
+	dec *FecDecoder,
+) now() int64 {
+	return int64(
+		dec.clock.Now().Sub(
+			dec.epoch,
+		),
+	)
+}
+
+// expire drops shards older than the maximum age, which are of groups
+// that can not complete in time to spare a retransmission. Entries are
+// ordered by seqid, not age, so they are swept every quarter age.
+func (
+	dec *FecDecoder,
+) expire(
+	now int64,
+) {
+	maxAge := int64(
+		dec.maxAge,
+	)
+	if maxAge <= 0 || now-dec.swept < maxAge/4 {
+		return
+	}
+	dec.swept = now
+	for i := 0; i < len(
+		dec.rx,
+	); {
+		if now-dec.rxTs[i] < maxAge {
+			i++
+			continue
+		}
+		if dec.rx[i].flag() == KTypeData {
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpFECExpiredShards,
+				1,
+			)
+		}
+		dec.freeRange(
+			i,
+			1,
+		)
+	}
+}
+
+// SetRxLimit sets how many shards the decoder keeps waiting for the
+// rest of their groups; links reordering shards further than that make
+// groups incomplete. With autoMax above limit, the decoder grows its
+// limit up to autoMax, from the reordering it sees, and shrinks it
+// back to limit when reordering fades.
+func (
+	dec *FecDecoder,
+) SetRxLimit(
+	limit,
+	autoMax int,
+) error {
+	if limit < dec.shardSize {
+		return errors.New(
+			"FEC receive limit below a group",
+		)
+	}
+	dec.rxbase = limit
+	dec.rxlimit = limit
+	dec.rxauto = 0
+	if autoMax > limit {
+		dec.rxauto = autoMax
+	}
+	return nil
+}
+
+// Occupancy returns the shards held, and the current limit.
+func (
+	dec *FecDecoder,
+) Occupancy() (
+	n,
+	limit int,
+) {
+	return len(
+		dec.rx,
+	), dec.rxlimit
+}
+
+// measureReorder tracks how far behind the highest seqid shards
+// arrive, and sizes an automatic rxlimit to hold twice that, plus a
+// group. The estimate decays by an eighth every 64 shards.
+func (
+	dec *FecDecoder,
+) measureReorder(
+	seqid uint32,
+	shardSize int,
+) {
+	if dec.rxauto == 0 {
+		return
+	}
+	if len(
+		dec.rx,
+	) == 0 && dec.highest == 0 {
+		dec.highest = seqid
+	}
+	if d := _itimediff(
+		dec.highest,
+		seqid,
+	); d < 0 {
+		dec.highest = seqid
+	} else if int(
+		d,
+	) > dec.reorder && int(
+		d,
+	) < dec.rxauto {
+		dec.reorder = int(
+			d,
+		)
+	}
+	dec.arrivals++
+	if dec.arrivals >= 64 {
+		dec.arrivals = 0
+		dec.reorder -= dec.reorder / 8
+	}
+	limit := 2*dec.reorder + shardSize
+	if limit < dec.rxbase {
+		limit = dec.rxbase
+	}
+	if limit > dec.rxauto {
+		limit = dec.rxauto
+	}
+	dec.rxlimit = limit
+}
+
+// SetMaxAge sets how long shards wait for the rest of their group
+// before they are dropped; zero keeps them until rxlimit pushes them
+// out.
+func (
+	dec *FecDecoder,
+) SetMaxAge(
+	maxAge time.Duration,
+) {
+	dec.maxAge = maxAge
 }
 
 type (
@@ -303,16 +813,30 @@ type (
 		dataShards    int
 		parityShards  int
 		shardSize     int
+		depth         int    // interleaving depth, the groups filled in turn
 		paws          uint32 // Protect Against Wrapped Sequence numbers
-		next          uint32 // next seqid
+		next          uint32 // first seqid of the interleaved groups being filled
 		shardCount    int    // count the number of datashards collected
-		maxSize       int    // track maximum data length in datashard
 		headerOffset  int    // FEC header offset
 		payloadOffset int    // FEC payload offset
-		shardCache    [][]byte
+		groups        []fecGroup
 		EncodeCache   [][]byte
+		flushCache    [][]byte
 		zeros         []byte
-		codec         reedsolomon.Encoder
+		codec         FECCodec
+		codecID       byte // FEC codec of version 1 headers
+		version       byte // FEC header version
+		pending       bool // a new layout waits for the groups to end
+		pendingData   int
+		pendingParity int
+		pendingDepth  int
+	}
+
+	// fecGroup is one of the interleaved groups being filled.
+	fecGroup struct {
+		shardCache [][]byte
+		count      int // data shards collected
+		maxSize    int // track maximum data length in datashard
 	}
 )
 
@@ -328,41 +852,228 @@ func NewFECEncoder(
 	enc := new(
 		FecEncoder,
 	)
-	enc.dataShards = dataShards
-	enc.parityShards = parityShards
-	enc.shardSize = dataShards + parityShards
-	enc.paws = (0xFFFFFFFF/uint32(enc.shardSize) - 1) * uint32(enc.shardSize)
 	enc.headerOffset = offset
 	enc.payloadOffset = enc.headerOffset + fecHeaderSize
-	codec, err := reedsolomon.New(
+	enc.zeros = make(
+		[]byte,
+		GFcpMtuLimit,
+	)
+	if enc.setLayout(
 		dataShards,
 		parityShards,
-	)
+		1,
+	) != nil {
+		return nil
+	}
+	return enc
+}
+
+// NewFECEncoderWithConfig returns an encoder writing version 1 headers,
+// whose shard layout can be changed with SetShards.
+func NewFECEncoderWithConfig(
+	cfg *FECConfig,
+	offset int,
+) *FecEncoder {
+	c, err := cfg.validate()
 	if err != nil {
 		return nil
 	}
-	enc.codec = codec
-	enc.EncodeCache = make(
-		[][]byte,
-		enc.shardSize,
-	)
-	enc.shardCache = make(
-		[][]byte,
-		enc.shardSize,
+	enc := new(
+		FecEncoder,
 	)
-	for k := range enc.shardCache {
-		enc.shardCache[k] = make(
-			[]byte,
-			GFcpMtuLimit,
-		)
-	}
+	enc.version = fecVersion1
+	enc.codecID = c.Codec
+	enc.headerOffset = offset
+	enc.payloadOffset = enc.headerOffset + fecHeaderSizeV1
 	enc.zeros = make(
 		[]byte,
 		GFcpMtuLimit,
 	)
+	if enc.setLayout(
+		c.DataShards,
+		c.ParityShards,
+		c.Interleave,
+	) != nil {
+		return nil
+	}
 	return enc
 }
 
+// SetShards changes the shard layout from the next FEC group on. Only
+// encoders writing version 1 headers can change their layout.
+func (
+	enc *FecEncoder,
+) SetShards(
+	dataShards,
+	parityShards int,
+) error {
+	if enc.version == fecVersion0 {
+		return errors.New(
+			errInvalidOperation,
+		)
+	}
+	if dataShards <= 0 || parityShards <= 0 ||
+		dataShards > fecMaxShards || parityShards > fecMaxShards {
+		return errors.New(
+			"invalid FEC shard layout",
+		)
+	}
+	if _, err := newFECCodec(
+		enc.codecID,
+		dataShards,
+		parityShards,
+	); err != nil {
+		return err
+	}
+	return enc.changeLayout(
+		dataShards,
+		parityShards,
+		enc.nextDepth(),
+	)
+}
+
+// SetInterleave spreads consecutive packets over depth FEC groups from
+// the next group on, so a burst of losses costs each group fewer
+// shards. Decoders need no setting, as groups are told apart by
+// seqid, but must keep depth times as many shards.
+func (
+	enc *FecEncoder,
+) SetInterleave(
+	depth int,
+) error {
+	if depth <= 0 || depth > fecMaxInterleave {
+		return errors.New(
+			"invalid FEC interleaving depth",
+		)
+	}
+	ds, ps := enc.dataShards, enc.parityShards
+	if enc.pending {
+		ds, ps = enc.pendingData, enc.pendingParity
+	}
+	return enc.changeLayout(
+		ds,
+		ps,
+		depth,
+	)
+}
+
+// nextDepth returns the interleaving depth of the next groups.
+func (
+	enc *FecEncoder,
+) nextDepth() int {
+	if enc.pending {
+		return enc.pendingDepth
+	}
+	return enc.depth
+}
+
+// changeLayout applies a layout at once between groups, or when the
+// groups being filled end.
+func (
+	enc *FecEncoder,
+) changeLayout(
+	dataShards,
+	parityShards,
+	depth int,
+) error {
+	if enc.shardCount == 0 {
+		enc.pending = false
+		return enc.setLayout(
+			dataShards,
+			parityShards,
+			depth,
+		)
+	}
+	enc.pending = true
+	enc.pendingData = dataShards
+	enc.pendingParity = parityShards
+	enc.pendingDepth = depth
+	return nil
+}
+
+// Shards returns the layout of the current FEC group.
+func (
+	enc *FecEncoder,
+) Shards() (
+	dataShards,
+	parityShards int,
+) {
+	return enc.dataShards, enc.parityShards
+}
+
+// setLayout switches to a new layout between groups. The next seqid is
+// rounded up to a multiple of the new group size times depth, so every
+// group keeps starting at a multiple of its own size, as decoders
+// expect.
+func (
+	enc *FecEncoder,
+) setLayout(
+	dataShards,
+	parityShards,
+	depth int,
+) error {
+	if dataShards == enc.dataShards && parityShards == enc.parityShards &&
+		depth == enc.depth {
+		return nil
+	}
+	if dataShards != enc.dataShards || parityShards != enc.parityShards {
+		codec, err := newFECCodec(
+			enc.codecID,
+			dataShards,
+			parityShards,
+		)
+		if err != nil {
+			return err
+		}
+		enc.codec = codec
+	}
+	enc.dataShards = dataShards
+	enc.parityShards = parityShards
+	enc.shardSize = dataShards + parityShards
+	enc.depth = depth
+	size := uint32(
+		enc.shardSize * enc.depth,
+	)
+	enc.paws = (0xFFFFFFFF/size - 1) * size
+	if r := enc.next % size; r != 0 {
+		enc.next += size - r
+	}
+	if enc.next >= enc.paws {
+		enc.next = 0
+	}
+	for len(
+		enc.groups,
+	) < enc.depth {
+		enc.groups = append(
+			enc.groups,
+			fecGroup{},
+		)
+	}
+	for g := range enc.groups[:enc.depth] {
+		grp := &enc.groups[g]
+		for len(
+			grp.shardCache,
+		) < enc.shardSize {
+			grp.shardCache = append(
+				grp.shardCache,
+				make(
+					[]byte,
+					GFcpMtuLimit,
+				),
+			)
+		}
+	}
+	if len(
+		enc.EncodeCache,
+	) < enc.shardSize {
+		enc.EncodeCache = make(
+			[][]byte,
+			enc.shardSize,
+		)
+	}
+	return nil
+}
+
 // Encode ...
 func (
 	enc *FecEncoder,
@@ -371,8 +1082,15 @@ func (
 ) (
 	ps [][]byte,
 ) {
+	// consecutive packets go to the interleaved groups in turn
+	g := enc.shardCount % enc.depth
+	base := enc.next + uint32(
+		g*enc.shardSize,
+	)
+	grp := &enc.groups[g]
 	enc.markData(
 		b[enc.headerOffset:],
+		base+uint32(grp.count),
 	)
 	binary.LittleEndian.PutUint16(
 		b[enc.payloadOffset:],
@@ -385,75 +1103,191 @@ func (
 	sz := len(
 		b,
 	)
-	enc.shardCache[enc.shardCount] = enc.shardCache[enc.shardCount][:sz]
+	grp.shardCache[grp.count] = grp.shardCache[grp.count][:sz]
 	copy(
-		enc.shardCache[enc.shardCount][enc.payloadOffset:],
+		grp.shardCache[grp.count][enc.payloadOffset:],
 		b[enc.payloadOffset:],
 	)
+	grp.count++
 	enc.shardCount++
-	if sz > enc.maxSize {
-		enc.maxSize = sz
-	}
-	if enc.shardCount == enc.dataShards {
-		for i := 0; i < enc.dataShards; i++ {
-			shard := enc.shardCache[i]
-			slen := len(
-				shard,
-			)
-			copy(
-				shard[slen:enc.maxSize],
-				enc.zeros,
+	if sz > grp.maxSize {
+		grp.maxSize = sz
+	}
+	if grp.count == enc.dataShards {
+		ps = enc.encodeGroup(
+			g,
+		)
+	}
+	if enc.shardCount == enc.dataShards*enc.depth {
+		enc.endGroups()
+	}
+	return
+}
+
+// Flush returns the parity of the groups being filled, as if the data
+// shards missing were zeros, so the last packets of a burst need not
+// wait for more to be protected. Their parity tells decoders how many
+// data shards the groups really hold. Only encoders writing version 1
+// headers can flush; those of NewFECEncoder write version 0 headers,
+// which have no room for that count, and return nil.
+func (
+	enc *FecEncoder,
+) Flush() (
+	ps [][]byte,
+) {
+	if enc.version == fecVersion0 || enc.shardCount == 0 {
+		return nil
+	}
+	ps = enc.flushCache[:0]
+	for g := range enc.groups[:enc.depth] {
+		if enc.groups[g].count > 0 {
+			ps = append(
+				ps,
+				enc.encodeGroup(
+					g,
+				)...,
 			)
 		}
-		cache := enc.EncodeCache
-		for k := range cache {
-			cache[k] = enc.shardCache[k][enc.payloadOffset:enc.maxSize]
+	}
+	enc.flushCache = ps
+	enc.endGroups()
+	return ps
+}
+
+// Partial reports whether groups are being filled, which Flush would
+// complete.
+func (
+	enc *FecEncoder,
+) Partial() bool {
+	return enc.shardCount > 0
+}
+
+// encodeGroup returns the parity of group g, zero padding the shards
+// to the longest, and any data shards missing.
+func (
+	enc *FecEncoder,
+) encodeGroup(
+	g int,
+) (
+	ps [][]byte,
+) {
+	grp := &enc.groups[g]
+	base := enc.next + uint32(
+		g*enc.shardSize,
+	)
+	for i := 0; i < enc.dataShards; i++ {
+		shard := grp.shardCache[i]
+		slen := len(
+			shard,
+		)
+		if i >= grp.count {
+			slen = enc.payloadOffset
 		}
-		if err := enc.codec.Encode(
-			cache,
-		); err == nil {
-			ps = enc.shardCache[enc.dataShards:]
-			for k := range ps {
-				enc.markParity(
-					ps[k][enc.headerOffset:],
-				)
-				ps[k] = ps[k][:enc.maxSize]
-			}
+		grp.shardCache[i] = shard[:grp.maxSize]
+		copy(
+			grp.shardCache[i][slen:],
+			enc.zeros,
+		)
+	}
+	cache := enc.EncodeCache[:enc.shardSize]
+	for k := range cache {
+		cache[k] = grp.shardCache[k][enc.payloadOffset:grp.maxSize]
+	}
+	if err := enc.codec.Encode(
+		cache,
+	); err == nil {
+		ps = grp.shardCache[enc.dataShards:enc.shardSize]
+		for k := range ps {
+			enc.markParity(
+				ps[k][enc.headerOffset:],
+				base+uint32(enc.dataShards+k),
+				grp.count,
+			)
+			ps[k] = ps[k][:grp.maxSize]
 		}
-		enc.shardCount = 0
-		enc.maxSize = 0
 	}
-	return
+	grp.count = 0
+	grp.maxSize = 0
+	return ps
+}
+
+// endGroups moves on to the next interleaved groups, applying any
+// pending layout.
+func (
+	enc *FecEncoder,
+) endGroups() {
+	enc.shardCount = 0
+	enc.next = (enc.next + uint32(enc.shardSize*enc.depth)) % enc.paws
+	if enc.pending {
+		enc.pending = false
+		enc.setLayout(
+			enc.pendingData,
+			enc.pendingParity,
+			enc.pendingDepth,
+		)
+	}
 }
 
 func (
 	enc *FecEncoder,
 ) markData(
 	data []byte,
+	seqid uint32,
 ) {
 	binary.LittleEndian.PutUint32(
 		data,
-		enc.next,
+		seqid,
 	)
 	binary.LittleEndian.PutUint16(
 		data[4:],
-		KTypeData,
+		KTypeData|uint16(enc.version)<<8,
+	)
+	enc.markLayout(
+		data,
+		enc.dataShards,
 	)
-	enc.next++
 }
 
 func (
 	enc *FecEncoder,
 ) markParity(
 	data []byte,
+	seqid uint32,
+	count int,
 ) {
 	binary.LittleEndian.PutUint32(
 		data,
-		enc.next,
+		seqid,
 	)
 	binary.LittleEndian.PutUint16(
 		data[4:],
-		KTypeParity,
+		KTypeParity|uint16(enc.version)<<8,
+	)
+	enc.markLayout(
+		data,
+		count,
+	)
+}
+
+// markLayout writes the group layout of a version 1 header, with the
+// number of data shards the group holds.
+func (
+	enc *FecEncoder,
+) markLayout(
+	data []byte,
+	count int,
+) {
+	if enc.version == fecVersion0 {
+		return
+	}
+	data[6] = byte(
+		enc.dataShards,
+	)
+	data[7] = byte(
+		enc.parityShards,
+	)
+	data[8] = enc.codecID
+	data[9] = byte(
+		count,
 	)
-	enc.next = (enc.next + 1) % enc.paws
 }
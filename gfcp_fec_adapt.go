@@ -0,0 +1,255 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// fecAdaptInterval is how often, in ms, adaptive FEC is tuned
+	fecAdaptInterval = 1000
+	// fecAdaptMinSegs is the least number of segments sent in an
+	// interval for its retransmit ratio to be trusted
+	fecAdaptMinSegs = 32
+	// fecAdaptLossRatio is the retransmit ratio above which parity grows
+	fecAdaptLossRatio = 0.01
+	// fecAdaptCleanIntervals is how many clean intervals in a row it
+	// takes to drop one parity shard
+	fecAdaptCleanIntervals = 5
+)
+
+// fecAdapter tunes the parity shards of a session's encoder.
+type fecAdapter struct {
+	last      uint32 // when the interval started
+	xmit      uint64 // GFCP counters at the start of the interval
+	resent    uint64
+	recovered uint64
+	clean     int // clean intervals in a row
+}
+
+// adaptFEC tunes the parity of an adaptive FEC session once per
+// interval. Retransmits mean the peer lost more than parity could
+// repair, so parity grows in proportion. Parity shrinks slowly, after
+// intervals without retransmits, nor any loss repaired locally, which
+// on symmetric paths suggests the peer needs no repair either.
+// s.mu must be held.
+func (
+	s *UDPSession,
+) adaptFEC(
+	current uint32,
+) {
+	a := &s.fecAdapt
+	if _itimediff(
+		current,
+		a.last,
+	) < fecAdaptInterval {
+		return
+	}
+	xmit := s.GFcp.xmitSegs - a.xmit
+	if xmit < fecAdaptMinSegs {
+		a.last = current
+		return
+	}
+	resent := s.GFcp.resentSegs - a.resent
+	recovered := atomic.LoadUint64(
+		&s.fecRecovered,
+	) - a.recovered
+	a.last = current
+	a.xmit = s.GFcp.xmitSegs
+	a.resent = s.GFcp.resentSegs
+	a.recovered += recovered
+	ds, ps := s.FecEncoder.Shards()
+	ratio := float64(
+		resent,
+	) / float64(
+		xmit,
+	)
+	switch {
+	case ratio > fecAdaptLossRatio:
+		a.clean = 0
+		grow := int(
+			float64(
+				ds,
+			)*ratio + 0.999,
+		)
+		if grow < 1 {
+			grow = 1
+		}
+		ps += grow
+	case resent == 0 && recovered == 0:
+		a.clean++
+		if a.clean < fecAdaptCleanIntervals {
+			return
+		}
+		a.clean = 0
+		ps--
+	default:
+		a.clean = 0
+		return
+	}
+	if ps > s.fec.MaxParityShards {
+		ps = s.fec.MaxParityShards
+	}
+	if ps < s.fec.MinParityShards {
+		ps = s.fec.MinParityShards
+	}
+	s.FecEncoder.SetShards(
+		ds,
+		ps,
+	)
+}
+
+// fecFlushAfter arms the flush of partial FEC groups once the sender
+// has been quiet for FlushDelay; s.mu must be held.
+func (
+	s *UDPSession,
+) fecFlushAfter() {
+	if s.fec == nil || s.fec.FlushDelay <= 0 {
+		return
+	}
+	s.fecFlushPending = s.FecEncoder.Partial()
+	s.fecFlushAt = s.GFcp.currentMs() + uint32(
+		s.fec.FlushDelay/time.Millisecond,
+	)
+}
+
+// fecFlush sends the parity of partial FEC groups when their time has
+// come, and otherwise returns how long is left; s.mu must be held.
+func (
+	s *UDPSession,
+) fecFlush(
+	current uint32,
+) time.Duration {
+	if wait := _itimediff(
+		s.fecFlushAt,
+		current,
+	); wait > 0 {
+		return time.Duration(
+			wait,
+		) * time.Millisecond
+	}
+	s.fecFlushPending = false
+	for _, ps := range s.FecEncoder.Flush() {
+		s.queue(
+			ps,
+		)
+	}
+	s.uncork()
+	return updateIdleInterval
+}
+
+// initFECRxLimit applies the receive limit of the session's FEC
+// config, or of its Listener.
+func (
+	s *UDPSession,
+) initFECRxLimit() {
+	if s.FecDecoder == nil {
+		return
+	}
+	var limit, autoMax int
+	if s.l != nil {
+		limit = int(
+			atomic.LoadInt32(
+				&s.l.fecRxLimit,
+			),
+		)
+		autoMax = int(
+			atomic.LoadInt32(
+				&s.l.fecAutoRx,
+			),
+		)
+	} else if s.fec != nil {
+		limit, autoMax = s.fec.RxLimit, s.fec.AutoRxLimit
+	}
+	if limit <= 0 {
+		limit = s.FecDecoder.rxlimit
+	}
+	s.FecDecoder.SetRxLimit(
+		limit,
+		autoMax,
+	)
+}
+
+// SetFECRxLimit sets how many FEC shards the session keeps waiting for
+// the rest of their groups, and the bound of an auto-sized limit; see
+// FecDecoder.SetRxLimit.
+func (
+	s *UDPSession,
+) SetFECRxLimit(
+	limit,
+	autoMax int,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.FecDecoder == nil {
+		return errors.New(
+			errInvalidOperation,
+		)
+	}
+	return s.FecDecoder.SetRxLimit(
+		limit,
+		autoMax,
+	)
+}
+
+// FECOccupancy returns the FEC shards the session holds waiting for
+// their groups, and its current limit.
+func (
+	s *UDPSession,
+) FECOccupancy() (
+	n,
+	limit int,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.FecDecoder == nil {
+		return 0, 0
+	}
+	return s.FecDecoder.Occupancy()
+}
+
+// SetFECRxLimit sets the FEC receive limit of sessions accepted from
+// now on; zero limit keeps the default.
+func (
+	l *Listener,
+) SetFECRxLimit(
+	limit,
+	autoMax int,
+) {
+	atomic.StoreInt32(
+		&l.fecRxLimit,
+		int32(limit),
+	)
+	atomic.StoreInt32(
+		&l.fecAutoRx,
+		int32(autoMax),
+	)
+}
+
+// FECShards returns the layout of the FEC group being sent, or zeros
+// for a session without FEC.
+func (
+	s *UDPSession,
+) FECShards() (
+	dataShards,
+	parityShards int,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.FecEncoder == nil {
+		return 0, 0
+	}
+	return s.FecEncoder.Shards()
+}
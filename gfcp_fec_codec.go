@@ -0,0 +1,306 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"crypto/subtle"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FECCodecXOR is a single parity shard, the XOR of the data shards.
+	FECCodecXOR = 1
+	// FECCodec2DXOR lays the data shards out in rows and columns, with
+	// an XOR parity shard for each row and each column, as in SMPTE
+	// 2022-1. Row parities come first.
+	FECCodec2DXOR = 2
+)
+
+// FECCodec computes and repairs the parity of an FEC group. Shards
+// are data shards then parity shards, all of the same length; missing
+// shards have length 0, and repaired data shards are written into
+// their capacity. Codecs fail with reedsolomon.ErrTooFewShards when
+// the shards present can not repair the data yet.
+type FECCodec interface {
+	Encode(
+		shards [][]byte,
+	) error
+	ReconstructData(
+		shards [][]byte,
+	) error
+}
+
+// newFECCodec returns the codec for a shard layout.
+func newFECCodec(
+	codec byte,
+	dataShards,
+	parityShards int,
+) (
+	FECCodec,
+	error,
+) {
+	switch codec {
+	case FECCodecReedSolomon:
+		return reedsolomon.New(
+			dataShards,
+			parityShards,
+		)
+	case FECCodecXOR:
+		if dataShards <= 0 || parityShards != 1 {
+			break
+		}
+		return xorCodec{}, nil
+	case FECCodec2DXOR:
+		rows, cols, ok := xor2DLayout(
+			dataShards,
+			parityShards,
+		)
+		if !ok {
+			break
+		}
+		return xor2DCodec{
+			rows: rows,
+			cols: cols,
+		}, nil
+	}
+	return nil, errors.New(
+		"invalid FEC codec layout",
+	)
+}
+
+// xorCodec is a single XOR parity shard.
+type xorCodec struct{}
+
+func (
+	xorCodec,
+) Encode(
+	shards [][]byte,
+) error {
+	n := len(
+		shards,
+	) - 1
+	copy(
+		shards[n],
+		shards[0],
+	)
+	for k := 1; k < n; k++ {
+		subtle.XORBytes(
+			shards[n],
+			shards[n],
+			shards[k],
+		)
+	}
+	return nil
+}
+
+func (
+	xorCodec,
+) ReconstructData(
+	shards [][]byte,
+) error {
+	n := len(
+		shards,
+	) - 1
+	missing := -1
+	for k := range shards[:n] {
+		if len(
+			shards[k],
+		) == 0 {
+			if missing >= 0 {
+				return reedsolomon.ErrTooFewShards
+			}
+			missing = k
+		}
+	}
+	if missing < 0 {
+		return nil
+	}
+	if len(
+		shards[n],
+	) == 0 {
+		return reedsolomon.ErrTooFewShards
+	}
+	shards[missing] = shards[missing][:len(shards[n])]
+	copy(
+		shards[missing],
+		shards[n],
+	)
+	for k := range shards[:n] {
+		if k != missing {
+			subtle.XORBytes(
+				shards[missing],
+				shards[missing],
+				shards[k],
+			)
+		}
+	}
+	return nil
+}
+
+// xor2DCodec protects rows*cols data shards with a parity shard for
+// each row and each column.
+type xor2DCodec struct {
+	rows,
+	cols int
+}
+
+// xor2DLayout finds rows and columns, rows <= cols, for which data
+// shards are rows*cols and parity shards rows+cols.
+func xor2DLayout(
+	dataShards,
+	parityShards int,
+) (
+	rows,
+	cols int,
+	ok bool,
+) {
+	for rows = 1; rows*rows <= dataShards; rows++ {
+		if dataShards%rows == 0 && rows+dataShards/rows == parityShards {
+			return rows, dataShards / rows, true
+		}
+	}
+	return 0, 0, false
+}
+
+// line returns the data shards of a row, or of column line-rows, and
+// the index of the parity shard protecting them.
+func (
+	x xor2DCodec,
+) line(
+	line int,
+	members []int,
+) (
+	[]int,
+	int,
+) {
+	members = members[:0]
+	if line < x.rows {
+		for c := 0; c < x.cols; c++ {
+			members = append(
+				members,
+				line*x.cols+c,
+			)
+		}
+	} else {
+		for r := 0; r < x.rows; r++ {
+			members = append(
+				members,
+				r*x.cols+line-x.rows,
+			)
+		}
+	}
+	return members, x.rows*x.cols + line
+}
+
+func (
+	x xor2DCodec,
+) Encode(
+	shards [][]byte,
+) error {
+	members := make(
+		[]int,
+		0,
+		x.cols,
+	)
+	for line := 0; line < x.rows+x.cols; line++ {
+		var parity int
+		members, parity = x.line(
+			line,
+			members,
+		)
+		clear(
+			shards[parity],
+		)
+		for _, k := range members {
+			subtle.XORBytes(
+				shards[parity],
+				shards[parity],
+				shards[k],
+			)
+		}
+	}
+	return nil
+}
+
+// ReconstructData repairs any row or column missing a single data
+// shard, and repeats as long as that makes progress.
+func (
+	x xor2DCodec,
+) ReconstructData(
+	shards [][]byte,
+) error {
+	size := 0
+	for k := range shards {
+		if len(
+			shards[k],
+		) > size {
+			size = len(
+				shards[k],
+			)
+		}
+	}
+	members := make(
+		[]int,
+		0,
+		x.cols,
+	)
+	for {
+		missing, repaired := 0, false
+		for line := 0; line < x.rows+x.cols; line++ {
+			var parity int
+			members, parity = x.line(
+				line,
+				members,
+			)
+			lost, count := -1, 0
+			for _, k := range members {
+				if len(
+					shards[k],
+				) == 0 {
+					lost = k
+					count++
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			missing += count
+			if count > 1 || len(
+				shards[parity],
+			) == 0 {
+				continue
+			}
+			shards[lost] = shards[lost][:size]
+			copy(
+				shards[lost],
+				shards[parity],
+			)
+			for _, k := range members {
+				if k != lost {
+					subtle.XORBytes(
+						shards[lost],
+						shards[lost],
+						shards[k],
+					)
+				}
+			}
+			repaired = true
+		}
+		if missing == 0 {
+			return nil
+		}
+		if !repaired {
+			return reedsolomon.ErrTooFewShards
+		}
+	}
+}
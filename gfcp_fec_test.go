@@ -14,8 +14,10 @@ import (
 	"encoding/binary"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
 )
 
 func BenchmarkFECDecode1500(
@@ -161,3 +163,1048 @@ func BenchmarkFECEncode9000(
 		)
 	}
 }
+
+// benchmarkFECEncodeCodec encodes version 1 FEC groups of codec.
+func benchmarkFECEncodeCodec(
+	b *testing.B,
+	codec byte,
+	dataSize,
+	paritySize,
+	payLoad int,
+) {
+	b.ReportAllocs()
+	b.SetBytes(
+		int64(payLoad),
+	)
+	Encoder := gfcp.NewFECEncoderWithConfig(
+		&gfcp.FECConfig{
+			DataShards:   dataSize,
+			ParityShards: paritySize,
+			Codec:        codec,
+		},
+		0,
+	)
+	data := make(
+		[]byte,
+		payLoad,
+	)
+	for i := 0; i < b.N; i++ {
+		Encoder.Encode(
+			data,
+		)
+	}
+}
+
+// benchmarkFECDecodeCodec decodes version 1 FEC groups of codec, one
+// packet in a group lost.
+func benchmarkFECDecodeCodec(
+	b *testing.B,
+	codec byte,
+	dataSize,
+	paritySize,
+	payLoad int,
+) {
+	decoder := gfcp.NewFECDecoder(
+		1024,
+		dataSize,
+		paritySize,
+	)
+	// Decode copies packets, so one buffer serves them all
+	pkt := make(
+		[]byte,
+		payLoad,
+	)
+	b.ReportAllocs()
+	b.SetBytes(
+		int64(payLoad),
+	)
+	for i := 0; i < b.N; i++ {
+		if i%(dataSize+paritySize) == 1 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(
+			pkt,
+			uint32(i),
+		)
+		pkt[4] = gfcp.KTypeData
+		if i%(dataSize+paritySize) >= dataSize {
+			pkt[4] = gfcp.KTypeParity
+		}
+		pkt[5] = 1 // version 1 header
+		pkt[6] = byte(dataSize)
+		pkt[7] = byte(paritySize)
+		pkt[8] = codec
+		pkt[9] = byte(dataSize)
+		binary.LittleEndian.PutUint16(
+			pkt[10:],
+			uint16(payLoad-10),
+		)
+		decoder.Decode(
+			pkt,
+		)
+	}
+}
+
+func BenchmarkFECEncode128(
+	b *testing.B,
+) {
+	benchmarkFECEncodeCodec(
+		b,
+		gfcp.FECCodecReedSolomon,
+		9,
+		3,
+		128,
+	)
+}
+
+func BenchmarkFECEncodeXOR128(
+	b *testing.B,
+) {
+	benchmarkFECEncodeCodec(
+		b,
+		gfcp.FECCodecXOR,
+		9,
+		1,
+		128,
+	)
+}
+
+func BenchmarkFECEncode2DXOR128(
+	b *testing.B,
+) {
+	benchmarkFECEncodeCodec(
+		b,
+		gfcp.FECCodec2DXOR,
+		9,
+		6,
+		128,
+	)
+}
+
+func BenchmarkFECEncodeXOR1500(
+	b *testing.B,
+) {
+	benchmarkFECEncodeCodec(
+		b,
+		gfcp.FECCodecXOR,
+		10,
+		1,
+		1500,
+	)
+}
+
+func BenchmarkFECEncode2DXOR1500(
+	b *testing.B,
+) {
+	benchmarkFECEncodeCodec(
+		b,
+		gfcp.FECCodec2DXOR,
+		10,
+		7,
+		1500,
+	)
+}
+
+func BenchmarkFECDecode128(
+	b *testing.B,
+) {
+	benchmarkFECDecodeCodec(
+		b,
+		gfcp.FECCodecReedSolomon,
+		9,
+		3,
+		128,
+	)
+}
+
+func BenchmarkFECDecodeXOR128(
+	b *testing.B,
+) {
+	benchmarkFECDecodeCodec(
+		b,
+		gfcp.FECCodecXOR,
+		9,
+		1,
+		128,
+	)
+}
+
+func BenchmarkFECDecode2DXOR128(
+	b *testing.B,
+) {
+	benchmarkFECDecodeCodec(
+		b,
+		gfcp.FECCodec2DXOR,
+		9,
+		6,
+		128,
+	)
+}
+
+func BenchmarkFECDecodeXOR1500(
+	b *testing.B,
+) {
+	benchmarkFECDecodeCodec(
+		b,
+		gfcp.FECCodecXOR,
+		10,
+		1,
+		1500,
+	)
+}
+
+func BenchmarkFECDecode2DXOR1500(
+	b *testing.B,
+) {
+	benchmarkFECDecodeCodec(
+		b,
+		gfcp.FECCodec2DXOR,
+		10,
+		7,
+		1500,
+	)
+}
+
+func TestFECLayoutChange(
+	t *testing.T,
+) {
+	const header = 12 // version 1 FEC header and size
+	enc := gfcp.NewFECEncoderWithConfig(
+		&gfcp.FECConfig{
+			DataShards:      4,
+			ParityShards:    2,
+			Adaptive:        true,
+			MinParityShards: 1,
+			MaxParityShards: 4,
+		},
+		0,
+	)
+	dec := gfcp.NewFECDecoder(
+		1024,
+		1,
+		1,
+	)
+	rnd := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	var want, got [][]byte
+	for i := 0; i < 64; i++ {
+		switch i {
+		case 10: // applied when the group ends
+			enc.SetShards(
+				4,
+				1,
+			)
+		case 30:
+			enc.SetShards(
+				3,
+				4,
+			)
+		}
+		payload := make(
+			[]byte,
+			1+rnd.Intn(
+				200,
+			),
+		)
+		rnd.Read(
+			payload,
+		)
+		want = append(
+			want,
+			payload,
+		)
+		pkt := make(
+			[]byte,
+			header+len(
+				payload,
+			),
+		)
+		copy(
+			pkt[header:],
+			payload,
+		)
+		pkts := [][]byte{
+			pkt,
+		}
+		for _, p := range enc.Encode(
+			pkt,
+		) {
+			pkts = append(
+				pkts,
+				append(
+					[]byte(nil),
+					p...,
+				),
+			)
+		}
+		for k, p := range pkts {
+			if k == 0 {
+				// at most one data shard per complete group is lost
+				if i%5 == 2 && i < 60 {
+					continue
+				}
+				got = append(
+					got,
+					p[header:],
+				)
+			}
+			for _, r := range dec.Decode(
+				p,
+			) {
+				sz := binary.LittleEndian.Uint16(
+					r,
+				)
+				got = append(
+					got,
+					append(
+						[]byte(nil),
+						r[2:sz]...,
+					),
+				)
+			}
+		}
+	}
+	if ds, ps := enc.Shards(); ds != 3 || ps != 4 {
+		t.Fatal(
+			"layout not changed",
+			ds,
+			ps,
+		)
+	}
+	seen := make(
+		map[string]bool,
+	)
+	for _, g := range got {
+		seen[string(g)] = true
+	}
+	for i, w := range want {
+		if !seen[string(w)] {
+			t.Fatalf(
+				"payload %v lost",
+				i,
+			)
+		}
+	}
+}
+
+// fecPipeSession dials a versioned FEC echo server over a pipe that
+// loses 10% of the packets each way.
+func fecPipeSession(
+	t *testing.T,
+	cfg *gfcp.FECConfig,
+) (
+	*gfcp.UDPSession,
+	func(),
+) {
+	link := func(
+		seed int64,
+	) *gfcptest.Link {
+		return &gfcptest.Link{
+			Loss: gfcptest.Bernoulli{
+				P: 0.1,
+			},
+			Delay: 10 * time.Millisecond,
+			Seed:  seed,
+		}
+	}
+	a, b := gfcptest.NewPacketPipe(
+		link(
+			1,
+		),
+		link(
+			2,
+		),
+	)
+	l, err := gfcp.ServeConnWithFEC(
+		cfg,
+		b,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(
+			1,
+			10,
+			2,
+			1,
+		)
+		buf := make(
+			[]byte,
+			4096,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := gfcp.NewConnWithFEC(
+		b.LocalAddr().String(),
+		cfg,
+		a,
+	)
+	if err != nil {
+		l.Close()
+		t.Fatal(
+			err,
+		)
+	}
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	cli.SetDeadline(
+		time.Now().Add(
+			20 * time.Second,
+		),
+	)
+	return cli, func() {
+		cli.Close()
+		l.Close()
+	}
+}
+
+func TestAdaptiveFEC(
+	t *testing.T,
+) {
+	cfg := &gfcp.FECConfig{
+		DataShards:      10,
+		ParityShards:    1,
+		Adaptive:        true,
+		MinParityShards: 1,
+		MaxParityShards: 8,
+	}
+	cli, done := fecPipeSession(
+		t,
+		cfg,
+	)
+	defer done()
+	deadline := time.Now().Add(
+		20 * time.Second,
+	)
+	for {
+		if err := echoTester(
+			cli,
+			4096,
+			16,
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		if _, ps := cli.FECShards(); ps > cfg.MinParityShards {
+			return
+		}
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatal(
+				"parity not raised on a lossy link",
+			)
+		}
+	}
+}
+
+func TestFECCodecSession(
+	t *testing.T,
+) {
+	cli, done := fecPipeSession(
+		t,
+		&gfcp.FECConfig{
+			DataShards:   6,
+			ParityShards: 5,
+			Codec:        gfcp.FECCodec2DXOR,
+			FlushDelay:   20 * time.Millisecond,
+		},
+	)
+	defer done()
+	before := gfcp.DefaultSnsi.Copy()
+	if err := echoTester(
+		cli,
+		4096,
+		64,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if gfcp.DefaultSnsi.Copy().GFcpFECRecovered == before.GFcpFECRecovered {
+		t.Fatal(
+			"nothing recovered",
+		)
+	}
+	if n, limit := cli.FECOccupancy(); limit != 3*11 || n > limit {
+		t.Fatal(
+			"FEC occupancy",
+			n,
+			limit,
+		)
+	}
+}
+
+func TestFECCodecs(
+	t *testing.T,
+) {
+	const header = 12 // version 1 FEC header and size
+	for _, tc := range []struct {
+		cfg  gfcp.FECConfig
+		lost []int // shards lost, data shards first
+	}{
+		{
+			gfcp.FECConfig{
+				DataShards:   4,
+				ParityShards: 2,
+			},
+			[]int{
+				1,
+				3,
+			},
+		},
+		{
+			gfcp.FECConfig{
+				DataShards:   5,
+				ParityShards: 1,
+				Codec:        gfcp.FECCodecXOR,
+			},
+			[]int{
+				2,
+			},
+		},
+		{
+			// two rows of three: once the first row repairs shard
+			// 0, the columns repair the second row, which also
+			// lost its parity
+			gfcp.FECConfig{
+				DataShards:   6,
+				ParityShards: 5,
+				Codec:        gfcp.FECCodec2DXOR,
+			},
+			[]int{
+				0,
+				3,
+				4,
+				7,
+			},
+		},
+	} {
+		enc := gfcp.NewFECEncoderWithConfig(
+			&tc.cfg,
+			0,
+		)
+		dec := gfcp.NewFECDecoder(
+			1024,
+			1,
+			1,
+		)
+		var want, pkts [][]byte
+		for i := 0; i < tc.cfg.DataShards; i++ {
+			pkt := make(
+				[]byte,
+				header+10+i*7,
+			)
+			rand.Read(
+				pkt[header:],
+			)
+			want = append(
+				want,
+				pkt[header:],
+			)
+			pkts = append(
+				pkts,
+				pkt,
+			)
+			for _, p := range enc.Encode(
+				pkt,
+			) {
+				pkts = append(
+					pkts,
+					append(
+						[]byte(nil),
+						p...,
+					),
+				)
+			}
+		}
+		if len(
+			pkts,
+		) != tc.cfg.DataShards+tc.cfg.ParityShards {
+			t.Fatal(
+				tc.cfg,
+				len(
+					pkts,
+				),
+			)
+		}
+		lost := make(
+			map[int]bool,
+		)
+		for _, k := range tc.lost {
+			lost[k] = true
+		}
+		var got [][]byte
+		for k, p := range pkts {
+			if lost[k] {
+				continue
+			}
+			for _, r := range dec.Decode(
+				p,
+			) {
+				sz := binary.LittleEndian.Uint16(
+					r,
+				)
+				got = append(
+					got,
+					append(
+						[]byte(nil),
+						r[2:sz]...,
+					),
+				)
+			}
+		}
+		for _, k := range tc.lost {
+			if k >= tc.cfg.DataShards {
+				continue
+			}
+			found := false
+			for _, g := range got {
+				if string(g) == string(want[k]) {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf(
+					"codec %v: shard %v not recovered",
+					tc.cfg.Codec,
+					k,
+				)
+			}
+		}
+	}
+}
+
+// fecBurstLoss sends packets through an encoder interleaving depth
+// groups and a Gilbert-Elliott channel, and returns how many data
+// packets the decoder could not recover.
+func fecBurstLoss(
+	depth,
+	packets int,
+) (
+	lost int,
+) {
+	const header = 12 // version 1 FEC header and size
+	enc := gfcp.NewFECEncoderWithConfig(
+		&gfcp.FECConfig{
+			DataShards:   8,
+			ParityShards: 2,
+			Interleave:   depth,
+		},
+		0,
+	)
+	dec := gfcp.NewFECDecoder(
+		3*10*depth,
+		8,
+		2,
+	)
+	channel := &gfcptest.GilbertElliott{
+		PGoodToBad: 0.02,
+		PBadToGood: 0.3,
+		LossBad:    0.8,
+	}
+	rnd := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	seen := make(
+		map[uint32]bool,
+	)
+	for i := 0; i < packets; i++ {
+		pkt := make(
+			[]byte,
+			header+4,
+		)
+		binary.LittleEndian.PutUint32(
+			pkt[header:],
+			uint32(i),
+		)
+		out := [][]byte{
+			pkt,
+		}
+		for _, p := range enc.Encode(
+			pkt,
+		) {
+			out = append(
+				out,
+				append(
+					[]byte(nil),
+					p...,
+				),
+			)
+		}
+		for k, p := range out {
+			if channel.Lost(
+				rnd,
+			) {
+				continue
+			}
+			if k == 0 {
+				seen[binary.LittleEndian.Uint32(
+					p[header:],
+				)] = true
+			}
+			for _, r := range dec.Decode(
+				p,
+			) {
+				seen[binary.LittleEndian.Uint32(
+					r[2:],
+				)] = true
+			}
+		}
+	}
+	// the last groups may be incomplete
+	for i := 0; i < packets-8*depth; i++ {
+		if !seen[uint32(i)] {
+			lost++
+		}
+	}
+	return lost
+}
+
+func TestFECInterleave(
+	t *testing.T,
+) {
+	const packets = 20000
+	flat := fecBurstLoss(
+		1,
+		packets,
+	)
+	interleaved := fecBurstLoss(
+		8,
+		packets,
+	)
+	t.Logf(
+		"unrecovered: %v without interleaving, %v interleaved",
+		flat,
+		interleaved,
+	)
+	if flat == 0 || interleaved*2 > flat {
+		t.Fatal(
+			"interleaving did not help against burst loss",
+		)
+	}
+}
+
+func TestFECFlush(
+	t *testing.T,
+) {
+	const header = 12 // version 1 FEC header and size
+	for _, depth := range []int{
+		1,
+		3,
+	} {
+		enc := gfcp.NewFECEncoderWithConfig(
+			&gfcp.FECConfig{
+				DataShards:   4,
+				ParityShards: 2,
+				Interleave:   depth,
+			},
+			0,
+		)
+		dec := gfcp.NewFECDecoder(
+			1024,
+			4,
+			2,
+		)
+		// five packets leave every group partial
+		var pkts [][]byte
+		for i := 0; i < 5; i++ {
+			pkt := make(
+				[]byte,
+				header+4,
+			)
+			binary.LittleEndian.PutUint32(
+				pkt[header:],
+				uint32(i),
+			)
+			if ps := enc.Encode(
+				pkt,
+			); ps != nil && depth > 1 {
+				t.Fatal(
+					"interleaved group full",
+				)
+			}
+			pkts = append(
+				pkts,
+				pkt,
+			)
+		}
+		if !enc.Partial() {
+			t.Fatal(
+				"no partial group",
+			)
+		}
+		for _, p := range enc.Flush() {
+			pkts = append(
+				pkts,
+				append(
+					[]byte(nil),
+					p...,
+				),
+			)
+		}
+		if enc.Partial() || enc.Flush() != nil {
+			t.Fatal(
+				"groups not flushed",
+			)
+		}
+		// lose the last data packet, in a group flushed short
+		got := false
+		for _, p := range append(
+			pkts[:4:4],
+			pkts[5:]...,
+		) {
+			for _, r := range dec.Decode(
+				p,
+			) {
+				if binary.LittleEndian.Uint32(
+					r[2:],
+				) == 4 {
+					got = true
+				}
+			}
+		}
+		if !got {
+			t.Fatalf(
+				"depth %v: flushed group not recovered",
+				depth,
+			)
+		}
+	}
+	if gfcp.NewFECEncoder(
+		4,
+		2,
+		0,
+	).Flush() != nil {
+		t.Fatal(
+			"version 0 encoder flushed",
+		)
+	}
+}
+
+func TestFECExpire(
+	t *testing.T,
+) {
+	clock := gfcptest.NewManualClock(
+		time.Unix(
+			0,
+			0,
+		),
+	)
+	dec := gfcp.NewFECDecoder(
+		1024,
+		4,
+		2,
+	)
+	dec.SetClock(
+		clock,
+	)
+	dec.SetMaxAge(
+		10 * time.Millisecond,
+	)
+	pkt := make(
+		[]byte,
+		32,
+	)
+	binary.LittleEndian.PutUint16(
+		pkt[4:],
+		gfcp.KTypeData,
+	)
+	before := gfcp.DefaultSnsi.Copy().GFcpFECExpiredShards
+	for _, step := range []struct {
+		advance time.Duration
+		seqid   uint32
+		expired uint64
+	}{
+		{0, 0, 0},
+		{5 * time.Millisecond, 100, 0},
+		{7 * time.Millisecond, 200, 1},
+	} {
+		clock.Advance(
+			step.advance,
+		)
+		binary.LittleEndian.PutUint32(
+			pkt,
+			step.seqid,
+		)
+		dec.Decode(
+			pkt,
+		)
+		if d := gfcp.DefaultSnsi.Copy().GFcpFECExpiredShards - before; d != step.expired {
+			t.Fatalf(
+				"%v shards expired at seqid %v, want %v",
+				d,
+				step.seqid,
+				step.expired,
+			)
+		}
+	}
+}
+
+// fecReorderLoss sends packets, one data shard lost per group, through
+// a decoder after shuffling them within windows of 120, and returns
+// how many lost data shards were not recovered.
+func fecReorderLoss(
+	dec *gfcp.FecDecoder,
+) (
+	lost int,
+) {
+	const (
+		header  = 8 // version 0 FEC header and size
+		packets = 3000
+	)
+	enc := gfcp.NewFECEncoder(
+		10,
+		3,
+		0,
+	)
+	rnd := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	var out [][]byte
+	dropped := make(
+		map[uint32]bool,
+	)
+	for i := 0; i < packets; i++ {
+		pkt := make(
+			[]byte,
+			header+4,
+		)
+		binary.LittleEndian.PutUint32(
+			pkt[header:],
+			uint32(i),
+		)
+		ps := enc.Encode(
+			pkt,
+		)
+		if i%10 == 3 {
+			dropped[uint32(i)] = true
+		} else {
+			out = append(
+				out,
+				pkt,
+			)
+		}
+		for _, p := range ps {
+			out = append(
+				out,
+				append(
+					[]byte(nil),
+					p...,
+				),
+			)
+		}
+	}
+	for w := 0; w < len(out); w += 120 {
+		win := out[w:min(w+120, len(out))]
+		rnd.Shuffle(
+			len(win),
+			func(
+				i,
+				j int,
+			) {
+				win[i], win[j] = win[j], win[i]
+			},
+		)
+	}
+	for _, p := range out {
+		for _, r := range dec.Decode(
+			p,
+		) {
+			delete(
+				dropped,
+				binary.LittleEndian.Uint32(
+					r[2:],
+				),
+			)
+		}
+	}
+	return len(
+		dropped,
+	)
+}
+
+func TestFECRxLimit(
+	t *testing.T,
+) {
+	fixed := gfcp.NewFECDecoder(
+		39,
+		10,
+		3,
+	)
+	auto := gfcp.NewFECDecoder(
+		39,
+		10,
+		3,
+	)
+	if err := auto.SetRxLimit(
+		39,
+		1000,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if err := auto.SetRxLimit(
+		5,
+		0,
+	); err == nil {
+		t.Fatal(
+			"limit below a group accepted",
+		)
+	}
+	auto.SetRxLimit(
+		39,
+		1000,
+	)
+	lostFixed := fecReorderLoss(
+		fixed,
+	)
+	lostAuto := fecReorderLoss(
+		auto,
+	)
+	n, limit := auto.Occupancy()
+	t.Logf(
+		"unrecovered: %v fixed, %v auto-sized to %v (holding %v)",
+		lostFixed,
+		lostAuto,
+		limit,
+		n,
+	)
+	if lostFixed == 0 || lostAuto*4 > lostFixed || limit <= 39 ||
+		n > limit {
+		t.Fatal(
+			"auto-sized limit did not absorb reordering",
+		)
+	}
+}
@@ -0,0 +1,660 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"math/bits"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fountain coded blocks bypass GFCP: a block is cut into k source
+// symbols, sent as they are, then followed by as many repair symbols
+// as the sender likes, each a random linear combination, over GF(2),
+// of the source symbols. A receiver completes the block from any k
+// linearly independent symbols, which takes k plus a few symbols of
+// whatever mix arrives; no acknowledgement or retransmission is used.
+//
+// A fountain packet is conv(4), type(1), reserved(1), k(2), block
+// ID(4), symbol ID(4) and block length(4), then the symbol. Symbols
+// below k are source symbols. It never enters a FEC group.
+const (
+	// KTypeFountain ...
+	KTypeFountain = 0xf4
+
+	fountainHeaderSize = 20
+	// fountainMaxSymbols bounds the source symbols of a block, as
+	// decoding costs grow with their square.
+	fountainMaxSymbols = 1024
+	// fountainMinSymbol keeps packets above the minimum session size
+	fountainMinSymbol = 32
+	// fountainMaxBlocks bounds the blocks a decoder tracks, and the
+	// completed blocks a session holds for ReadBlock.
+	fountainMaxBlocks = 8
+	// fountainMaxDone bounds the completed blocks whose late symbols a
+	// decoder drops.
+	fountainMaxDone = 64
+	// fountainBatch is how many symbols WriteSymbols queues at a time
+	fountainBatch = 64
+)
+
+// fountainResult is a completed block waiting for ReadBlock.
+type fountainResult struct {
+	id    uint32
+	block []byte
+}
+
+// FountainEncoder produces the symbols of a block.
+type FountainEncoder struct {
+	id         uint32
+	k          int
+	symbolSize int
+	length     int
+	source     []byte // the block, padded to k symbols
+	coefs      []uint64
+}
+
+// NewFountainEncoder cuts block into source symbols of at most
+// symbolSize bytes.
+func NewFountainEncoder(
+	id uint32,
+	block []byte,
+	symbolSize int,
+) (
+	*FountainEncoder,
+	error,
+) {
+	if len(
+		block,
+	) == 0 || symbolSize < fountainMinSymbol {
+		return nil, errors.New(
+			errInvalidOperation,
+		)
+	}
+	k := (len(block) + symbolSize - 1) / symbolSize
+	if k > fountainMaxSymbols {
+		return nil, errors.New(
+			"block too large for fountain coding",
+		)
+	}
+	// spread the block evenly over k symbols
+	symbolSize = (len(block) + k - 1) / k
+	if symbolSize < fountainMinSymbol {
+		symbolSize = fountainMinSymbol
+	}
+	enc := &FountainEncoder{
+		id:         id,
+		k:          k,
+		symbolSize: symbolSize,
+		length:     len(block),
+		source: make(
+			[]byte,
+			k*symbolSize,
+		),
+		coefs: make(
+			[]uint64,
+			(k+63)/64,
+		),
+	}
+	copy(
+		enc.source,
+		block,
+	)
+	return enc, nil
+}
+
+// K returns the number of source symbols, the least number of symbols
+// a receiver needs to complete the block.
+func (
+	enc *FountainEncoder,
+) K() int {
+	return enc.k
+}
+
+// Encode writes the packet of symbol esi into pkt, which must hold
+// fountainHeaderSize plus the symbol size, and returns it; the first
+// four bytes are left for the conversation ID.
+func (
+	enc *FountainEncoder,
+) Encode(
+	pkt []byte,
+	esi uint32,
+) []byte {
+	pkt = pkt[:fountainHeaderSize+enc.symbolSize]
+	pkt[4] = KTypeFountain
+	pkt[5] = 0
+	binary.LittleEndian.PutUint16(
+		pkt[6:],
+		uint16(enc.k),
+	)
+	binary.LittleEndian.PutUint32(
+		pkt[8:],
+		enc.id,
+	)
+	binary.LittleEndian.PutUint32(
+		pkt[12:],
+		esi,
+	)
+	binary.LittleEndian.PutUint32(
+		pkt[16:],
+		uint32(enc.length),
+	)
+	sym := pkt[fountainHeaderSize:]
+	if int(
+		esi,
+	) < enc.k {
+		copy(
+			sym,
+			enc.source[int(esi)*enc.symbolSize:],
+		)
+		return pkt
+	}
+	clear(
+		sym,
+	)
+	fountainCoefs(
+		enc.coefs,
+		enc.id,
+		esi,
+		enc.k,
+	)
+	for w, word := range enc.coefs {
+		for word != 0 {
+			c := w*64 + bits.TrailingZeros64(
+				word,
+			)
+			word &= word - 1
+			subtle.XORBytes(
+				sym,
+				sym,
+				enc.source[c*enc.symbolSize:(c+1)*enc.symbolSize],
+			)
+		}
+	}
+	return pkt
+}
+
+// fountainCoefs sets the source symbols combined by repair symbol esi,
+// half of them on average, from a generator seeded by block and esi.
+func fountainCoefs(
+	coefs []uint64,
+	id,
+	esi uint32,
+	k int,
+) {
+	x := uint64(id)<<32 | uint64(esi)
+	for w := range coefs {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		coefs[w] = z ^ z>>31
+	}
+	if k%64 != 0 {
+		coefs[len(coefs)-1] &= 1<<(k%64) - 1
+	}
+	coefs[int(esi)%k/64] |= 1 << (int(esi) % k % 64)
+}
+
+// fountainBlock is a block being decoded by Gaussian elimination.
+// Each stored row has its lowest set coefficient at the column it is
+// the pivot of.
+type fountainBlock struct {
+	k          int
+	symbolSize int
+	length     int
+	rank       int
+	pivots     []int // row of each column, -1 if none
+	coefs      [][]uint64
+	rows       [][]byte
+	held       int // capacity of coefs and rows, in bytes
+}
+
+// FountainDecoder completes fountain coded blocks.
+type FountainDecoder struct {
+	blocks    map[uint32]*fountainBlock
+	order     []uint32        // blocks by arrival, for eviction
+	held      int             // bytes of the blocks being decoded
+	done      map[uint32]bool // blocks completed lately, whose symbols are dropped
+	doneOrder []uint32        // completed blocks, oldest first
+}
+
+// NewFountainDecoder ...
+func NewFountainDecoder() *FountainDecoder {
+	return &FountainDecoder{
+		blocks: make(
+			map[uint32]*fountainBlock,
+		),
+		done: make(
+			map[uint32]bool,
+		),
+	}
+}
+
+// Decode adds a fountain packet to its block, and returns the block
+// once it is complete. Later symbols of the last fountainMaxDone blocks
+// completed are dropped.
+func (
+	dec *FountainDecoder,
+) Decode(
+	pkt []byte,
+) (
+	id uint32,
+	block []byte,
+	ok bool,
+) {
+	if len(
+		pkt,
+	) < fountainHeaderSize+1 || pkt[4] != KTypeFountain {
+		return 0, nil, false
+	}
+	k := int(
+		binary.LittleEndian.Uint16(
+			pkt[6:],
+		),
+	)
+	id = binary.LittleEndian.Uint32(
+		pkt[8:],
+	)
+	esi := binary.LittleEndian.Uint32(
+		pkt[12:],
+	)
+	length := int(
+		binary.LittleEndian.Uint32(
+			pkt[16:],
+		),
+	)
+	sym := pkt[fountainHeaderSize:]
+	if k == 0 || k > fountainMaxSymbols || length > k*len(sym) ||
+		length <= (k-1)*len(sym) && k > 1 {
+		return 0, nil, false
+	}
+	if dec.done[id] {
+		return 0, nil, false
+	}
+	b := dec.blocks[id]
+	if b == nil {
+		if len(
+			dec.order,
+		) >= fountainMaxBlocks {
+			dec.held -= dec.blocks[dec.order[0]].held
+			delete(
+				dec.blocks,
+				dec.order[0],
+			)
+			dec.order = dec.order[1:]
+		}
+		b = &fountainBlock{
+			k:          k,
+			symbolSize: len(sym),
+			length:     length,
+			pivots: make(
+				[]int,
+				k,
+			),
+		}
+		for c := range b.pivots {
+			b.pivots[c] = -1
+		}
+		dec.blocks[id] = b
+		dec.order = append(
+			dec.order,
+			id,
+		)
+	}
+	if b.k != k || b.symbolSize != len(sym) ||
+		b.length != length {
+		return 0, nil, false
+	}
+	coefs := make(
+		[]uint64,
+		(k+63)/64,
+	)
+	if int(
+		esi,
+	) < k {
+		coefs[esi/64] = 1 << (esi % 64)
+	} else {
+		fountainCoefs(
+			coefs,
+			id,
+			esi,
+			k,
+		)
+	}
+	held := b.held
+	inserted := b.insert(
+		coefs,
+		append(
+			[]byte(nil),
+			sym...,
+		),
+	)
+	dec.held += b.held - held
+	if !inserted || b.rank < k {
+		return 0, nil, false
+	}
+	dec.held -= b.held
+	dec.complete(
+		id,
+	)
+	return id, b.solve(), true
+}
+
+// complete stops tracking block id, and remembers it as done.
+func (
+	dec *FountainDecoder,
+) complete(
+	id uint32,
+) {
+	delete(
+		dec.blocks,
+		id,
+	)
+	for i, o := range dec.order {
+		if o == id {
+			dec.order = append(
+				dec.order[:i],
+				dec.order[i+1:]...,
+			)
+			break
+		}
+	}
+	if len(
+		dec.doneOrder,
+	) >= fountainMaxDone {
+		delete(
+			dec.done,
+			dec.doneOrder[0],
+		)
+		dec.doneOrder = dec.doneOrder[1:]
+	}
+	dec.done[id] = true
+	dec.doneOrder = append(
+		dec.doneOrder,
+		id,
+	)
+}
+
+// insert reduces a symbol by the stored rows, and stores it if it is
+// independent of them.
+func (
+	b *fountainBlock,
+) insert(
+	coefs []uint64,
+	sym []byte,
+) bool {
+	for w := range coefs {
+		for coefs[w] != 0 {
+			c := w*64 + bits.TrailingZeros64(
+				coefs[w],
+			)
+			r := b.pivots[c]
+			if r < 0 {
+				b.pivots[c] = len(
+					b.rows,
+				)
+				b.coefs = append(
+					b.coefs,
+					coefs,
+				)
+				b.rows = append(
+					b.rows,
+					sym,
+				)
+				b.held += cap(
+					sym,
+				) + 8*cap(
+					coefs,
+				)
+				b.rank++
+				return true
+			}
+			// the pivot row has no bits below c, so words before w
+			// stay clear
+			for i := w; i < len(coefs); i++ {
+				coefs[i] ^= b.coefs[r][i]
+			}
+			subtle.XORBytes(
+				sym,
+				sym,
+				b.rows[r],
+			)
+		}
+	}
+	return false
+}
+
+// solve back-substitutes the full rank rows into source symbols, and
+// returns the block.
+func (
+	b *fountainBlock,
+) solve() []byte {
+	for c := b.k - 1; c >= 0; c-- {
+		r := b.pivots[c]
+		coefs := b.coefs[r]
+		for w := c / 64; w < len(coefs); w++ {
+			word := coefs[w]
+			if w == c/64 {
+				// keep the pivot, clear everything above it
+				word &^= 1<<(c%64+1) - 1
+			}
+			for word != 0 {
+				d := w*64 + bits.TrailingZeros64(
+					word,
+				)
+				word &= word - 1
+				subtle.XORBytes(
+					b.rows[r],
+					b.rows[r],
+					b.rows[b.pivots[d]],
+				)
+			}
+		}
+	}
+	block := make(
+		[]byte,
+		0,
+		b.k*b.symbolSize,
+	)
+	for c := 0; c < b.k; c++ {
+		block = append(
+			block,
+			b.rows[b.pivots[c]]...,
+		)
+	}
+	b.coefs = nil
+	b.rows = nil
+	b.pivots = nil
+	b.held = 0
+	return block[:b.length]
+}
+
+// NewFountainEncoder cuts block into source symbols that fit the
+// session's packets.
+func (
+	s *UDPSession,
+) NewFountainEncoder(
+	id uint32,
+	block []byte,
+) (
+	*FountainEncoder,
+	error,
+) {
+	s.mu.Lock()
+	mtu := int(
+		s.GFcp.mtu,
+	)
+	s.mu.Unlock()
+	return NewFountainEncoder(
+		id,
+		block,
+		mtu-fountainHeaderSize,
+	)
+}
+
+// WriteSymbols sends n symbols of a fountain coded block, from symbol
+// first on. Symbols below enc.K() are the block itself; any symbol at
+// or above it is a repair symbol, so a sender may keep sending more of
+// them until its receivers are done.
+//
+// Symbols bypass the send window and congestion control: WriteSymbols
+// sends them as fast as it is called, so the caller paces them. A
+// receiver holds up to fountainMaxBlocks incomplete blocks of up to
+// 1024 symbols of an mtu each, about 12MB at the default mtu. Its
+// memory budgets count them as FEC, but do not limit them.
+func (
+	s *UDPSession,
+) WriteSymbols(
+	enc *FountainEncoder,
+	first,
+	n uint32,
+) error {
+	pkt := make(
+		[]byte,
+		fountainHeaderSize+enc.symbolSize,
+	)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return errors.New(
+			errBrokenPipe,
+		)
+	}
+	for esi := first; esi != first+n; esi++ {
+		pkt = enc.Encode(
+			pkt,
+			esi,
+		)
+		binary.LittleEndian.PutUint32(
+			pkt,
+			s.GFcp.conv,
+		)
+		s.queue(
+			pkt,
+		)
+		if len(
+			s.txqueue,
+		) >= fountainBatch {
+			s.uncork()
+		}
+	}
+	s.uncork()
+	return nil
+}
+
+// fountainInput hands a fountain packet to the session's decoder, and
+// queues the block it completes for ReadBlock.
+func (
+	s *UDPSession,
+) fountainInput(
+	data []byte,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if binary.LittleEndian.Uint32(
+		data,
+	) != s.GFcp.conv {
+		return
+	}
+	if s.fountain == nil {
+		s.fountain = NewFountainDecoder()
+	}
+	id, block, ok := s.fountain.Decode(
+		data,
+	)
+	defer s.accountMemory()
+	if !ok {
+		return
+	}
+	if len(
+		s.blocks,
+	) >= fountainMaxBlocks {
+		s.blocks = s.blocks[1:]
+	}
+	s.blocks = append(
+		s.blocks,
+		fountainResult{
+			id:    id,
+			block: block,
+		},
+	)
+	select {
+	case s.chBlockEvent <- struct{}{}:
+	default:
+	}
+	s.pollEvent(
+		PollReadable,
+		nil,
+	)
+}
+
+// ReadBlock returns the next fountain coded block completed, waiting
+// for one until the read deadline.
+func (
+	s *UDPSession,
+) ReadBlock() (
+	id uint32,
+	block []byte,
+	err error,
+) {
+	for {
+		s.mu.Lock()
+		if len(
+			s.blocks,
+		) > 0 {
+			r := s.blocks[0]
+			s.blocks = s.blocks[1:]
+			s.accountMemory()
+			s.mu.Unlock()
+			return r.id, r.block, nil
+		}
+		if s.isClosed {
+			s.mu.Unlock()
+			return 0, nil, errors.New(
+				errBrokenPipe,
+			)
+		}
+		if s.nonblock {
+			s.mu.Unlock()
+			return 0, nil, errTimeout{}
+		}
+		var timeout *time.Timer
+		var c <-chan time.Time
+		if !s.rd.IsZero() {
+			if time.Now().After(
+				s.rd,
+			) {
+				s.mu.Unlock()
+				return 0, nil, errTimeout{}
+			}
+			timeout = time.NewTimer(
+				time.Until(
+					s.rd,
+				),
+			)
+			c = timeout.C
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.chBlockEvent:
+		case <-c:
+		case <-s.die:
+		}
+		if timeout != nil {
+			timeout.Stop()
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+func TestFountainDecoder(
+	t *testing.T,
+) {
+	rnd := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	block := make(
+		[]byte,
+		10000,
+	)
+	rnd.Read(
+		block,
+	)
+	for _, tc := range []struct {
+		first uint32  // first symbol sent
+		loss  float64 // fraction of symbols lost
+	}{
+		{
+			0,
+			0,
+		},
+		{
+			0,
+			0.3,
+		},
+		{
+			// repair symbols only
+			1000,
+			0,
+		},
+	} {
+		enc, err := gfcp.NewFountainEncoder(
+			7,
+			block,
+			100,
+		)
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		dec := gfcp.NewFountainDecoder()
+		pkt := make(
+			[]byte,
+			2048,
+		)
+		received := 0
+		for esi := tc.first; ; esi++ {
+			if rnd.Float64() < tc.loss {
+				continue
+			}
+			received++
+			id, got, ok := dec.Decode(
+				enc.Encode(
+					pkt,
+					esi,
+				),
+			)
+			if !ok {
+				if received > enc.K()+20 {
+					t.Fatalf(
+						"%+v: not complete after %v symbols",
+						tc,
+						received,
+					)
+				}
+				continue
+			}
+			if id != 7 || !bytes.Equal(
+				got,
+				block,
+			) {
+				t.Fatalf(
+					"%+v: block corrupted",
+					tc,
+				)
+			}
+			break
+		}
+	}
+}
+
+// TestFountainDecoderLateSymbols checks that repair symbols arriving
+// after their block is complete do not deliver it again, even once
+// more blocks than the decoder tracks have come and gone.
+func TestFountainDecoderLateSymbols(
+	t *testing.T,
+) {
+	block := make(
+		[]byte,
+		1000,
+	)
+	rand.Read(
+		block,
+	)
+	dec := gfcp.NewFountainDecoder()
+	pkt := make(
+		[]byte,
+		2048,
+	)
+	encoders := make(
+		[]*gfcp.FountainEncoder,
+		10,
+	)
+	for id := range encoders {
+		enc, err := gfcp.NewFountainEncoder(
+			uint32(id),
+			block,
+			100,
+		)
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		encoders[id] = enc
+		complete := false
+		for esi := uint32(0); !complete; esi++ {
+			if esi > uint32(enc.K()+20) {
+				t.Fatalf(
+					"block %v not complete",
+					id,
+				)
+			}
+			_, _, complete = dec.Decode(
+				enc.Encode(
+					pkt,
+					esi,
+				),
+			)
+		}
+	}
+	enc := encoders[0]
+	for esi := uint32(1000); esi < uint32(1000+2*enc.K()); esi++ {
+		if _, _, ok := dec.Decode(
+			enc.Encode(
+				pkt,
+				esi,
+			),
+		); ok {
+			t.Fatalf(
+				"block delivered again at symbol %v",
+				esi,
+			)
+		}
+	}
+}
+
+func TestSessionBlocks(
+	t *testing.T,
+) {
+	link := func(
+		seed int64,
+	) *gfcptest.Link {
+		return &gfcptest.Link{
+			Loss: gfcptest.Bernoulli{
+				P: 0.2,
+			},
+			Delay: 5 * time.Millisecond,
+			Seed:  seed,
+		}
+	}
+	a, b := gfcptest.NewPacketPipe(
+		link(
+			1,
+		),
+		link(
+			2,
+		),
+	)
+	l, err := gfcp.ServeConn(
+		0,
+		0,
+		b,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := make(
+		chan struct{},
+	)
+	blocks := make(
+		chan []byte,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		close(
+			accepted,
+		)
+		s.SetReadDeadline(
+			time.Now().Add(
+				10 * time.Second,
+			),
+		)
+		_, block, err := s.ReadBlock()
+		if err != nil {
+			block = nil
+		}
+		blocks <- block
+	}()
+	cli, err := gfcp.NewConn(
+		b.LocalAddr().String(),
+		0,
+		0,
+		a,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	// the Listener opens sessions for GFCP packets only
+	if _, err := cli.Write(
+		[]byte(
+			"hello",
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(
+		10 * time.Second,
+	):
+		t.Fatal(
+			"session not accepted",
+		)
+	}
+	block := make(
+		[]byte,
+		200000,
+	)
+	rand.Read(
+		block,
+	)
+	enc, err := cli.NewFountainEncoder(
+		1,
+		block,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	// enough to lose 20%, and more
+	if err := cli.WriteSymbols(
+		enc,
+		0,
+		uint32(enc.K()*3/2),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if got := <-blocks; !bytes.Equal(
+		got,
+		block,
+	) {
+		t.Fatal(
+			"block not received",
+		)
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerLimits bounds the sessions a Listener accepts, and the rate
+// at which it takes in packets for each. Zero values do not limit.
+// Bursts of 0 default to the rate, rounded up.
+type ListenerLimits struct {
+	MaxSessions int     // sessions open at once
+	IPRate      float64 // new sessions per second from an IP address
+	IPBurst     int     // new sessions from an IP address at once
+	SubnetRate  float64 // new sessions per second from a subnet
+	SubnetBurst int     // new sessions from a subnet at once
+	SubnetBits4 int     // prefix length of IPv4 subnets, 24 by default
+	SubnetBits6 int     // prefix length of IPv6 subnets, 64 by default
+	PacketRate  float64 // packets per second from a session
+	PacketBurst int     // packets from a session at once
+}
+
+// tokenBucket allows events at a rate, and in bursts of its size.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill; a new bucket
+// starts full.
+func (
+	b *tokenBucket,
+) refill(
+	now time.Time,
+	rate float64,
+	burst int,
+) {
+	if b.last.IsZero() {
+		b.tokens = float64(
+			burst,
+		)
+	} else {
+		b.tokens = math.Min(
+			b.tokens+now.Sub(
+				b.last,
+			).Seconds()*rate,
+			float64(burst),
+		)
+	}
+	b.last = now
+}
+
+// full reports whether the bucket would be full by now, so that it
+// can be forgotten.
+func (
+	b *tokenBucket,
+) full(
+	now time.Time,
+	rate float64,
+	burst int,
+) bool {
+	return b.tokens+now.Sub(
+		b.last,
+	).Seconds()*rate >= float64(
+		burst,
+	)
+}
+
+// listenerLimiter applies the ListenerLimits of a Listener.
+type listenerLimiter struct {
+	ListenerLimits
+	mu      sync.Mutex
+	ips     map[string]*tokenBucket
+	subnets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newListenerLimiter(
+	limits ListenerLimits,
+) *listenerLimiter {
+	burst := func(
+		burst int,
+		rate float64,
+	) int {
+		if burst <= 0 {
+			burst = int(
+				math.Ceil(
+					rate,
+				),
+			)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		return burst
+	}
+	limits.IPBurst = burst(
+		limits.IPBurst,
+		limits.IPRate,
+	)
+	limits.SubnetBurst = burst(
+		limits.SubnetBurst,
+		limits.SubnetRate,
+	)
+	limits.PacketBurst = burst(
+		limits.PacketBurst,
+		limits.PacketRate,
+	)
+	if limits.SubnetBits4 <= 0 || limits.SubnetBits4 > 32 {
+		limits.SubnetBits4 = 24
+	}
+	if limits.SubnetBits6 <= 0 || limits.SubnetBits6 > 128 {
+		limits.SubnetBits6 = 64
+	}
+	return &listenerLimiter{
+		ListenerLimits: limits,
+		ips: make(
+			map[string]*tokenBucket,
+		),
+		subnets: make(
+			map[string]*tokenBucket,
+		),
+	}
+}
+
+// allowSession takes a token for a new session from addr, from both
+// its IP address and its subnet, or from neither if one has none.
+func (
+	lim *listenerLimiter,
+) allowSession(
+	addr net.Addr,
+	now time.Time,
+) bool {
+	if lim.IPRate <= 0 && lim.SubnetRate <= 0 {
+		return true
+	}
+	ip, subnet := lim.sourceKeys(
+		addr,
+	)
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if now.Sub(
+		lim.swept,
+	) > time.Second {
+		lim.sweep(
+			now,
+		)
+	}
+	var buckets [2]*tokenBucket
+	if lim.IPRate > 0 {
+		b := lim.bucket(
+			lim.ips,
+			ip,
+		)
+		b.refill(
+			now,
+			lim.IPRate,
+			lim.IPBurst,
+		)
+		if b.tokens < 1 {
+			return false
+		}
+		buckets[0] = b
+	}
+	if lim.SubnetRate > 0 && subnet != "" {
+		b := lim.bucket(
+			lim.subnets,
+			subnet,
+		)
+		b.refill(
+			now,
+			lim.SubnetRate,
+			lim.SubnetBurst,
+		)
+		if b.tokens < 1 {
+			return false
+		}
+		buckets[1] = b
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
+
+// allowPacket takes a token for a packet of a session from its bucket,
+// which the caller guards with the session's lock.
+func (
+	lim *listenerLimiter,
+) allowPacket(
+	b *tokenBucket,
+	now time.Time,
+) bool {
+	if lim.PacketRate <= 0 {
+		return true
+	}
+	b.refill(
+		now,
+		lim.PacketRate,
+		lim.PacketBurst,
+	)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// bucket returns the bucket of key in m, adding it if needed.
+func (
+	lim *listenerLimiter,
+) bucket(
+	m map[string]*tokenBucket,
+	key string,
+) *tokenBucket {
+	b, ok := m[key]
+	if !ok {
+		b = new(
+			tokenBucket,
+		)
+		m[key] = b
+	}
+	return b
+}
+
+// sweep forgets the buckets that have filled up again, so that the
+// maps hold only sources that are being limited.
+func (
+	lim *listenerLimiter,
+) sweep(
+	now time.Time,
+) {
+	for k, b := range lim.ips {
+		if b.full(
+			now,
+			lim.IPRate,
+			lim.IPBurst,
+		) {
+			delete(
+				lim.ips,
+				k,
+			)
+		}
+	}
+	for k, b := range lim.subnets {
+		if b.full(
+			now,
+			lim.SubnetRate,
+			lim.SubnetBurst,
+		) {
+			delete(
+				lim.subnets,
+				k,
+			)
+		}
+	}
+	lim.swept = now
+}
+
+// sourceKeys returns the IP address of addr and its subnet. Addresses
+// that are not IP addresses are their own source, with no subnet.
+func (
+	lim *listenerLimiter,
+) sourceKeys(
+	addr net.Addr,
+) (
+	ip,
+	subnet string,
+) {
+	var parsed net.IP
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		parsed = udp.IP
+	} else if host, _, err := net.SplitHostPort(
+		addr.String(),
+	); err == nil {
+		parsed = net.ParseIP(
+			host,
+		)
+	}
+	if parsed == nil {
+		return addr.String(), ""
+	}
+	mask := net.CIDRMask(
+		lim.SubnetBits6,
+		128,
+	)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+		mask = net.CIDRMask(
+			lim.SubnetBits4,
+			32,
+		)
+	}
+	return parsed.String(), parsed.Mask(
+		mask,
+	).String()
+}
+
+// SetLimits bounds the sessions the Listener accepts from now on, and
+// the packets it takes in for them; sessions over the limits are not
+// accepted, and packets over them are dropped.
+func (
+	l *Listener,
+) SetLimits(
+	limits ListenerLimits,
+) {
+	l.limiter.Store(
+		newListenerLimiter(
+			limits,
+		),
+	)
+}
+
+// admitSession reports whether a new session from addr is within the
+// limits of the Listener, counting it if not.
+func (
+	l *Listener,
+) admitSession(
+	addr net.Addr,
+) bool {
+	lim, _ := l.limiter.Load().(*listenerLimiter)
+	if lim == nil {
+		return true
+	}
+	if lim.MaxSessions > 0 {
+		l.sessionLock.Lock()
+		n := l.nsessions
+		l.sessionLock.Unlock()
+		if n >= lim.MaxSessions {
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpMaxSessionsRejects,
+				1,
+			)
+			return false
+		}
+	}
+	if !lim.allowSession(
+		addr,
+		l.clock().Now(),
+	) {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpSessionRateRejects,
+			1,
+		)
+		return false
+	}
+	return true
+}
+
+// admitReply reports whether the Listener may answer a packet from
+// addr, which no session is bound to, counting the reply as a new
+// session from its source, so that spoofed packets reflect no more
+// than they could open sessions.
+func (
+	l *Listener,
+) admitReply(
+	addr net.Addr,
+) bool {
+	lim, _ := l.limiter.Load().(*listenerLimiter)
+	if lim == nil || lim.allowSession(
+		addr,
+		l.clock().Now(),
+	) {
+		return true
+	}
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpReplyRateDrops,
+		1,
+	)
+	return false
+}
+
+// admitPacket reports whether a packet for s is within the limits of
+// the Listener, counting it if not.
+func (
+	l *Listener,
+) admitPacket(
+	s *UDPSession,
+) bool {
+	lim, _ := l.limiter.Load().(*listenerLimiter)
+	if lim == nil {
+		return true
+	}
+	now := l.clock().Now()
+	s.mu.Lock()
+	ok := lim.allowPacket(
+		&s.inBucket,
+		now,
+	)
+	s.mu.Unlock()
+	if ok {
+		return true
+	}
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpPacketRateDrops,
+		1,
+	)
+	return false
+}
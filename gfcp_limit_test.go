@@ -0,0 +1,455 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+func TestListenerLimits(
+	t *testing.T,
+) {
+	for _, tc := range []struct {
+		name     string
+		limits   gfcp.ListenerLimits
+		from     []string
+		accepted int
+		rejects  *uint64
+	}{
+		{
+			"MaxSessions",
+			gfcp.ListenerLimits{
+				MaxSessions: 2,
+			},
+			[]string{
+				"10.0.0.1:1",
+				"10.0.1.1:1",
+				"10.0.2.1:1",
+				"10.0.3.1:1",
+			},
+			2,
+			&gfcp.DefaultSnsi.GFcpMaxSessionsRejects,
+		},
+		{
+			"IPRate",
+			gfcp.ListenerLimits{
+				IPRate:  0.001,
+				IPBurst: 2,
+			},
+			[]string{
+				"10.0.0.1:1",
+				"10.0.0.1:2",
+				"10.0.0.1:3",
+				"10.0.0.2:1",
+			},
+			3,
+			&gfcp.DefaultSnsi.GFcpSessionRateRejects,
+		},
+		{
+			"SubnetRate",
+			gfcp.ListenerLimits{
+				SubnetRate:  0.001,
+				SubnetBurst: 2,
+			},
+			[]string{
+				"10.0.0.1:1",
+				"10.0.0.2:1",
+				"10.0.0.3:1",
+				"10.0.1.1:1",
+				"[2001:db8::1]:1",
+				"[2001:db8::2]:1",
+				"[2001:db8::3]:1",
+			},
+			5,
+			&gfcp.DefaultSnsi.GFcpSessionRateRejects,
+		},
+	} {
+		t.Run(
+			tc.name,
+			func(
+				t *testing.T,
+			) {
+				network := gfcp.NewMemNetwork()
+				l, err := network.Listen(
+					"server",
+					0,
+					0,
+				)
+				if err != nil {
+					t.Fatal(
+						err,
+					)
+				}
+				defer l.Close()
+				l.SetLimits(
+					tc.limits,
+				)
+				rejects := atomic.LoadUint64(
+					tc.rejects,
+				)
+				for _, from := range tc.from {
+					cli := dialFrom(
+						t,
+						network,
+						from,
+					)
+					defer cli.Close()
+				}
+				accepted := 0
+				l.SetDeadline(
+					time.Now().Add(
+						time.Second,
+					),
+				)
+				for {
+					s, err := l.AcceptGFCP()
+					if err != nil {
+						break
+					}
+					defer s.Close()
+					accepted++
+				}
+				if accepted != tc.accepted {
+					t.Fatalf(
+						"%v sessions accepted, want %v",
+						accepted,
+						tc.accepted,
+					)
+				}
+				if atomic.LoadUint64(
+					tc.rejects,
+				) == rejects {
+					t.Fatal(
+						"rejections not counted",
+					)
+				}
+			},
+		)
+	}
+}
+
+func TestListenerPacketRate(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	l.SetLimits(
+		gfcp.ListenerLimits{
+			PacketRate:  1,
+			PacketBurst: 4,
+		},
+	)
+	drops := atomic.LoadUint64(
+		&gfcp.DefaultSnsi.GFcpPacketRateDrops,
+	)
+	cli := dialFrom(
+		t,
+		network,
+		"10.0.0.1:1",
+	)
+	defer cli.Close()
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	// segments too large to share a packet
+	msg := make(
+		[]byte,
+		1000,
+	)
+	for i := 0; i < 16; i++ {
+		if _, err := cli.Write(
+			msg,
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	for deadline := time.Now().Add(
+		5 * time.Second,
+	); atomic.LoadUint64(
+		&gfcp.DefaultSnsi.GFcpPacketRateDrops,
+	)-drops < 8; time.Sleep(
+		10 * time.Millisecond,
+	) {
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatalf(
+				"%v packets dropped, want at least 8",
+				atomic.LoadUint64(
+					&gfcp.DefaultSnsi.GFcpPacketRateDrops,
+				)-drops,
+			)
+		}
+	}
+}
+
+// TestListenerReplyRate sends FEC packets the Listener rejects from one
+// address, and checks that it answers no more of them than it would
+// open sessions for.
+func TestListenerReplyRate(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	l.SetLimits(
+		gfcp.ListenerLimits{
+			IPRate:  0.001,
+			IPBurst: 2,
+		},
+	)
+	drops := atomic.LoadUint64(
+		&gfcp.DefaultSnsi.GFcpReplyRateDrops,
+	)
+	raw, err := network.ListenPacket(
+		"10.0.0.1:1",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer raw.Close()
+	server, err := raw.ResolveAddr(
+		"server",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	// version 0 FEC, which the Listener does not serve
+	pkt := make(
+		[]byte,
+		8+gfcp.GfcpOverhead,
+	)
+	pkt[4] = gfcp.KTypeData
+	binary.LittleEndian.PutUint16(
+		pkt[6:],
+		2+gfcp.GfcpOverhead,
+	)
+	binary.LittleEndian.PutUint32(
+		pkt[8:],
+		42,
+	)
+	pkt[12] = gfcp.GfcpCmdPush
+	for i := 0; i < 5; i++ {
+		if _, err := raw.WriteTo(
+			pkt,
+			server,
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	buf := make(
+		[]byte,
+		gfcp.GFcpMtuLimit,
+	)
+	replies := 0
+	for {
+		raw.SetReadDeadline(
+			time.Now().Add(
+				200 * time.Millisecond,
+			),
+		)
+		if _, _, err := raw.ReadFrom(
+			buf,
+		); err != nil {
+			break
+		}
+		replies++
+	}
+	if replies != 2 {
+		t.Fatalf(
+			"%v replies, want 2",
+			replies,
+		)
+	}
+	if n := atomic.LoadUint64(
+		&gfcp.DefaultSnsi.GFcpReplyRateDrops,
+	) - drops; n != 3 {
+		t.Fatalf(
+			"%v replies withheld, want 3",
+			n,
+		)
+	}
+}
+
+// dialFrom dials the "server" of network from the address from, and
+// sends it a message to open the session.
+// TestListenerMaxSessionsPaths checks that MaxSessions counts a
+// session with a joined path once, and frees its slot on close.
+func TestListenerMaxSessionsPaths(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	l.SetLimits(
+		gfcp.ListenerLimits{
+			MaxSessions: 2,
+		},
+	)
+	l.SetDeadline(
+		time.Now().Add(
+			5 * time.Second,
+		),
+	)
+	cli := dialFrom(
+		t,
+		network,
+		"10.0.0.1:1",
+	)
+	defer cli.Close()
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	second, err := network.ListenPacket(
+		"10.0.0.2:1",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if err := cli.AddPath(
+		second,
+		"server",
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	for deadline := time.Now().Add(
+		5 * time.Second,
+	); len(
+		s.PathStats(),
+	) < 2; time.Sleep(
+		10 * time.Millisecond,
+	) {
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatal(
+				"path not joined",
+			)
+		}
+	}
+	other := dialFrom(
+		t,
+		network,
+		"10.0.1.1:1",
+	)
+	defer other.Close()
+	s2, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatalf(
+			"second session refused: %v",
+			err,
+		)
+	}
+	defer s2.Close()
+	s.Close()
+	third := dialFrom(
+		t,
+		network,
+		"10.0.2.1:1",
+	)
+	defer third.Close()
+	s3, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatalf(
+			"session refused after a close: %v",
+			err,
+		)
+	}
+	s3.Close()
+}
+
+func dialFrom(
+	t *testing.T,
+	network *gfcp.MemNetwork,
+	from string,
+) *gfcp.UDPSession {
+	conn, err := network.ListenPacket(
+		from,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli, err := gfcp.NewConn(
+		"server",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if _, err := cli.Write(
+		[]byte(
+			"hello",
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	return cli
+}
@@ -0,0 +1,382 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnsonjh/gfcp/internal/packetqueue"
+	"github.com/pkg/errors"
+)
+
+// memQueueLen bounds the receive queue of a MemConn; further packets
+// are dropped, as a full socket buffer would.
+const memQueueLen = 1024
+
+// MemAddr is the name of a MemConn on its MemNetwork.
+type MemAddr string
+
+// Network returns "mem".
+func (
+	a MemAddr,
+) Network() string {
+	return "mem"
+}
+
+func (
+	a MemAddr,
+) String() string {
+	return string(
+		a,
+	)
+}
+
+// MemNetwork is an in-process packet network. Conns on it are
+// addressed by name, and packets are delivered without any sockets.
+type MemNetwork struct {
+	mu    sync.Mutex
+	conns map[MemAddr]*MemConn
+	next  uint64
+}
+
+// NewMemNetwork creates an empty MemNetwork.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		conns: make(
+			map[MemAddr]*MemConn,
+		),
+	}
+}
+
+// ListenPacket attaches a new MemConn named name to the network.
+// An empty name picks an unused one.
+func (
+	n *MemNetwork,
+) ListenPacket(
+	name string,
+) (
+	*MemConn,
+	error,
+) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := MemAddr(
+		name,
+	)
+	for addr == "" {
+		n.next++
+		addr = MemAddr(
+			"mem-" + strconv.FormatUint(
+				n.next,
+				10,
+			),
+		)
+		if _, ok := n.conns[addr]; ok {
+			addr = ""
+		}
+	}
+	if _, ok := n.conns[addr]; ok {
+		return nil, errors.New(
+			"address already in use",
+		)
+	}
+	c := &MemConn{
+		network: n,
+		addr:    addr,
+		queue: packetqueue.New(
+			memQueueLen,
+		),
+	}
+	n.conns[addr] = c
+	return c, nil
+}
+
+// Listen serves GFcp on a new MemConn named laddr.
+func (
+	n *MemNetwork,
+) Listen(
+	laddr string,
+	dataShards,
+	parityShards int,
+) (
+	*Listener,
+	error,
+) {
+	conn, err := n.ListenPacket(
+		laddr,
+	)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"MemNetwork.ListenPacket",
+		)
+	}
+	return ServeConn(
+		dataShards,
+		parityShards,
+		conn,
+	)
+}
+
+// Dial connects to the Listener named raddr from a new MemConn.
+func (
+	n *MemNetwork,
+) Dial(
+	raddr string,
+	dataShards,
+	parityShards int,
+) (
+	*UDPSession,
+	error,
+) {
+	conn, err := n.ListenPacket(
+		"",
+	)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"MemNetwork.ListenPacket",
+		)
+	}
+	return NewConn(
+		raddr,
+		dataShards,
+		parityShards,
+		conn,
+	)
+}
+
+func (
+	n *MemNetwork,
+) lookup(
+	addr MemAddr,
+) *MemConn {
+	n.mu.Lock()
+	c := n.conns[addr]
+	n.mu.Unlock()
+	return c
+}
+
+func (
+	n *MemNetwork,
+) remove(
+	c *MemConn,
+) {
+	n.mu.Lock()
+	if n.conns[c.addr] == c {
+		delete(
+			n.conns,
+			c.addr,
+		)
+	}
+	n.mu.Unlock()
+}
+
+// MemConn is a net.PacketConn attached to a MemNetwork.
+type MemConn struct {
+	network *MemNetwork
+	addr    MemAddr
+	queue   *packetqueue.Queue
+	dropped uint64
+}
+
+// ResolveAddr parses addr as a name on the conn's network.
+func (
+	c *MemConn,
+) ResolveAddr(
+	addr string,
+) (
+	net.Addr,
+	error,
+) {
+	if addr == "" {
+		return nil, errors.New(
+			"missing address",
+		)
+	}
+	return MemAddr(
+		addr,
+	), nil
+}
+
+// Dropped returns the number of packets dropped by a full receive
+// queue.
+func (
+	c *MemConn,
+) Dropped() uint64 {
+	return atomic.LoadUint64(
+		&c.dropped,
+	)
+}
+
+// ReadFrom implements net.PacketConn.
+func (
+	c *MemConn,
+) ReadFrom(
+	b []byte,
+) (
+	int,
+	net.Addr,
+	error,
+) {
+	n, from, err := c.queue.Pop(
+		b,
+	)
+	if err != nil {
+		return 0, nil, c.opError(
+			"read",
+			err,
+		)
+	}
+	return n, from, nil
+}
+
+// WriteTo implements net.PacketConn. As with UDP, packets for unknown
+// addresses are silently discarded.
+func (
+	c *MemConn,
+) WriteTo(
+	b []byte,
+	addr net.Addr,
+) (
+	int,
+	error,
+) {
+	select {
+	case <-c.queue.Done():
+		return 0, c.opError(
+			"write",
+			net.ErrClosed,
+		)
+	default:
+	}
+	if addr == nil {
+		return 0, c.opError(
+			"write",
+			errors.New(
+				"missing address",
+			),
+		)
+	}
+	dst := c.network.lookup(
+		MemAddr(
+			addr.String(),
+		),
+	)
+	if dst != nil {
+		dst.enqueue(
+			packetqueue.Packet{
+				Data: append(
+					[]byte(nil),
+					b...,
+				),
+				From: c.addr,
+			},
+		)
+	}
+	return len(
+		b,
+	), nil
+}
+
+func (
+	c *MemConn,
+) enqueue(
+	p packetqueue.Packet,
+) {
+	select {
+	case <-c.queue.Done():
+		return
+	default:
+	}
+	if !c.queue.Push(
+		p,
+	) {
+		atomic.AddUint64(
+			&c.dropped,
+			1,
+		)
+	}
+}
+
+// Close detaches the conn from its network.
+func (
+	c *MemConn,
+) Close() error {
+	if !c.queue.Close() {
+		return c.opError(
+			"close",
+			net.ErrClosed,
+		)
+	}
+	c.network.remove(
+		c,
+	)
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (
+	c *MemConn,
+) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements net.PacketConn.
+func (
+	c *MemConn,
+) SetDeadline(
+	t time.Time,
+) error {
+	return c.SetReadDeadline(
+		t,
+	)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (
+	c *MemConn,
+) SetReadDeadline(
+	t time.Time,
+) error {
+	c.queue.SetDeadline(
+		t,
+	)
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn. Writes never block, so
+// it has no effect.
+func (
+	c *MemConn,
+) SetWriteDeadline(
+	t time.Time,
+) error {
+	return nil
+}
+
+func (
+	c *MemConn,
+) opError(
+	op string,
+	err error,
+) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "mem",
+		Source: c.addr,
+		Err:    err,
+	}
+}
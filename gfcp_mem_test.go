@@ -0,0 +1,131 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	u "github.com/johnsonjh/leaktestfe"
+)
+
+func TestMemNetwork(
+	t *testing.T,
+) {
+	defer u.Leakplug(
+		t,
+	)
+	const clients = 200
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		10,
+		3,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	if _, err := network.ListenPacket(
+		"server",
+	); err == nil {
+		t.Fatal(
+			"duplicate address accepted",
+		)
+	}
+	go func() {
+		for {
+			s, err := l.AcceptGFCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				s.SetDeadline(
+					time.Now().Add(
+						10 * time.Second,
+					),
+				)
+				buf := make(
+					[]byte,
+					1024,
+				)
+				for {
+					n, err := s.Read(
+						buf,
+					)
+					if err != nil {
+						return
+					}
+					s.Write(
+						buf[:n],
+					)
+				}
+			}()
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(
+		chan error,
+		clients,
+	)
+	for i := 0; i < clients; i++ {
+		wg.Add(
+			1,
+		)
+		go func() {
+			defer wg.Done()
+			cli, err := network.Dial(
+				"server",
+				10,
+				3,
+			)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer cli.Close()
+			if network := cli.RemoteAddr().Network(); network != "mem" {
+				errs <- fmt.Errorf(
+					"remote network %q",
+					network,
+				)
+				return
+			}
+			cli.SetDeadline(
+				time.Now().Add(
+					10 * time.Second,
+				),
+			)
+			errs <- echoTester(
+				cli,
+				1024,
+				16,
+			)
+		}()
+	}
+	wg.Wait()
+	close(
+		errs,
+	)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+}
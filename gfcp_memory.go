@@ -0,0 +1,194 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"sync/atomic"
+)
+
+// pressureRcvWnd is the receive window of sessions while a memory
+// budget they count against is over its limit.
+const pressureRcvWnd = 4
+
+// DefaultMemoryBudget accounts for the buffers of all sessions of the
+// process. It has no limit unless one is set.
+var DefaultMemoryBudget = NewMemoryBudget(
+	0,
+)
+
+// MemoryUsage is the capacity of the buffers sessions hold, in bytes.
+type MemoryUsage struct {
+	Send    int64 // queued to be sent, or not yet acknowledged
+	Receive int64 // received, and not yet read
+	FEC     int64 // FEC shards and fountain symbols waiting for the rest of their group or block
+}
+
+// Total returns the capacity of all buffers.
+func (
+	u MemoryUsage,
+) Total() int64 {
+	return u.Send + u.Receive + u.FEC
+}
+
+// MemoryBudget accounts for the data held in the buffers of a group of
+// sessions. Once that is over its limit, the sessions shrink their
+// receive windows to a few segments, so that attackers or slow readers
+// slow them down rather than run the process out of memory.
+type MemoryBudget struct {
+	limit   int64 // 0 for none
+	send    int64
+	receive int64
+	fec     int64
+}
+
+// NewMemoryBudget returns a MemoryBudget of limit bytes; 0 is no limit.
+func NewMemoryBudget(
+	limit int64,
+) *MemoryBudget {
+	return &MemoryBudget{
+		limit: limit,
+	}
+}
+
+// SetLimit changes the limit of the budget, in bytes; 0 is no limit.
+// Sessions apply it as their buffers next change.
+func (
+	b *MemoryBudget,
+) SetLimit(
+	limit int64,
+) {
+	atomic.StoreInt64(
+		&b.limit,
+		limit,
+	)
+}
+
+// Limit returns the limit of the budget, in bytes.
+func (
+	b *MemoryBudget,
+) Limit() int64 {
+	return atomic.LoadInt64(
+		&b.limit,
+	)
+}
+
+// Usage returns the data held in the buffers of the sessions counted.
+func (
+	b *MemoryBudget,
+) Usage() MemoryUsage {
+	return MemoryUsage{
+		Send: atomic.LoadInt64(
+			&b.send,
+		),
+		Receive: atomic.LoadInt64(
+			&b.receive,
+		),
+		FEC: atomic.LoadInt64(
+			&b.fec,
+		),
+	}
+}
+
+// over reports whether the budget is over its limit.
+func (
+	b *MemoryBudget,
+) over() bool {
+	limit := b.Limit()
+	return limit > 0 && b.Usage().Total() > limit
+}
+
+// add counts a change in the data held.
+func (
+	b *MemoryBudget,
+) add(
+	d MemoryUsage,
+) {
+	atomic.AddInt64(
+		&b.send,
+		d.Send,
+	)
+	atomic.AddInt64(
+		&b.receive,
+		d.Receive,
+	)
+	atomic.AddInt64(
+		&b.fec,
+		d.FEC,
+	)
+}
+
+// accountMemory counts the change in the buffers held by s
+// against its budgets, and caps its receive window while any of them is
+// over its limit. Callers must hold s.mu.
+func (
+	s *UDPSession,
+) accountMemory() {
+	var held MemoryUsage
+	if !s.isClosed {
+		held.Send = int64(
+			s.GFcp.sndHeld,
+		)
+		held.Receive = int64(
+			s.GFcp.rcvHeld,
+		)
+		if s.FecDecoder != nil {
+			held.FEC = int64(
+				s.FecDecoder.held,
+			)
+		}
+		if s.fountain != nil {
+			held.FEC += int64(
+				s.fountain.held,
+			)
+		}
+		for _, r := range s.blocks {
+			held.Receive += int64(
+				cap(r.block),
+			)
+		}
+	}
+	if held != s.memHeld {
+		d := MemoryUsage{
+			Send:    held.Send - s.memHeld.Send,
+			Receive: held.Receive - s.memHeld.Receive,
+			FEC:     held.FEC - s.memHeld.FEC,
+		}
+		s.memHeld = held
+		DefaultMemoryBudget.add(
+			d,
+		)
+		if s.l != nil {
+			s.l.memory.add(
+				d,
+			)
+		}
+		// negative changes wrap around to subtract
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpSendBufferBytes,
+			uint64(d.Send),
+		)
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpReceiveBufferBytes,
+			uint64(d.Receive),
+		)
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpFECBufferBytes,
+			uint64(d.FEC),
+		)
+	}
+	var wnd uint32
+	if DefaultMemoryBudget.over() || (s.l != nil && s.l.memory.over()) {
+		wnd = pressureRcvWnd
+	}
+	s.GFcp.capRcvWnd(
+		wnd,
+	)
+}
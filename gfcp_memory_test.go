@@ -0,0 +1,427 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+func TestMemoryBudget(
+	t *testing.T,
+) {
+	const limit = 32 * 1024
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	budget := l.MemoryBudget()
+	budget.SetLimit(
+		limit,
+	)
+	accepted := make(
+		chan *gfcp.UDPSession,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err == nil {
+			accepted <- s
+		}
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	cli.SetWindowSize(
+		128,
+		128,
+	)
+	data := make(
+		[]byte,
+		256*1024,
+	)
+	rand.Read(
+		data,
+	)
+	written := make(
+		chan error,
+		1,
+	)
+	go func() {
+		cli.SetWriteDeadline(
+			time.Now().Add(
+				30 * time.Second,
+			),
+		)
+		_, err := cli.Write(
+			data,
+		)
+		written <- err
+	}()
+	s := <-accepted
+	defer s.Close()
+	// a window well beyond the limit: the server reads nothing, so its
+	// buffers fill up to the limit, and no more than a few segments past
+	s.SetWindowSize(
+		128,
+		128,
+	)
+	for deadline := time.Now().Add(
+		10 * time.Second,
+	); budget.Usage().Receive < limit; time.Sleep(
+		10 * time.Millisecond,
+	) {
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatalf(
+				"%v bytes held, want %v",
+				budget.Usage().Receive,
+				limit,
+			)
+		}
+	}
+	time.Sleep(
+		500 * time.Millisecond,
+	)
+	if held := budget.Usage().Receive; held > limit+8*1400 {
+		t.Fatalf(
+			"%v bytes held for a limit of %v",
+			held,
+			limit,
+		)
+	}
+	s.SetReadDeadline(
+		time.Now().Add(
+			30 * time.Second,
+		),
+	)
+	got := make(
+		[]byte,
+		len(data),
+	)
+	if _, err := io.ReadFull(
+		s,
+		got,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if !bytes.Equal(
+		got,
+		data,
+	) {
+		t.Fatal(
+			"data corrupted",
+		)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if u := budget.Usage(); u != (gfcp.MemoryUsage{}) {
+		t.Fatalf(
+			"%+v held once all is read",
+			u,
+		)
+	}
+}
+
+// TestMemoryBufferCapacity checks that small messages are charged for
+// the pooled buffers holding them, not for their length.
+func TestMemoryBufferCapacity(
+	t *testing.T,
+) {
+	const messages = 16
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	budget := l.MemoryBudget()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	for i := 0; i < messages; i++ {
+		if _, err := cli.Write(
+			[]byte{
+				byte(i),
+			},
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	l.SetDeadline(
+		time.Now().Add(
+			5 * time.Second,
+		),
+	)
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	// each byte sits in a buffer of the smallest size class
+	for deadline := time.Now().Add(
+		5 * time.Second,
+	); budget.Usage().Receive < messages*128; time.Sleep(
+		10 * time.Millisecond,
+	) {
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatalf(
+				"%+v held for %v messages",
+				budget.Usage(),
+				messages,
+			)
+		}
+	}
+	s.SetReadDeadline(
+		time.Now().Add(
+			5 * time.Second,
+		),
+	)
+	buf := make(
+		[]byte,
+		16,
+	)
+	for i := 0; i < messages; i++ {
+		if _, err := s.Read(
+			buf,
+		); err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	if u := budget.Usage(); u.Total() != 0 {
+		t.Fatalf(
+			"%+v held once all is read",
+			u,
+		)
+	}
+}
+
+// TestFountainMemory checks that fountain symbols waiting for the rest
+// of their block count as FEC, and completed blocks until read as
+// received data.
+func TestFountainMemory(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	budget := l.MemoryBudget()
+	accepted := make(
+		chan *gfcp.UDPSession,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err == nil {
+			accepted <- s
+		}
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	// the Listener opens sessions for GFCP packets only
+	if _, err := cli.Write(
+		[]byte(
+			"hello",
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s := <-accepted
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if _, err := s.Read(
+		make(
+			[]byte,
+			5,
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	block := make(
+		[]byte,
+		100000,
+	)
+	rand.Read(
+		block,
+	)
+	enc, err := cli.NewFountainEncoder(
+		1,
+		block,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	k := uint32(
+		enc.K(),
+	)
+	wait := func(
+		what string,
+		done func(
+			gfcp.MemoryUsage,
+		) bool,
+	) {
+		t.Helper()
+		for deadline := time.Now().Add(
+			5 * time.Second,
+		); !done(
+			budget.Usage(),
+		); time.Sleep(
+			10 * time.Millisecond,
+		) {
+			if time.Now().After(
+				deadline,
+			) {
+				t.Fatalf(
+					"%v: %+v held",
+					what,
+					budget.Usage(),
+				)
+			}
+		}
+	}
+	if err := cli.WriteSymbols(
+		enc,
+		0,
+		k/2,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	wait(
+		"half a block",
+		func(
+			u gfcp.MemoryUsage,
+		) bool {
+			return u.FEC >= int64(len(block)/4)
+		},
+	)
+	if err := cli.WriteSymbols(
+		enc,
+		k/2,
+		k-k/2,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	wait(
+		"a completed block",
+		func(
+			u gfcp.MemoryUsage,
+		) bool {
+			return u.FEC == 0 && u.Receive >= int64(len(block))
+		},
+	)
+	if _, got, err := s.ReadBlock(); err != nil || !bytes.Equal(
+		got,
+		block,
+	) {
+		t.Fatal(
+			"block not received:",
+			err,
+		)
+	}
+	if u := budget.Usage(); u.Total() != 0 {
+		t.Fatalf(
+			"%+v held once the block is read",
+			u,
+		)
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a message read without copying: the data of its segments,
+// in order, in pooled buffers.
+type Message struct {
+	Buffers [][]byte
+}
+
+// Len returns the size of the message.
+func (
+	m *Message,
+) Len() (
+	n int,
+) {
+	for _, b := range m.Buffers {
+		n += len(
+			b,
+		)
+	}
+	return
+}
+
+// Release returns the buffers of the message to their pool; they must
+// not be used afterwards.
+func (
+	m *Message,
+) Release() {
+	for k, b := range m.Buffers {
+		xmitBuf.Put(
+			b,
+		)
+		m.Buffers[k] = nil
+	}
+	m.Buffers = nil
+}
+
+// ReadMessage returns the next message, handing out the buffers it was
+// received in rather than copying them, waiting for one until the read
+// deadline. The message must be released once used.
+func (
+	s *UDPSession,
+) ReadMessage() (
+	msg Message,
+	err error,
+) {
+	msg.Buffers, err = s.readBuffers(
+		nil,
+		false,
+	)
+	return msg, err
+}
+
+// readBuffers waits for a message until the read deadline, and appends
+// its buffers to bufs, or, with drain, those of every message received.
+func (
+	s *UDPSession,
+) readBuffers(
+	bufs [][]byte,
+	drain bool,
+) (
+	[][]byte,
+	error,
+) {
+	for {
+		s.mu.Lock()
+		if len(
+			s.bufptr,
+		) > 0 {
+			// the rest of a message Read only in part
+			buf := xmitBuf.Get(
+				len(s.bufptr),
+			)
+			copy(
+				buf,
+				s.bufptr,
+			)
+			s.bufptr = nil
+			s.mu.Unlock()
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpBytesReceived,
+				uint64(len(buf)),
+			)
+			return append(
+				bufs,
+				buf,
+			), nil
+		}
+		if s.isClosed {
+			s.mu.Unlock()
+			return bufs, errors.New(
+				errBrokenPipe,
+			)
+		}
+		if s.rejected != nil {
+			s.mu.Unlock()
+			return bufs, s.rejected
+		}
+		var size int
+		if bufs, size = s.GFcp.RecvBuffers(
+			bufs,
+		); size >= 0 {
+			for drain {
+				var more int
+				if bufs, more = s.GFcp.RecvBuffers(
+					bufs,
+				); more < 0 {
+					break
+				}
+				size += more
+			}
+			s.accountMemory()
+			wake := s.wakeup(
+				s.GFcp.WaitSnd(),
+			)
+			s.mu.Unlock()
+			s.reschedule(
+				wake,
+			)
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpBytesReceived,
+				uint64(size),
+			)
+			return bufs, nil
+		}
+		if s.nonblock {
+			s.mu.Unlock()
+			return bufs, errTimeout{}
+		}
+		var timeout *time.Timer
+		var c <-chan time.Time
+		if !s.rd.IsZero() {
+			if time.Now().After(
+				s.rd,
+			) {
+				s.mu.Unlock()
+				return bufs, errTimeout{}
+			}
+			timeout = time.NewTimer(
+				time.Until(
+					s.rd,
+				),
+			)
+			c = timeout.C
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.chReadEvent:
+		case <-c:
+		case <-s.die:
+		case err := <-s.chReadError:
+			if timeout != nil {
+				timeout.Stop()
+			}
+			return bufs, err
+		}
+		if timeout != nil {
+			timeout.Stop()
+		}
+	}
+}
+
+// WriteTo writes messages to w as they arrive, straight from the
+// buffers they were received in, until an error, which it returns.
+// It implements io.WriterTo, so io.Copy forwards without copying.
+func (
+	s *UDPSession,
+) WriteTo(
+	w io.Writer,
+) (
+	n int64,
+	err error,
+) {
+	var vec, scratch [][]byte
+	var bufs net.Buffers
+	for {
+		if vec, err = s.readBuffers(
+			vec[:0],
+			true,
+		); err != nil {
+			return n, err
+		}
+		// net.Buffers consumes its slice and the buffers in it, so it
+		// gets a copy; vec keeps them whole, to return to the pool
+		scratch = append(
+			scratch[:0],
+			vec...,
+		)
+		bufs = scratch
+		written, err := bufs.WriteTo(
+			w,
+		)
+		n += written
+		for k, b := range vec {
+			xmitBuf.Put(
+				b,
+			)
+			vec[k] = nil
+			scratch[k] = nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// readFromBatch is the most segments ReadFrom reads before sending.
+const readFromBatch = 32
+
+// ReadFrom sends what it reads from r until EOF, reading straight into
+// the buffers of mss sized segments. Reads that fill their segment are
+// batched, and sent and flushed together as a Write would be, once a
+// read comes up short or the batch is full. It implements io.ReaderFrom,
+// so io.Copy sends without copying. It reads from r only once the send
+// window has room, and queues the whole batch then, so a write deadline
+// never leaves data read but not queued.
+func (
+	s *UDPSession,
+) ReadFrom(
+	r io.Reader,
+) (
+	n int64,
+	err error,
+) {
+	var batch [][]byte
+	for {
+		if _, err := s.sendBuffers(
+			nil,
+			false,
+		); err != nil {
+			return n, err
+		}
+		s.mu.Lock()
+		mss := int(
+			s.GFcp.mss,
+		)
+		segs := readFromBatch
+		if s.sndBufLimit > 0 {
+			// keep within a segment of the send buffer limit
+			if room := (s.sendAvailable() + mss - 1) / mss; room < segs {
+				segs = room
+			}
+			if segs < 1 {
+				segs = 1
+			}
+		}
+		s.mu.Unlock()
+		var rerr error
+		for len(
+			batch,
+		) < segs {
+			buf := xmitBuf.Get(
+				mss,
+			)
+			nr, err := r.Read(
+				buf,
+			)
+			if nr > 0 {
+				batch = append(
+					batch,
+					buf[:nr],
+				)
+			} else {
+				xmitBuf.Put(
+					buf,
+				)
+			}
+			if err != nil {
+				rerr = err
+				break
+			}
+			if nr < mss {
+				break
+			}
+		}
+		if len(
+			batch,
+		) > 0 {
+			sent, err := s.sendBuffers(
+				batch,
+				true,
+			)
+			if err != nil {
+				for _, b := range batch {
+					xmitBuf.Put(
+						b,
+					)
+				}
+				return n, err
+			}
+			n += int64(
+				sent,
+			)
+			for k := range batch {
+				batch[k] = nil
+			}
+			batch = batch[:0]
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// sendBuffers queues bufs, segments of xmitBuf, once the send window
+// has room, or at once if force is set, flushing them as WriteBuffers
+// would. Either all of bufs are queued, or none are and it returns an
+// error. Without bufs, it only waits for room.
+func (
+	s *UDPSession,
+) sendBuffers(
+	bufs [][]byte,
+	force bool,
+) (
+	n int,
+	err error,
+) {
+	for {
+		s.mu.Lock()
+		if s.isClosed {
+			s.mu.Unlock()
+			return 0, errors.New(
+				errBrokenPipe,
+			)
+		}
+		if s.rejected != nil {
+			s.mu.Unlock()
+			return 0, s.rejected
+		}
+		if force || s.GFcp.WaitSnd() < int(
+			s.GFcp.sndWnd,
+		) && !s.sendBufferFull() {
+			for _, b := range bufs {
+				if len(
+					b,
+				) > int(
+					s.GFcp.mss,
+				) {
+					s.mu.Unlock()
+					return 0, errors.New(
+						errInvalidOperation,
+					)
+				}
+			}
+			for _, b := range bufs {
+				s.GFcp.SendBuffer(
+					b,
+				)
+				n += len(
+					b,
+				)
+			}
+			if s.GFcp.WaitSnd() >= int(
+				s.GFcp.sndWnd,
+			) || !s.writeDelay {
+				s.GFcp.Flush(
+					false,
+				)
+				s.uncork()
+			}
+			s.accountMemory()
+			wake := s.wakeup(
+				s.GFcp.WaitSnd(),
+			)
+			s.mu.Unlock()
+			s.reschedule(
+				wake,
+			)
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpBytesSent,
+				uint64(
+					n,
+				),
+			)
+			return n, nil
+		}
+		s.sndFull = true
+		if s.nonblock {
+			s.mu.Unlock()
+			return 0, errTimeout{}
+		}
+		var timeout *time.Timer
+		var c <-chan time.Time
+		if !s.wd.IsZero() {
+			if time.Now().After(
+				s.wd,
+			) {
+				s.mu.Unlock()
+				return 0, errTimeout{}
+			}
+			timeout = time.NewTimer(
+				time.Until(
+					s.wd,
+				),
+			)
+			c = timeout.C
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.chWriteEvent:
+		case <-c:
+		case <-s.die:
+		case err = <-s.chWriteError:
+			if timeout != nil {
+				timeout.Stop()
+			}
+			return 0, err
+		}
+		if timeout != nil {
+			timeout.Stop()
+		}
+	}
+}
@@ -0,0 +1,683 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+// limitWriter collects writes until it holds n bytes, then fails.
+type limitWriter struct {
+	bytes.Buffer
+	n int
+}
+
+var errLimit = errors.New(
+	"limit reached",
+)
+
+func (
+	w *limitWriter,
+) Write(
+	b []byte,
+) (
+	int,
+	error,
+) {
+	w.Buffer.Write(
+		b,
+	)
+	if w.Len() >= w.n {
+		return len(b), errLimit
+	}
+	return len(b), nil
+}
+
+func TestReadMessage(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	// messages of one and of several segments
+	msgs := make(
+		[][]byte,
+		8,
+	)
+	for k := range msgs {
+		msgs[k] = make(
+			[]byte,
+			1+rand.Intn(
+				8000,
+			),
+		)
+		rand.Read(
+			msgs[k],
+		)
+	}
+	done := make(
+		chan struct{},
+	)
+	defer close(
+		done,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		for _, m := range msgs {
+			if _, err := s.Write(
+				m,
+			); err != nil {
+				return
+			}
+		}
+		<-done
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if _, err := cli.Write(
+		[]byte(
+			"hello",
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	// Write splits messages into segments, each read as a message
+	want := bytes.Join(
+		msgs,
+		nil,
+	)
+	var got []byte
+	for len(
+		got,
+	) < len(want)/2 {
+		msg, err := cli.ReadMessage()
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		n := msg.Len()
+		for _, b := range msg.Buffers {
+			got = append(
+				got,
+				b...,
+			)
+		}
+		msg.Release()
+		if n == 0 || !bytes.Equal(
+			got,
+			want[:len(got)],
+		) {
+			t.Fatalf(
+				"message of %v bytes corrupted",
+				n,
+			)
+		}
+	}
+	want = want[len(got):]
+	w := &limitWriter{
+		n: len(want),
+	}
+	n, err := io.Copy(
+		w,
+		cli,
+	)
+	if err != errLimit || n != int64(len(want)) || !bytes.Equal(
+		w.Bytes(),
+		want,
+	) {
+		t.Fatalf(
+			"WriteTo: %v bytes, %v",
+			n,
+			err,
+		)
+	}
+}
+
+func TestReadFrom(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	data := make(
+		[]byte,
+		256*1024,
+	)
+	rand.Read(
+		data,
+	)
+	sent := make(
+		chan error,
+		1,
+	)
+	go func() {
+		// hide bytes.Reader's WriteTo, so io.Copy uses ReadFrom
+		n, err := io.Copy(
+			cli,
+			struct{ io.Reader }{
+				bytes.NewReader(
+					data,
+				),
+			},
+		)
+		if err == nil && n != int64(len(data)) {
+			err = io.ErrShortWrite
+		}
+		sent <- err
+	}()
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	got := make(
+		[]byte,
+		len(data),
+	)
+	if _, err := io.ReadFull(
+		s,
+		got,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if !bytes.Equal(
+		got,
+		data,
+	) {
+		t.Fatal(
+			"data corrupted",
+		)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+}
+
+// TestReadFromTimeout keeps calling ReadFrom through write timeouts,
+// and checks that the batches that timed out are still sent in order.
+func TestReadFromTimeout(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(
+		16,
+		16,
+	)
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	data := make(
+		[]byte,
+		64*1024,
+	)
+	rand.Read(
+		data,
+	)
+	sent := make(
+		chan error,
+		1,
+	)
+	go func() {
+		r := bytes.NewReader(
+			data,
+		)
+		var total int64
+		timeouts := 0
+		for {
+			cli.SetWriteDeadline(
+				time.Now().Add(
+					5 * time.Millisecond,
+				),
+			)
+			n, err := cli.ReadFrom(
+				r,
+			)
+			total += n
+			var ne net.Error
+			if errors.As(
+				err,
+				&ne,
+			) && ne.Timeout() {
+				timeouts++
+				continue
+			}
+			if err == nil && total != int64(len(data)) {
+				err = io.ErrShortWrite
+			}
+			if err == nil && timeouts == 0 {
+				err = errors.New(
+					"no write timed out",
+				)
+			}
+			sent <- err
+			return
+		}
+	}()
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	got := make(
+		[]byte,
+		len(data),
+	)
+	if _, err := io.ReadFull(
+		s,
+		got,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if !bytes.Equal(
+		got,
+		data,
+	) {
+		t.Fatal(
+			"data corrupted",
+		)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+}
+
+// TestReadFromTimeoutClose checks that the bytes a timed out ReadFrom
+// reports are sent without further calls, before the session closes.
+func TestReadFromTimeoutClose(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli.SetWindowSize(
+		16,
+		16,
+	)
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	data := make(
+		[]byte,
+		1024*1024,
+	)
+	rand.Read(
+		data,
+	)
+	// the server reads nothing yet, so the send window fills up
+	cli.SetWriteDeadline(
+		time.Now().Add(
+			200 * time.Millisecond,
+		),
+	)
+	n, err := cli.ReadFrom(
+		bytes.NewReader(
+			data,
+		),
+	)
+	var ne net.Error
+	if !errors.As(
+		err,
+		&ne,
+	) || !ne.Timeout() || n == 0 || n == int64(len(data)) {
+		t.Fatalf(
+			"ReadFrom: %v bytes, %v; want a timeout",
+			n,
+			err,
+		)
+	}
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	got := make(
+		[]byte,
+		n,
+	)
+	if m, err := io.ReadFull(
+		s,
+		got,
+	); err != nil {
+		t.Fatalf(
+			"%v of %v bytes written received: %v",
+			m,
+			n,
+			err,
+		)
+	}
+	if !bytes.Equal(
+		got,
+		data[:n],
+	) {
+		t.Fatal(
+			"data corrupted",
+		)
+	}
+	if err := cli.Close(); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s.SetReadDeadline(
+		time.Now().Add(
+			100 * time.Millisecond,
+		),
+	)
+	if m, err := s.Read(
+		got,
+	); err == nil {
+		t.Fatalf(
+			"%v bytes received beyond those written",
+			m,
+		)
+	}
+}
+
+// zeroReader reads zeros without end.
+type zeroReader struct{}
+
+func (
+	zeroReader,
+) Read(
+	b []byte,
+) (
+	int,
+	error,
+) {
+	return len(b), nil
+}
+
+// countWriter discards writes until it has n bytes, then fails.
+type countWriter struct {
+	n int64
+}
+
+func (
+	w *countWriter,
+) Write(
+	b []byte,
+) (
+	int,
+	error,
+) {
+	w.n -= int64(
+		len(b),
+	)
+	if w.n <= 0 {
+		return len(b), errLimit
+	}
+	return len(b), nil
+}
+
+// BenchmarkCopy proxies a stream through a pair of sessions with
+// io.Copy on both ends, with and without ReadFrom and WriteTo.
+func BenchmarkCopy(
+	b *testing.B,
+) {
+	const chunk = 32 * 1024
+	for _, bc := range []struct {
+		name string
+		dst  func(*gfcp.UDPSession) io.Writer
+		src  func(*gfcp.UDPSession) io.Reader
+	}{
+		{
+			"io.Copy",
+			func(
+				s *gfcp.UDPSession,
+			) io.Writer {
+				return struct{ io.Writer }{
+					s,
+				}
+			},
+			func(
+				s *gfcp.UDPSession,
+			) io.Reader {
+				return struct{ io.Reader }{
+					s,
+				}
+			},
+		},
+		{
+			"ReadFrom+WriteTo",
+			func(
+				s *gfcp.UDPSession,
+			) io.Writer {
+				return s
+			},
+			func(
+				s *gfcp.UDPSession,
+			) io.Reader {
+				return s
+			},
+		},
+	} {
+		b.Run(
+			bc.name,
+			func(
+				b *testing.B,
+			) {
+				network := gfcp.NewMemNetwork()
+				l, err := network.Listen(
+					"server",
+					0,
+					0,
+				)
+				if err != nil {
+					b.Fatal(
+						err,
+					)
+				}
+				defer l.Close()
+				cli, err := network.Dial(
+					"server",
+					0,
+					0,
+				)
+				if err != nil {
+					b.Fatal(
+						err,
+					)
+				}
+				defer cli.Close()
+				total := int64(
+					b.N,
+				) * chunk
+				go io.Copy(
+					bc.dst(
+						cli,
+					),
+					io.LimitReader(
+						zeroReader{},
+						total,
+					),
+				)
+				s, err := l.AcceptGFCP()
+				if err != nil {
+					b.Fatal(
+						err,
+					)
+				}
+				defer s.Close()
+				for _, sess := range []*gfcp.UDPSession{
+					cli,
+					s,
+				} {
+					sess.SetNoDelay(
+						1,
+						10,
+						2,
+						1,
+					)
+					sess.SetWindowSize(
+						1024,
+						1024,
+					)
+				}
+				s.SetReadDeadline(
+					time.Now().Add(
+						time.Minute,
+					),
+				)
+				b.ReportAllocs()
+				b.SetBytes(
+					chunk,
+				)
+				b.ResetTimer()
+				if _, err := io.Copy(
+					&countWriter{
+						n: total,
+					},
+					bc.src(
+						s,
+					),
+				); err != errLimit {
+					b.Fatal(
+						err,
+					)
+				}
+			},
+		)
+	}
+}
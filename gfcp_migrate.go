@@ -0,0 +1,550 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Path validation control packets. They share the layout of a GFCP
+// segment header, so they pass the same size checks, and are never
+// handed to GFCP.Input. With FEC, they carry an FEC header of type
+// KTypeControl, and never enter a FEC group.
+//
+// A Listener always lets its sessions migrate. The session key is sent
+// in clear by GfcpCmdPathKey packets, so path validation only protects
+// against off-path hijacking: anyone who sees the session's traffic can
+// move it to an address of their own.
+const (
+	GfcpCmdPathChallenge = 85 // GfcpCmdPathChallenge: Prove you own this address
+	GfcpCmdPathResponse  = 86 // GfcpCmdPathResponse: Echo of a challenge token
+	GfcpCmdPathKey       = 88 // GfcpCmdPathKey: Session key proving path responses
+
+	// KTypeControl ...
+	KTypeControl = 0xf3
+
+	pathTokenSize = 8
+	pathFlagsOff  = 5 // after conv and cmd
+	pathTokenOff  = 8 // after flags and 2 bytes of padding
+	pathProofOff  = pathTokenOff + pathTokenSize
+
+	// pathChallengeInterval limits how often a new address is challenged
+	pathChallengeInterval = 200 * time.Millisecond
+	// pathChallengeTimeout is how long an unanswered challenge is kept
+	pathChallengeTimeout = 5 * time.Second
+	// pathKeyAttempts bounds how often an accepted session sends its
+	// key without confirmation, twice as long apart each time.
+	pathKeyAttempts = 8
+)
+
+// pathChallenge is an outstanding validation of a new client address.
+type pathChallenge struct {
+	s      *UDPSession
+	token  [pathTokenSize]byte
+	sent   time.Time
+	failed bool // answered without the key of s: a new client
+}
+
+// newPathControl builds a path validation packet. The token of path
+// responses is followed by its proof.
+func newPathControl(
+	fec bool,
+	cmd,
+	flags byte,
+	conv uint32,
+	token []byte,
+) []byte {
+	off := 0
+	if fec {
+		off = fecHeaderSizePlus2
+	}
+	size := GfcpOverhead
+	if fec {
+		// long enough for sessions with version 1 FEC headers
+		size += fecHeaderSizeV1Plus2
+	}
+	pkt := make(
+		[]byte,
+		size,
+	)
+	if fec {
+		binary.LittleEndian.PutUint16(
+			pkt[4:],
+			KTypeControl,
+		)
+	}
+	binary.LittleEndian.PutUint32(
+		pkt[off:],
+		conv,
+	)
+	pkt[off+4] = cmd
+	pkt[off+pathFlagsOff] = flags
+	copy(
+		pkt[off+pathTokenOff:],
+		token,
+	)
+	return pkt
+}
+
+// parsePathControl returns the command, flags, conversation, token
+// and proof of a control packet, with or without FEC framing, or
+// ok == false for anything else.
+func parsePathControl(
+	data []byte,
+) (
+	cmd,
+	flags byte,
+	conv uint32,
+	token,
+	proof []byte,
+	ok bool,
+) {
+	if len(
+		data,
+	) < GfcpOverhead {
+		return 0, 0, 0, nil, nil, false
+	}
+	off := 0
+	if binary.LittleEndian.Uint16(
+		data[4:],
+	) == KTypeControl {
+		off = fecHeaderSizePlus2
+	}
+	if len(
+		data,
+	) < off+GfcpOverhead {
+		return 0, 0, 0, nil, nil, false
+	}
+	cmd = data[off+4]
+	if cmd != GfcpCmdPathChallenge && cmd != GfcpCmdPathResponse &&
+		cmd != GfcpCmdFECReject && cmd != GfcpCmdPathKey {
+		return 0, 0, 0, nil, nil, false
+	}
+	return cmd, data[off+pathFlagsOff], binary.LittleEndian.Uint32(
+			data[off:],
+		), data[off+pathTokenOff : off+pathTokenOff+pathTokenSize],
+		data[off+pathProofOff : off+pathProofOff+pathTokenSize],
+		true
+}
+
+// pathProof returns the proof of a path response to token by a holder
+// of key.
+func pathProof(
+	key,
+	token []byte,
+) []byte {
+	mac := hmac.New(
+		sha256.New,
+		key,
+	)
+	mac.Write(
+		token,
+	)
+	return mac.Sum(
+		nil,
+	)[:pathTokenSize]
+}
+
+// newPathResponse answers a path challenge of token; clients prove
+// with it that they hold the key of the session. s.mu must be held.
+func (
+	s *UDPSession,
+) newPathResponse(
+	flags byte,
+	token []byte,
+) []byte {
+	body := make(
+		[]byte,
+		2*pathTokenSize,
+	)
+	copy(
+		body,
+		token,
+	)
+	if s.l == nil && s.pathKeyed {
+		copy(
+			body[pathTokenSize:],
+			pathProof(
+				s.pathKey[:],
+				token,
+			),
+		)
+	}
+	return newPathControl(
+		s.FecDecoder != nil,
+		GfcpCmdPathResponse,
+		flags,
+		s.GFcp.conv,
+		body,
+	)
+}
+
+// pathKeyInput takes the session key from the Listener, once, and
+// confirms it, or on an accepted session, takes the confirmation; it
+// returns a packet to send in reply, if any. s.mu must be held.
+func (
+	s *UDPSession,
+) pathKeyInput(
+	key []byte,
+) []byte {
+	if s.l != nil {
+		if hmac.Equal(
+			key,
+			s.pathKey[:],
+		) {
+			s.pathKeyed = true
+		}
+		return nil
+	}
+	if !s.pathKeyed {
+		copy(
+			s.pathKey[:],
+			key,
+		)
+		s.pathKeyed = true
+	}
+	return newPathControl(
+		s.FecDecoder != nil,
+		GfcpCmdPathKey,
+		0,
+		s.GFcp.conv,
+		s.pathKey[:],
+	)
+}
+
+// sendPathKey sends the session key of an accepted session to its
+// client, backing off, until the client confirms it or pathKeyAttempts
+// run out. It returns how long until the next attempt, or 0 if there
+// is none; s.mu must be held.
+func (
+	s *UDPSession,
+) sendPathKey() time.Duration {
+	if s.l == nil || s.pathKeyed || s.pathKeyTries >= pathKeyAttempts {
+		return 0
+	}
+	now := s.now()
+	if s.pathKeyTries > 0 {
+		if wait := pathChallengeInterval<<(s.pathKeyTries-1) - now.Sub(
+			s.pathKeySent,
+		); wait > 0 {
+			return wait
+		}
+	}
+	s.pathKeySent = now
+	s.pathKeyTries++
+	s.queue(
+		newPathControl(
+			s.FecDecoder != nil,
+			GfcpCmdPathKey,
+			0,
+			s.GFcp.conv,
+			s.pathKey[:],
+		),
+	)
+	s.uncork()
+	if s.pathKeyTries >= pathKeyAttempts {
+		return 0
+	}
+	return pathChallengeInterval << (s.pathKeyTries - 1)
+}
+
+// remoteAddr returns the current remote address, which changes when
+// a Listener migrates the session.
+func (
+	s *UDPSession,
+) remoteAddr() net.Addr {
+	return s.remote.Load().(net.Addr)
+}
+
+// pathControlInput answers challenges from the session's peer, and
+// reports whether data was a path validation packet.
+func (
+	s *UDPSession,
+) pathControlInput(
+	data []byte,
+) bool {
+	cmd, flags, conv, token, _, ok := parsePathControl(
+		data,
+	)
+	if !ok {
+		return false
+	}
+	if cmd == GfcpCmdFECReject && conv == s.GFcp.conv {
+		s.fecRejected(
+			flags,
+		)
+	}
+	if cmd == GfcpCmdPathChallenge && conv == s.GFcp.conv {
+		s.mu.Lock()
+		if s.l != nil {
+			s.pathRedundant = flags&pathFlagRedundant != 0
+		}
+		s.queue(
+			s.newPathResponse(
+				0,
+				token,
+			),
+		)
+		s.uncork()
+		s.mu.Unlock()
+	}
+	if cmd == GfcpCmdPathKey && conv == s.GFcp.conv {
+		s.mu.Lock()
+		if reply := s.pathKeyInput(
+			token,
+		); reply != nil {
+			s.queue(
+				reply,
+			)
+			s.uncork()
+		}
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// migrateInput handles a packet from an address no session is bound
+// to; it reports whether the packet belonged to an existing session,
+// which is then either being validated or has just been migrated.
+// Sessions only migrate once their key is confirmed, to a client that
+// proves it holds the key; the packets of any other client with the
+// same conv open a new session.
+func (
+	l *Listener,
+) migrateInput(
+	data []byte,
+	addr net.Addr,
+) bool {
+	key := addr.String()
+	cmd, flags, conv, token, proof, ok := parsePathControl(
+		data,
+	)
+	if ok && cmd == GfcpCmdPathResponse {
+		l.pathResponse(
+			conv,
+			flags,
+			token,
+			proof,
+			addr,
+		)
+		return true
+	}
+	control := ok
+	if ok && cmd == GfcpCmdFECReject {
+		// only clients are rejected
+		return true
+	}
+	if !ok {
+		conv, ok = l.packetConv(
+			data,
+		)
+		if !ok {
+			return false
+		}
+	}
+	now := l.clock().Now()
+	l.sessionLock.Lock()
+	s, ok := l.convs[conv]
+	if !ok {
+		// path probes never open a session
+		l.sessionLock.Unlock()
+		return control
+	}
+	s.mu.Lock()
+	keyed := s.pathKeyed
+	s.mu.Unlock()
+	pc := l.challenges[key]
+	if !keyed || pc != nil && pc.s == s && pc.failed {
+		l.sessionLock.Unlock()
+		return control
+	}
+	if pc == nil || pc.s != s {
+		if len(
+			l.challenges,
+		) >= acceptBacklog && !l.expireChallenges(
+			now,
+		) {
+			l.sessionLock.Unlock()
+			return true
+		}
+		pc = &pathChallenge{
+			s: s,
+		}
+		if _, err := rand.Read(
+			pc.token[:],
+		); err != nil {
+			l.sessionLock.Unlock()
+			return true
+		}
+		l.challenges[key] = pc
+	} else if now.Sub(
+		pc.sent,
+	) < pathChallengeInterval {
+		l.sessionLock.Unlock()
+		return true
+	}
+	pc.sent = now
+	pkt := newPathControl(
+		s.FecDecoder != nil,
+		GfcpCmdPathChallenge,
+		0,
+		conv,
+		pc.token[:],
+	)
+	l.sessionLock.Unlock()
+	if !l.admitReply(
+		addr,
+	) {
+		return true
+	}
+	if _, err := l.conn.WriteTo(
+		pkt,
+		addr,
+	); err == nil {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpPathChallenges,
+			1,
+		)
+	}
+	return true
+}
+
+// pathResponse moves a session to addr, or adds addr as a path of a
+// multipath session, once it has echoed the token challenged there
+// with the proof of its key; a wrong proof lets addr open its own
+// session instead.
+func (
+	l *Listener,
+) pathResponse(
+	conv uint32,
+	flags byte,
+	token,
+	proof []byte,
+	addr net.Addr,
+) {
+	key := addr.String()
+	l.sessionLock.Lock()
+	pc := l.challenges[key]
+	if pc == nil || pc.failed || pc.s.GFcp.conv != conv || !bytes.Equal(
+		pc.token[:],
+		token,
+	) || l.convs[conv] != pc.s {
+		l.sessionLock.Unlock()
+		return
+	}
+	pc.s.mu.Lock()
+	proven := hmac.Equal(
+		proof,
+		pathProof(
+			pc.s.pathKey[:],
+			token,
+		),
+	)
+	pc.s.mu.Unlock()
+	if !proven {
+		pc.failed = true
+		l.sessionLock.Unlock()
+		return
+	}
+	delete(
+		l.challenges,
+		key,
+	)
+	s := pc.s
+	if flags&pathFlagJoin != 0 {
+		l.sessions[key] = s
+		s.addRemotePath(
+			addr,
+		)
+		l.sessionLock.Unlock()
+		return
+	}
+	delete(
+		l.sessions,
+		s.remoteAddr().String(),
+	)
+	l.sessions[key] = s
+	s.setRemote(
+		addr,
+	)
+	l.sessionLock.Unlock()
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpMigrations,
+		1,
+	)
+}
+
+// expireChallenges drops challenges unanswered by now, and reports
+// whether any were dropped; l.sessionLock must be held.
+func (
+	l *Listener,
+) expireChallenges(
+	now time.Time,
+) (
+	expired bool,
+) {
+	for key, pc := range l.challenges {
+		if now.Sub(
+			pc.sent,
+		) > pathChallengeTimeout {
+			delete(
+				l.challenges,
+				key,
+			)
+			expired = true
+		}
+	}
+	return
+}
+
+// packetConv extracts the conversation ID of a GFCP segment, or of an
+// FEC data packet; the framing is told by the type byte, as clients
+// with and without FEC share a Listener.
+func (
+	l *Listener,
+) packetConv(
+	data []byte,
+) (
+	uint32,
+	bool,
+) {
+	if len(
+		data,
+	) < GfcpOverhead {
+		return 0, false
+	}
+	if isGFcpCmd(
+		data[4],
+	) {
+		return binary.LittleEndian.Uint32(
+			data,
+		), true
+	}
+	f := FecPacket(
+		data,
+	)
+	off := f.headerLen() + 2
+	if f.flag() != KTypeData || off == 2 || len(
+		data,
+	) < off+4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(
+		data[off:],
+	), true
+}
@@ -0,0 +1,635 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+type rebindPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// rebindConn emulates a NAT rebinding: rebind() moves writes to a new
+// address, while packets still arriving at the old one are read.
+type rebindConn struct {
+	network *gfcp.MemNetwork
+	mu      sync.Mutex
+	conns   []*gfcp.MemConn
+	in      chan rebindPacket
+	die     chan struct{}
+	once    sync.Once
+}
+
+func newRebindConn(
+	network *gfcp.MemNetwork,
+) *rebindConn {
+	c := &rebindConn{
+		network: network,
+		in: make(
+			chan rebindPacket,
+			1024,
+		),
+		die: make(
+			chan struct{},
+		),
+	}
+	c.rebind()
+	return c
+}
+
+func (
+	c *rebindConn,
+) rebind() net.Addr {
+	conn, err := c.network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		panic(
+			err,
+		)
+	}
+	c.mu.Lock()
+	c.conns = append(
+		c.conns,
+		conn,
+	)
+	c.mu.Unlock()
+	go func() {
+		for {
+			buf := make(
+				[]byte,
+				gfcp.GFcpMtuLimit,
+			)
+			n, from, err := conn.ReadFrom(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			select {
+			case c.in <- rebindPacket{
+				buf[:n],
+				from,
+			}:
+			case <-c.die:
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+func (
+	c *rebindConn,
+) current() *gfcp.MemConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns[len(c.conns)-1]
+}
+
+func (
+	c *rebindConn,
+) ReadFrom(
+	b []byte,
+) (
+	int,
+	net.Addr,
+	error,
+) {
+	select {
+	case p := <-c.in:
+		return copy(
+			b,
+			p.data,
+		), p.from, nil
+	case <-c.die:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (
+	c *rebindConn,
+) WriteTo(
+	b []byte,
+	addr net.Addr,
+) (
+	int,
+	error,
+) {
+	return c.current().WriteTo(
+		b,
+		addr,
+	)
+}
+
+func (
+	c *rebindConn,
+) Close() error {
+	c.once.Do(
+		func() {
+			close(
+				c.die,
+			)
+			c.mu.Lock()
+			for _, conn := range c.conns {
+				conn.Close()
+			}
+			c.mu.Unlock()
+		},
+	)
+	return nil
+}
+
+func (
+	c *rebindConn,
+) ResolveAddr(
+	addr string,
+) (
+	net.Addr,
+	error,
+) {
+	return c.current().ResolveAddr(
+		addr,
+	)
+}
+
+func (
+	c *rebindConn,
+) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (
+	c *rebindConn,
+) SetDeadline(
+	t time.Time,
+) error {
+	return nil
+}
+
+func (
+	c *rebindConn,
+) SetReadDeadline(
+	t time.Time,
+) error {
+	return nil
+}
+
+func (
+	c *rebindConn,
+) SetWriteDeadline(
+	t time.Time,
+) error {
+	return nil
+}
+
+// migrationServer echoes on the sessions l accepts, which it also
+// passes on.
+func migrationServer(
+	l *gfcp.Listener,
+) chan *gfcp.UDPSession {
+	accepted := make(
+		chan *gfcp.UDPSession,
+		2,
+	)
+	go func() {
+		for {
+			s, err := l.AcceptGFCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			go func() {
+				defer s.Close()
+				s.SetDeadline(
+					time.Now().Add(
+						10 * time.Second,
+					),
+				)
+				buf := make(
+					[]byte,
+					1024,
+				)
+				for {
+					n, err := s.Read(
+						buf,
+					)
+					if err != nil {
+						return
+					}
+					s.Write(
+						buf[:n],
+					)
+				}
+			}()
+		}
+	}()
+	return accepted
+}
+
+func TestMigration(
+	t *testing.T,
+) {
+	for _, shards := range [][2]int{
+		{
+			0,
+			0,
+		},
+		{
+			10,
+			3,
+		},
+	} {
+		testMigration(
+			t,
+			shards[0],
+			shards[1],
+		)
+	}
+}
+
+func testMigration(
+	t *testing.T,
+	dataShards,
+	parityShards int,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		dataShards,
+		parityShards,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := migrationServer(
+		l,
+	)
+	conn := newRebindConn(
+		network,
+	)
+	cli, err := gfcp.NewConn(
+		"server",
+		dataShards,
+		parityShards,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	migrations := gfcp.DefaultSnsi.Copy().GFcpMigrations
+	addr := conn.rebind()
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s := <-accepted
+	if s.RemoteAddr().String() != addr.String() {
+		t.Fatal(
+			"session not migrated:",
+			s.RemoteAddr(),
+			addr,
+		)
+	}
+	if gfcp.DefaultSnsi.Copy().GFcpMigrations <= migrations {
+		t.Fatal(
+			"migration not counted",
+		)
+	}
+	select {
+	case s := <-accepted:
+		t.Fatal(
+			"new session accepted after rebinding:",
+			s.RemoteAddr(),
+		)
+	default:
+	}
+}
+
+func TestMigrationConvCollision(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := migrationServer(
+		l,
+	)
+	cli, err := gfcp.NewConn(
+		"server",
+		0,
+		0,
+		newRebindConn(
+			network,
+		),
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s := <-accepted
+	remote := s.RemoteAddr().String()
+	migrations := gfcp.DefaultSnsi.Copy().GFcpMigrations
+	// a new client with the same conv, which cannot prove the key of s
+	raw, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer raw.Close()
+	server, err := raw.ResolveAddr(
+		"server",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	push := make(
+		[]byte,
+		gfcp.GfcpOverhead+5,
+	)
+	binary.LittleEndian.PutUint32(
+		push,
+		cli.GetConv(),
+	)
+	push[4] = gfcp.GfcpCmdPush
+	binary.LittleEndian.PutUint16(
+		push[6:],
+		32,
+	)
+	binary.LittleEndian.PutUint32(
+		push[20:],
+		5,
+	)
+	copy(
+		push[gfcp.GfcpOverhead:],
+		"hello",
+	)
+	buf := make(
+		[]byte,
+		gfcp.GFcpMtuLimit,
+	)
+	deadline := time.Now().Add(
+		5 * time.Second,
+	)
+	var s2 *gfcp.UDPSession
+	for s2 == nil && time.Now().Before(
+		deadline,
+	) {
+		raw.WriteTo(
+			push,
+			server,
+		)
+		raw.SetReadDeadline(
+			time.Now().Add(
+				50 * time.Millisecond,
+			),
+		)
+		if n, _, err := raw.ReadFrom(
+			buf,
+		); err == nil && n >= gfcp.GfcpOverhead &&
+			buf[4] == gfcp.GfcpCmdPathChallenge {
+			// echo the token, without a proof
+			buf[4] = gfcp.GfcpCmdPathResponse
+			raw.WriteTo(
+				buf[:gfcp.GfcpOverhead],
+				server,
+			)
+		}
+		select {
+		case s2 = <-accepted:
+		default:
+		}
+	}
+	if s2 == nil {
+		t.Fatal(
+			"colliding client got no session",
+		)
+	}
+	if s2.RemoteAddr().String() != raw.LocalAddr().String() {
+		t.Fatal(
+			"new session for the wrong client:",
+			s2.RemoteAddr(),
+		)
+	}
+	if s.RemoteAddr().String() != remote {
+		t.Fatal(
+			"session hijacked by a colliding client:",
+			s.RemoteAddr(),
+		)
+	}
+	if gfcp.DefaultSnsi.Copy().GFcpMigrations != migrations {
+		t.Fatal(
+			"colliding client counted as a migration",
+		)
+	}
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+}
+
+// TestPathKeyBackoff checks that an accepted session whose client never
+// confirms its path key stops sending it, and settles to the idle
+// interval.
+func TestPathKeyBackoff(
+	t *testing.T,
+) {
+	const idleInterval = 5 * time.Second
+	clock := &resetClock{
+		gfcptest.NewManualClock(
+			time.Now(),
+		),
+		make(
+			chan time.Duration,
+			64,
+		),
+	}
+	updater := gfcp.NewUpdaterWithClock(
+		1,
+		clock,
+	)
+	defer updater.Close()
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	l.SetUpdater(
+		updater,
+	)
+	peer, err := network.ListenPacket(
+		"peer",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer peer.Close()
+	push := make(
+		[]byte,
+		gfcp.GfcpOverhead+4,
+	)
+	binary.LittleEndian.PutUint32(
+		push,
+		0x11223344,
+	)
+	push[4] = gfcp.GfcpCmdPush
+	binary.LittleEndian.PutUint16(
+		push[6:],
+		gfcp.GfcpWndRcv,
+	)
+	binary.LittleEndian.PutUint32(
+		push[20:],
+		4,
+	)
+	if _, err := peer.WriteTo(
+		push,
+		l.Addr(),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s, err := l.AcceptGFCP()
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	// the key goes out at 0, 200ms, 600ms... and last at 25.4s
+	var d time.Duration
+	for elapsed := time.Duration(0); elapsed < time.Minute; elapsed += d {
+		d = clock.schedule(
+			t,
+		)
+		clock.Advance(
+			d,
+		)
+	}
+	if d != idleInterval {
+		t.Fatalf(
+			"session scheduled in %v, want %v",
+			d,
+			idleInterval,
+		)
+	}
+	keys := 0
+	buf := make(
+		[]byte,
+		gfcp.GFcpMtuLimit,
+	)
+	for {
+		peer.SetReadDeadline(
+			time.Now().Add(
+				100 * time.Millisecond,
+			),
+		)
+		n, _, err := peer.ReadFrom(
+			buf,
+		)
+		if err != nil {
+			break
+		}
+		if n > 4 && buf[4] == gfcp.GfcpCmdPathKey {
+			keys++
+		}
+	}
+	if keys != 8 {
+		t.Fatalf(
+			"path key sent %v times, want 8",
+			keys,
+		)
+	}
+}
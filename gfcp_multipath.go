@@ -0,0 +1,872 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// pathProbeInterval is how often a multipath client probes each path
+	pathProbeInterval = time.Second
+	// pathTimeout is how long a path may stay silent before the
+	// scheduler stops using it, while other paths are alive
+	pathTimeout = 5 * pathProbeInterval
+	// pathInitialRTT is assumed for paths without RTT samples
+	pathInitialRTT = 100 * time.Millisecond
+	// pathFlagJoin marks a path response that adds a path to the
+	// session, instead of migrating the session onto it
+	pathFlagJoin = 1
+	// pathFlagRedundant marks path control packets from a client that
+	// sends every datagram over all paths, asking the server to do the same
+	pathFlagRedundant = 2
+)
+
+// PathStats describes one path of a multipath session.
+type PathStats struct {
+	LocalAddr   net.Addr      // local end of the path
+	RemoteAddr  net.Addr      // remote end of the path
+	TxPackets   uint64        // datagrams sent over the path
+	TxBytes     uint64        // bytes sent over the path
+	RxPackets   uint64        // datagrams received over the path
+	RxBytes     uint64        // bytes received over the path
+	Retransmits uint64        // datagrams carrying a retransmission
+	Lost        uint64        // segments and probes presumed lost
+	Won         uint64        // datagrams whose new data arrived here first
+	Duplicates  uint64        // datagrams whose data had already arrived
+	SRTT        time.Duration // smoothed round-trip time
+	Loss        float64       // smoothed loss rate, from 0 to 1
+}
+
+// path is one (conn, remote) pair a multipath session sends over.
+// Everything but conn, which never changes, and remote, which a
+// migration replaces, is protected by the session's mu.
+type path struct {
+	conn       net.PacketConn
+	remote     atomic.Value // net.Addr
+	own        bool         // conn was added by AddPath and is closed with the session
+	srtt       time.Duration
+	loss       float64
+	credit     float64 // smooth weighted round-robin state
+	lastRx     time.Time
+	probeToken [pathTokenSize]byte
+	probeSent  time.Time // zero once the last probe was answered
+	nextProbe  time.Time
+	stats      PathStats
+}
+
+// remoteAddr returns the remote end of p.
+func (
+	p *path,
+) remoteAddr() net.Addr {
+	return p.remote.Load().(net.Addr)
+}
+
+// pathSend records the path and GFCP timestamp of the most recent
+// transmission of a segment.
+type pathSend struct {
+	path *path
+	ts   uint32
+}
+
+// sessionPaths returns the paths of a multipath session, or nil.
+func (
+	s *UDPSession,
+) sessionPaths() []*path {
+	paths, _ := s.paths.Load().([]*path)
+	return paths
+}
+
+// initPaths turns the session into a multipath session over its
+// current conn and remote address; s.mu must be held.
+func (
+	s *UDPSession,
+) initPaths() []*path {
+	if paths := s.sessionPaths(); paths != nil {
+		return paths
+	}
+	s.pathSent = make(
+		map[uint32]pathSend,
+	)
+	s.pathSeen = make(
+		map[uint32]struct{},
+	)
+	return []*path{
+		s.newPath(
+			s.conn,
+			s.remoteAddr(),
+		),
+	}
+}
+
+func (
+	s *UDPSession,
+) newPath(
+	conn net.PacketConn,
+	remote net.Addr,
+) *path {
+	p := &path{
+		conn:   conn,
+		srtt:   pathInitialRTT,
+		lastRx: s.now(),
+	}
+	p.remote.Store(
+		remote,
+	)
+	p.stats.LocalAddr = conn.LocalAddr()
+	p.stats.RemoteAddr = remote
+	return p
+}
+
+// AddPath adds a path over conn to the remote address raddr, making
+// the session a multipath session. Segments are then spread across all
+// paths, weighted by each path's RTT and loss, and retransmissions
+// prefer a path other than the one the segment was lost on. The
+// session owns conn, which must not be shared with any other path.
+// Only sessions created with NewConn or Dial may add paths; a Listener
+// adds the client's paths to the accepted session once it has
+// validated them.
+func (
+	s *UDPSession,
+) AddPath(
+	conn net.PacketConn,
+	raddr string,
+) error {
+	if s.l != nil {
+		return errors.New(
+			errInvalidOperation,
+		)
+	}
+	remote, err := resolveAddr(
+		conn,
+		raddr,
+	)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
+		return errors.New(
+			errBrokenPipe,
+		)
+	}
+	paths := s.initPaths()
+	for _, p := range paths {
+		if p.conn == conn {
+			s.mu.Unlock()
+			return errors.New(
+				errInvalidOperation,
+			)
+		}
+	}
+	p := s.newPath(
+		conn,
+		remote,
+	)
+	p.own = true
+	paths = append(
+		paths[:len(paths):len(paths)],
+		p,
+	)
+	s.paths.Store(
+		paths,
+	)
+	s.probePaths(
+		paths,
+	)
+	s.mu.Unlock()
+	go s.pathReadLoop(
+		p,
+	)
+	return nil
+}
+
+// addRemotePath adds a validated client address as a path of an
+// accepted session.
+func (
+	s *UDPSession,
+) addRemotePath(
+	remote net.Addr,
+) {
+	s.mu.Lock()
+	paths := s.initPaths()
+	for _, p := range paths {
+		if p.remoteAddr().String() == remote.String() {
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.paths.Store(
+		append(
+			paths[:len(paths):len(paths)],
+			s.newPath(
+				s.conn,
+				remote,
+			),
+		),
+	)
+	s.mu.Unlock()
+}
+
+// setRemote moves the session to a new remote address.
+func (
+	s *UDPSession,
+) setRemote(
+	remote net.Addr,
+) {
+	s.mu.Lock()
+	s.remote.Store(
+		remote,
+	)
+	if paths := s.sessionPaths(); paths != nil {
+		paths[0].remote.Store(
+			remote,
+		)
+		paths[0].stats.RemoteAddr = remote
+	}
+	s.mu.Unlock()
+}
+
+// pathRemotes returns the remote addresses of all paths.
+func (
+	s *UDPSession,
+) pathRemotes() []net.Addr {
+	paths := s.sessionPaths()
+	if paths == nil {
+		return []net.Addr{
+			s.remoteAddr(),
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remotes := make(
+		[]net.Addr,
+		0,
+		len(paths),
+	)
+	for _, p := range paths {
+		remotes = append(
+			remotes,
+			p.remoteAddr(),
+		)
+	}
+	return remotes
+}
+
+// PathStats returns statistics for each path of a multipath session,
+// or nil for a single-path session.
+func (
+	s *UDPSession,
+) PathStats() []PathStats {
+	paths := s.sessionPaths()
+	if paths == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(
+		[]PathStats,
+		len(paths),
+	)
+	for k, p := range paths {
+		stats[k] = p.stats
+		stats[k].SRTT = p.srtt
+		stats[k].Loss = p.loss
+	}
+	return stats
+}
+
+// SetPathRedundant makes a multipath client send every datagram over
+// all live paths, instead of spreading datagrams across them, trading
+// bandwidth for tail latency. Receivers drop the duplicates by segment
+// number and FEC sequence, and the server side of the session follows
+// the client's setting within one probe interval.
+func (
+	s *UDPSession,
+) SetPathRedundant(
+	redundant bool,
+) {
+	s.mu.Lock()
+	changed := s.pathRedundant != redundant
+	s.pathRedundant = redundant
+	if changed && s.l == nil {
+		// tell the server at once
+		for _, p := range s.sessionPaths() {
+			s.probePath(
+				p,
+			)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// pathFlags returns the flags of path control packets sent by the
+// session; s.mu must be held.
+func (
+	s *UDPSession,
+) pathFlags() (
+	flags byte,
+) {
+	if s.l == nil {
+		flags = pathFlagJoin
+		if s.pathRedundant {
+			flags |= pathFlagRedundant
+		}
+	}
+	return
+}
+
+// pathReadLoop reads packets from a path added by AddPath.
+func (
+	s *UDPSession,
+) pathReadLoop(
+	p *path,
+) {
+	buf := xmitBuf.Get(
+		GFcpMtuLimit,
+	)
+	defer xmitBuf.Put(
+		buf,
+	)
+	src := p.remoteAddr().String()
+	for {
+		n, addr, err := p.conn.ReadFrom(
+			buf,
+		)
+		if err != nil {
+			return
+		}
+		if addr.String() != src || n < s.headerSize+GfcpOverhead {
+			atomic.AddUint64(
+				&DefaultSnsi.GFcpInputErrors,
+				1,
+			)
+			continue
+		}
+		s.pathInput(
+			p,
+			buf[:n],
+		)
+	}
+}
+
+// inputFrom passes a packet a Listener received from addr to the
+// session, on the path with that remote address.
+func (
+	s *UDPSession,
+) inputFrom(
+	data []byte,
+	addr net.Addr,
+) {
+	if paths := s.sessionPaths(); paths != nil {
+		key := addr.String()
+		for _, p := range paths {
+			if p.remoteAddr().String() == key {
+				s.pathInput(
+					p,
+					data,
+				)
+				return
+			}
+		}
+	}
+	s.packetInput(
+		data,
+	)
+}
+
+// pathInput accounts an incoming packet to p, answers path probes and
+// attributes acknowledgements to the path that carried the segment,
+// before handing the packet to GFCP.
+func (
+	s *UDPSession,
+) pathInput(
+	p *path,
+	data []byte,
+) {
+	s.mu.Lock()
+	p.stats.RxPackets++
+	p.stats.RxBytes += uint64(
+		len(data),
+	)
+	p.lastRx = s.now()
+	if cmd, flags, conv, token, _, ok := parsePathControl(
+		data,
+	); ok {
+		if conv == s.GFcp.conv {
+			switch cmd {
+			case GfcpCmdPathChallenge:
+				if s.l != nil {
+					s.pathRedundant = flags&pathFlagRedundant != 0
+				}
+				s.pathWrite(
+					p,
+					s.newPathResponse(
+						s.pathFlags(),
+						token,
+					),
+				)
+			case GfcpCmdPathKey:
+				if reply := s.pathKeyInput(
+					token,
+				); reply != nil {
+					s.pathWrite(
+						p,
+						reply,
+					)
+				}
+			case GfcpCmdPathResponse:
+				if !p.probeSent.IsZero() && string(
+					token,
+				) == string(
+					p.probeToken[:],
+				) {
+					p.sample(
+						s.now().Sub(
+							p.probeSent,
+						),
+					)
+					p.probeSent = time.Time{}
+				}
+			case GfcpCmdFECReject:
+				defer s.fecRejected(
+					flags,
+				)
+			}
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.pathAcks(
+		data,
+	)
+	s.pathWins(
+		p,
+		data,
+	)
+	s.mu.Unlock()
+	s.GFcpInput(
+		data,
+	)
+}
+
+// sample folds an RTT sample and a delivery into the path estimates.
+func (
+	p *path,
+) sample(
+	rtt time.Duration,
+) {
+	p.srtt += (rtt - p.srtt) / 8
+	p.loss -= p.loss / 8
+}
+
+// lost folds a presumed loss into the path estimates.
+func (
+	p *path,
+) lost() {
+	p.stats.Lost++
+	p.loss += (1 - p.loss) / 8
+}
+
+// gfcpSegments calls fn for each GFCP segment header in a datagram,
+// skipping FEC parity; it stops early if fn returns false.
+func gfcpSegments(
+	fec bool,
+	data []byte,
+	fn func(
+		cmd byte,
+		ts,
+		sn uint32,
+	) bool,
+) {
+	if fec {
+		if len(
+			data,
+		) < fecHeaderSizePlus2 {
+			return
+		}
+		f := FecPacket(
+			data,
+		)
+		off := f.headerLen() + 2
+		if f.flag() != KTypeData || off == 2 || len(
+			data,
+		) < off {
+			return
+		}
+		data = data[off:]
+	}
+	for len(
+		data,
+	) >= GfcpOverhead {
+		length := binary.LittleEndian.Uint32(
+			data[20:],
+		)
+		if !fn(
+			data[4],
+			binary.LittleEndian.Uint32(
+				data[8:],
+			),
+			binary.LittleEndian.Uint32(
+				data[12:],
+			),
+		) || uint32(len(data)-GfcpOverhead) < length {
+			return
+		}
+		data = data[GfcpOverhead+int(length):]
+	}
+}
+
+// pathAcks takes RTT samples from acknowledgements of segments whose
+// last transmission is recorded; s.mu must be held.
+func (
+	s *UDPSession,
+) pathAcks(
+	data []byte,
+) {
+	current := s.GFcp.currentMs()
+	gfcpSegments(
+		s.FecDecoder != nil,
+		data,
+		func(
+			cmd byte,
+			ts,
+			sn uint32,
+		) bool {
+			if cmd != GfcpCmdAck {
+				return true
+			}
+			if sent, ok := s.pathSent[sn]; ok {
+				if sent.ts == ts {
+					sent.path.sample(
+						time.Duration(
+							_itimediff(
+								current,
+								ts,
+							),
+						) * time.Millisecond,
+					)
+				}
+				delete(
+					s.pathSent,
+					sn,
+				)
+			}
+			return true
+		},
+	)
+}
+
+// pathWins credits p with a win if the datagram carries data that has
+// not arrived over any path yet, and with a duplicate if it carries only
+// data that has; s.mu must be held.
+func (
+	s *UDPSession,
+) pathWins(
+	p *path,
+	data []byte,
+) {
+	pushes := 0
+	fresh := 0
+	gfcpSegments(
+		s.FecDecoder != nil,
+		data,
+		func(
+			cmd byte,
+			ts,
+			sn uint32,
+		) bool {
+			if cmd != GfcpCmdPush {
+				return true
+			}
+			pushes++
+			if _itimediff(
+				sn,
+				s.GFcp.rcvNxt,
+			) < 0 {
+				return true
+			}
+			if _, ok := s.pathSeen[sn]; !ok {
+				s.pathSeen[sn] = struct{}{}
+				fresh++
+			}
+			return true
+		},
+	)
+	if fresh > 0 {
+		p.stats.Won++
+	} else if pushes > 0 {
+		p.stats.Duplicates++
+	}
+	if len(
+		s.pathSeen,
+	) > 2*int(s.GFcp.rcvWnd)+64 {
+		for sn := range s.pathSeen {
+			if _itimediff(
+				sn,
+				s.GFcp.rcvNxt,
+			) < 0 {
+				delete(
+					s.pathSeen,
+					sn,
+				)
+			}
+		}
+	}
+}
+
+// pathOutput sends a datagram over the best path, recording which
+// segments it carries, and moving retransmissions off the path they
+// were lost on; s.mu must be held.
+func (
+	s *UDPSession,
+) pathOutput(
+	paths []*path,
+	buf []byte,
+) {
+	if s.pathRedundant {
+		s.pathBroadcast(
+			paths,
+			buf,
+		)
+		return
+	}
+	fec := s.FecDecoder != nil
+	var avoid *path
+	gfcpSegments(
+		fec,
+		buf,
+		func(
+			cmd byte,
+			ts,
+			sn uint32,
+		) bool {
+			if sent, ok := s.pathSent[sn]; ok && cmd == GfcpCmdPush {
+				sent.path.lost()
+				avoid = sent.path
+			}
+			return true
+		},
+	)
+	p := pickPath(
+		paths,
+		avoid,
+		s.now(),
+	)
+	if avoid != nil {
+		p.stats.Retransmits++
+	}
+	gfcpSegments(
+		fec,
+		buf,
+		func(
+			cmd byte,
+			ts,
+			sn uint32,
+		) bool {
+			if cmd == GfcpCmdPush {
+				s.pathSent[sn] = pathSend{
+					path: p,
+					ts:   ts,
+				}
+			}
+			return true
+		},
+	)
+	if len(
+		s.pathSent,
+	) > 2*s.GFcp.sndBuf.size()+64 {
+		for sn := range s.pathSent {
+			if _itimediff(
+				sn,
+				s.GFcp.sndUna,
+			) < 0 {
+				delete(
+					s.pathSent,
+					sn,
+				)
+			}
+		}
+	}
+	s.pathWrite(
+		p,
+		buf,
+	)
+}
+
+// pathBroadcast sends a datagram over every live path, or over all
+// paths if none is alive; s.mu must be held.
+func (
+	s *UDPSession,
+) pathBroadcast(
+	paths []*path,
+	buf []byte,
+) {
+	now := s.now()
+	alive := 0
+	for _, p := range paths {
+		if now.Sub(
+			p.lastRx,
+		) < pathTimeout {
+			alive++
+		}
+	}
+	for _, p := range paths {
+		if alive == 0 || now.Sub(
+			p.lastRx,
+		) < pathTimeout {
+			s.pathWrite(
+				p,
+				buf,
+			)
+		}
+	}
+}
+
+// pickPath chooses a path by smooth weighted round-robin, weighting
+// each path by its delivery rate over its RTT. Paths that have been
+// silent for pathTimeout are skipped while any other path is alive,
+// and avoid is skipped if there is another choice.
+func pickPath(
+	paths []*path,
+	avoid *path,
+	now time.Time,
+) *path {
+	alive := 0
+	for _, p := range paths {
+		if p != avoid && now.Sub(
+			p.lastRx,
+		) < pathTimeout {
+			alive++
+		}
+	}
+	var best *path
+	total := 0.0
+	for _, p := range paths {
+		if p == avoid || (alive > 0 && now.Sub(
+			p.lastRx,
+		) >= pathTimeout) {
+			continue
+		}
+		srtt := p.srtt
+		if srtt < time.Millisecond {
+			srtt = time.Millisecond
+		}
+		w := (1 - p.loss) * (1 - p.loss) / srtt.Seconds()
+		p.credit += w
+		total += w
+		if best == nil || p.credit > best.credit {
+			best = p
+		}
+	}
+	if best == nil {
+		if avoid != nil {
+			return avoid
+		}
+		return paths[0]
+	}
+	best.credit -= total
+	return best
+}
+
+// pathWrite sends a datagram over p; s.mu must be held. Write errors
+// only fail the session on its original path.
+func (
+	s *UDPSession,
+) pathWrite(
+	p *path,
+	buf []byte,
+) {
+	n, err := p.conn.WriteTo(
+		buf,
+		p.remoteAddr(),
+	)
+	if err != nil {
+		if !p.own {
+			s.notifyWriteError(
+				err,
+			)
+		}
+		return
+	}
+	p.stats.TxPackets++
+	p.stats.TxBytes += uint64(
+		n,
+	)
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpOutputPackets,
+		1,
+	)
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpOutputBytes,
+		uint64(
+			n,
+		),
+	)
+}
+
+// probePaths probes every path of a multipath client that is due;
+// s.mu must be held.
+func (
+	s *UDPSession,
+) probePaths(
+	paths []*path,
+) {
+	now := s.now()
+	for _, p := range paths {
+		if !now.Before(
+			p.nextProbe,
+		) {
+			s.probePath(
+				p,
+			)
+		}
+	}
+}
+
+// probePath sends a path challenge, whose response measures the RTT
+// of p, and which makes a Listener validate a newly added path; an
+// unanswered previous probe counts as a loss. s.mu must be held.
+func (
+	s *UDPSession,
+) probePath(
+	p *path,
+) {
+	if !p.probeSent.IsZero() {
+		p.lost()
+	}
+	if _, err := rand.Read(
+		p.probeToken[:],
+	); err != nil {
+		return
+	}
+	p.probeSent = s.now()
+	p.nextProbe = p.probeSent.Add(
+		pathProbeInterval,
+	)
+	s.pathWrite(
+		p,
+		newPathControl(
+			s.FecDecoder != nil,
+			GfcpCmdPathChallenge,
+			s.pathFlags(),
+			s.GFcp.conv,
+			p.probeToken[:],
+		),
+	)
+}
@@ -0,0 +1,277 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+// lossyMemConn drops a fraction of the packets written to it.
+type lossyMemConn struct {
+	*gfcp.MemConn
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+}
+
+func (
+	c *lossyMemConn,
+) WriteTo(
+	b []byte,
+	addr net.Addr,
+) (
+	int,
+	error,
+) {
+	c.mu.Lock()
+	drop := c.rnd.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(
+			b,
+		), nil
+	}
+	return c.MemConn.WriteTo(
+		b,
+		addr,
+	)
+}
+
+// multipathEcho echoes data over a multipath session with a lossless
+// path and a lossy one, and returns the path stats of both ends.
+func multipathEcho(
+	t *testing.T,
+	redundant bool,
+) (
+	client,
+	server []gfcp.PathStats,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := make(
+		chan *gfcp.UDPSession,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		defer s.Close()
+		s.SetNoDelay(
+			1,
+			10,
+			2,
+			1,
+		)
+		s.SetDeadline(
+			time.Now().Add(
+				10 * time.Second,
+			),
+		)
+		buf := make(
+			[]byte,
+			1024,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	deadline := time.Now().Add(
+		10 * time.Second,
+	)
+	cli.SetDeadline(
+		deadline,
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		1,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if cli.PathStats() != nil {
+		t.Fatal(
+			"single-path session has path stats",
+		)
+	}
+	second, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli.SetPathRedundant(
+		redundant,
+	)
+	if err := cli.AddPath(
+		&lossyMemConn{
+			MemConn: second,
+			rnd: rand.New(
+				rand.NewSource(
+					1,
+				),
+			),
+			loss: 0.3,
+		},
+		"server",
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s := <-accepted
+	for len(
+		s.PathStats(),
+	) < 2 {
+		// wait for the server to validate the new path
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatal(
+				"path not joined",
+			)
+		}
+		time.Sleep(
+			10 * time.Millisecond,
+		)
+	}
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		256,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	return cli.PathStats(), s.PathStats()
+}
+
+func TestMultipath(
+	t *testing.T,
+) {
+	stats, server := multipathEcho(
+		t,
+		false,
+	)
+	if len(
+		stats,
+	) != 2 || len(
+		server,
+	) != 2 {
+		t.Fatal(
+			stats,
+			server,
+		)
+	}
+	for k := range stats {
+		if stats[k].TxPackets == 0 || stats[k].RxPackets == 0 {
+			t.Fatalf(
+				"path %v unused: %+v",
+				k,
+				stats[k],
+			)
+		}
+	}
+	if stats[1].Lost == 0 || stats[1].Loss <= stats[0].Loss ||
+		stats[1].TxPackets >= stats[0].TxPackets {
+		t.Fatalf(
+			"lossy path not penalized: %+v",
+			stats,
+		)
+	}
+}
+
+func TestMultipathRedundant(
+	t *testing.T,
+) {
+	stats, server := multipathEcho(
+		t,
+		true,
+	)
+	if len(
+		stats,
+	) != 2 || len(
+		server,
+	) != 2 {
+		t.Fatal(
+			stats,
+			server,
+		)
+	}
+	for _, end := range [][]gfcp.PathStats{
+		stats,
+		server,
+	} {
+		if end[0].TxPackets+8 < end[1].TxPackets ||
+			end[0].TxPackets > end[1].TxPackets+8 {
+			t.Fatalf(
+				"datagrams not duplicated: %+v",
+				end,
+			)
+		}
+	}
+	// the client may stop reading before the slower copies arrive
+	if server[0].Won+server[1].Won == 0 ||
+		server[0].Duplicates+server[1].Duplicates == 0 {
+		t.Fatalf(
+			"no duplicate delivery: %+v",
+			server,
+		)
+	}
+}
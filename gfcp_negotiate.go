@@ -0,0 +1,219 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// A Listener tells clients whose FEC settings it will not serve with a
+// control packet, framed as the packet it refuses. Its flags carry the
+// reason, its conversation that of the client when the Listener could
+// read it, and its token the first bytes of the refused packet.
+const (
+	GfcpCmdFECReject = 87 // GfcpCmdFECReject: FEC settings refused
+
+	FECRejectLayout  = 1 // FECRejectLayout: Version 0 FEC, but no layout to assume
+	FECRejectVersion = 2 // FECRejectVersion: Unknown FEC header version
+	FECRejectInvalid = 3 // FECRejectInvalid: Invalid shard layout or codec
+	FECRejectPolicy  = 4 // FECRejectPolicy: Refused by the Listener's FEC policy
+)
+
+// FECRejectedError is returned by Read and Write of a session whose
+// FEC settings the Listener refused.
+type FECRejectedError struct {
+	Reason byte
+}
+
+func (
+	e *FECRejectedError,
+) Error() string {
+	switch e.Reason {
+	case FECRejectLayout:
+		return "FEC rejected by peer: version 0 layout unknown"
+	case FECRejectVersion:
+		return "FEC rejected by peer: unsupported version"
+	case FECRejectInvalid:
+		return "FEC rejected by peer: invalid layout"
+	case FECRejectPolicy:
+		return "FEC rejected by peer: refused by policy"
+	}
+	return "FEC rejected by peer"
+}
+
+// isGFcpCmd reports whether cmd starts a GFCP segment, as opposed to
+// an FEC type, which tells a packet sent without FEC.
+func isGFcpCmd(
+	cmd byte,
+) bool {
+	return cmd >= GfcpCmdPush && cmd <= GfcpCmdWins
+}
+
+// SetFECPolicy makes the Listener consult policy before accepting a
+// client: with the FEC layout it advertises, or nil for a client
+// without FEC. Clients it returns an error for are rejected.
+func (
+	l *Listener,
+) SetFECPolicy(
+	policy func(
+		cfg *FECConfig,
+	) error,
+) {
+	l.fecPolicy.Store(
+		policy,
+	)
+}
+
+// negotiateFEC returns the FEC settings of a session opened by data.
+// A GFCP segment opens a session without FEC, version 0 FEC gets the
+// Listener's shards, and version 1 FEC the layout and codec of its
+// first packet, interleaved as the Listener, and adaptive if both the
+// Listener and codec are. It returns a reject reason for settings it
+// can not serve; anything else does not open a session.
+func (
+	l *Listener,
+) negotiateFEC(
+	data []byte,
+) (
+	dataShards,
+	parityShards int,
+	fec *FECConfig,
+	reject byte,
+) {
+	var cfg *FECConfig
+	f := FecPacket(
+		data,
+	)
+	switch {
+	case isGFcpCmd(
+		data[4],
+	):
+	case f.flag() != KTypeData:
+		return 0, 0, nil, 0
+	case f.version() == fecVersion0:
+		if l.FecDecoder == nil {
+			return 0, 0, nil, FECRejectLayout
+		}
+		dataShards, parityShards = l.dataShards, l.parityShards
+		cfg = &FECConfig{
+			DataShards:   dataShards,
+			ParityShards: parityShards,
+		}
+	case f.version() == fecVersion1:
+		if f.headerLen() == 0 {
+			return 0, 0, nil, 0
+		}
+		ds, ps, codec := f.layout()
+		cfg = &FECConfig{
+			DataShards:   ds,
+			ParityShards: ps,
+			Codec:        codec,
+		}
+		if l.fec != nil {
+			cfg.Interleave = l.fec.Interleave
+		}
+		if l.fec != nil && l.fec.Adaptive && codec == FECCodecReedSolomon {
+			cfg.Adaptive = true
+			cfg.MinParityShards = l.fec.MinParityShards
+			cfg.MaxParityShards = l.fec.MaxParityShards
+		}
+		c, err := cfg.validate()
+		if err != nil {
+			return 0, 0, nil, FECRejectInvalid
+		}
+		cfg, fec = &c, &c
+		dataShards, parityShards = c.DataShards, c.ParityShards
+	default:
+		return 0, 0, nil, FECRejectVersion
+	}
+	if policy, ok := l.fecPolicy.Load().(func(
+		*FECConfig,
+	) error); ok && policy != nil && policy(
+		cfg,
+	) != nil {
+		return 0, 0, nil, FECRejectPolicy
+	}
+	return dataShards, parityShards, fec, 0
+}
+
+// rejectFEC answers a client whose FEC settings are refused, within
+// the rate limits of its source. The answer is just long enough for the
+// client's headers, at most 12 bytes more than the smallest packet
+// carrying a conv.
+func (
+	l *Listener,
+) rejectFEC(
+	data []byte,
+	conv uint32,
+	reason byte,
+	addr net.Addr,
+) {
+	if !l.admitReply(
+		addr,
+	) {
+		return
+	}
+	fec := !isGFcpCmd(
+		data[4],
+	)
+	pkt := newPathControl(
+		fec,
+		GfcpCmdFECReject,
+		reason,
+		conv,
+		data[:pathTokenSize],
+	)
+	// as long as the client's own headers, so it is not dropped as short
+	size := GfcpOverhead
+	if fec {
+		size += fecHeaderSizePlus2
+		if FecPacket(
+			data,
+		).headerLen() == fecHeaderSizeV1 {
+			size += fecHeaderSizeV1 - fecHeaderSize
+		}
+	}
+	if _, err := l.conn.WriteTo(
+		pkt[:size],
+		addr,
+	); err == nil {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpFECRejects,
+			1,
+		)
+	}
+}
+
+// fecRejected fails Read and Write of a client session whose FEC
+// settings the Listener refused. Rejects are only believed until the
+// Listener is heard from, as they carry nothing but the conv.
+func (
+	s *UDPSession,
+) fecRejected(
+	reason byte,
+) {
+	if s.l != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heard {
+		return
+	}
+	if s.rejected == nil {
+		s.rejected = &FECRejectedError{
+			Reason: reason,
+		}
+	}
+	s.notifyReadEvent()
+	s.notifyWriteEvent()
+}
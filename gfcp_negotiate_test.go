@@ -0,0 +1,427 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+// negotiateServer echoes on every session the Listener accepts.
+func negotiateServer(
+	l *gfcp.Listener,
+) {
+	for {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			s.SetDeadline(
+				time.Now().Add(
+					10 * time.Second,
+				),
+			)
+			buf := make(
+				[]byte,
+				1024,
+			)
+			for {
+				n, err := s.Read(
+					buf,
+				)
+				if err != nil {
+					return
+				}
+				s.Write(
+					buf[:n],
+				)
+			}
+		}()
+	}
+}
+
+func TestFECNegotiation(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	dial := func(
+		raddr string,
+		dataShards,
+		parityShards int,
+		cfg *gfcp.FECConfig,
+	) *gfcp.UDPSession {
+		conn, err := network.ListenPacket(
+			"",
+		)
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		var cli *gfcp.UDPSession
+		if cfg == nil {
+			cli, err = gfcp.NewConn(
+				raddr,
+				dataShards,
+				parityShards,
+				conn,
+			)
+		} else {
+			cli, err = gfcp.NewConnWithFEC(
+				raddr,
+				cfg,
+				conn,
+			)
+		}
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		cli.SetDeadline(
+			time.Now().Add(
+				10 * time.Second,
+			),
+		)
+		return cli
+	}
+	for _, name := range []string{
+		"fec",
+		"plain",
+	} {
+		shards := 0
+		if name == "fec" {
+			shards = 3
+		}
+		conn, err := network.ListenPacket(
+			name,
+		)
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		l, err := gfcp.ServeConn(
+			shards*3,
+			shards,
+			conn,
+		)
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+		defer l.Close()
+		l.SetFECPolicy(
+			func(
+				cfg *gfcp.FECConfig,
+			) error {
+				if cfg != nil && cfg.Codec == gfcp.FECCodec2DXOR {
+					return errors.New(
+						"2D XOR not served",
+					)
+				}
+				return nil
+			},
+		)
+		go negotiateServer(
+			l,
+		)
+	}
+	v1 := func(
+		dataShards,
+		parityShards int,
+		codec byte,
+	) *gfcp.FECConfig {
+		return &gfcp.FECConfig{
+			DataShards:   dataShards,
+			ParityShards: parityShards,
+			Codec:        codec,
+			FlushDelay:   20 * time.Millisecond,
+		}
+	}
+	for _, tc := range []struct {
+		listener     string
+		dataShards   int // version 0 FEC, if fec is nil
+		parityShards int
+		fec          *gfcp.FECConfig
+		reject       byte
+	}{
+		{
+			"fec",
+			0,
+			0,
+			nil,
+			0,
+		},
+		{
+			"fec",
+			9,
+			3,
+			nil,
+			0,
+		},
+		{
+			"fec",
+			0,
+			0,
+			v1(
+				4,
+				1,
+				gfcp.FECCodecXOR,
+			),
+			0,
+		},
+		{
+			"plain",
+			0,
+			0,
+			v1(
+				4,
+				1,
+				gfcp.FECCodecXOR,
+			),
+			0,
+		},
+		{
+			"plain",
+			9,
+			3,
+			nil,
+			gfcp.FECRejectLayout,
+		},
+		{
+			"fec",
+			0,
+			0,
+			v1(
+				4,
+				4,
+				gfcp.FECCodec2DXOR,
+			),
+			gfcp.FECRejectPolicy,
+		},
+	} {
+		cli := dial(
+			tc.listener,
+			tc.dataShards,
+			tc.parityShards,
+			tc.fec,
+		)
+		err := echoTester(
+			cli,
+			1024,
+			16,
+		)
+		cli.Close()
+		var rejected *gfcp.FECRejectedError
+		switch {
+		case tc.reject == 0 && err != nil:
+			t.Fatalf(
+				"%+v: %v",
+				tc,
+				err,
+			)
+		case tc.reject != 0 && !errors.As(
+			err,
+			&rejected,
+		):
+			t.Fatalf(
+				"%+v: not rejected: %v",
+				tc,
+				err,
+			)
+		case tc.reject != 0 && rejected.Reason != tc.reject:
+			t.Fatalf(
+				"%+v: %v",
+				tc,
+				err,
+			)
+		}
+	}
+}
+
+func TestFECRejectShort(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"plain",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	go negotiateServer(
+		l,
+	)
+	raw, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer raw.Close()
+	server, err := raw.ResolveAddr(
+		"plain",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	// the smallest version 0 FEC packet, which the Listener cannot serve
+	pkt := make(
+		[]byte,
+		8+gfcp.GfcpOverhead,
+	)
+	pkt[4] = gfcp.KTypeData
+	binary.LittleEndian.PutUint16(
+		pkt[6:],
+		2+gfcp.GfcpOverhead,
+	)
+	binary.LittleEndian.PutUint32(
+		pkt[8:],
+		42,
+	)
+	pkt[12] = gfcp.GfcpCmdPush
+	if _, err := raw.WriteTo(
+		pkt,
+		server,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	raw.SetReadDeadline(
+		time.Now().Add(
+			time.Second,
+		),
+	)
+	buf := make(
+		[]byte,
+		gfcp.GFcpMtuLimit,
+	)
+	n, _, err := raw.ReadFrom(
+		buf,
+	)
+	if err != nil {
+		t.Fatal(
+			"no reject:",
+			err,
+		)
+	}
+	if n != len(
+		pkt,
+	) || buf[4] != gfcp.KTypeControl || binary.LittleEndian.Uint32(
+		buf[8:],
+	) != 42 || buf[12] != gfcp.GfcpCmdFECReject ||
+		buf[13] != gfcp.FECRejectLayout {
+		t.Fatalf(
+			"bad reject: %x",
+			buf[:n],
+		)
+	}
+}
+
+func TestFECRejectAfterHeard(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"plain",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	go negotiateServer(
+		l,
+	)
+	conn := newRebindConn(
+		network,
+	)
+	cli, err := gfcp.NewConn(
+		"plain",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	server, err := conn.ResolveAddr(
+		"plain",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	// a spoofed reject, after the Listener has answered
+	reject := make(
+		[]byte,
+		gfcp.GfcpOverhead,
+	)
+	binary.LittleEndian.PutUint32(
+		reject,
+		cli.GetConv(),
+	)
+	reject[4] = gfcp.GfcpCmdFECReject
+	reject[5] = gfcp.FECRejectPolicy
+	conn.in <- rebindPacket{
+		reject,
+		server,
+	}
+	if err := echoTester(
+		cli,
+		1024,
+		16,
+	); err != nil {
+		t.Fatal(
+			"spoofed reject believed:",
+			err,
+		)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+func TestSessionLossyPipe(
+	t *testing.T,
+) {
+	link := func(
+		seed int64,
+	) *gfcptest.Link {
+		return &gfcptest.Link{
+			Loss: gfcptest.Bernoulli{
+				P: 0.1,
+			},
+			Delay:     10 * time.Millisecond,
+			Jitter:    5 * time.Millisecond,
+			Reorder:   0.05,
+			Duplicate: 0.05,
+			Seed:      seed,
+		}
+	}
+	a, b := gfcptest.NewPacketPipe(
+		link(
+			1,
+		),
+		link(
+			2,
+		),
+	)
+	l, err := gfcp.ServeConn(
+		0,
+		0,
+		b,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(
+			1,
+			10,
+			2,
+			1,
+		)
+		buf := make(
+			[]byte,
+			4096,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := gfcp.NewConn(
+		b.LocalAddr().String(),
+		0,
+		0,
+		a,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	cli.SetDeadline(
+		time.Now().Add(
+			20 * time.Second,
+		),
+	)
+	if err := echoTester(
+		cli,
+		4096,
+		64,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if stats := a.Stats(); stats.Lost == 0 {
+		t.Fatalf(
+			"%+v",
+			stats,
+		)
+	}
+}
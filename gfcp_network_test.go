@@ -519,32 +519,329 @@ func TestNetwork(
 	)
 }
 
+// benchWindows are the window sizes of BenchmarkFlush and BenchmarkInput.
+var benchWindows = []int{
+	32,
+	256,
+	2048,
+	16384,
+}
+
+// benchSegment encodes a GFCP segment header, with no data, into buf.
+func benchSegment(
+	buf []byte,
+	cmd byte,
+	wnd int,
+	ts,
+	sn,
+	una uint32,
+) []byte {
+	binary.LittleEndian.PutUint32(
+		buf,
+		1,
+	)
+	buf[4] = cmd
+	buf[5] = 0
+	binary.LittleEndian.PutUint16(
+		buf[6:],
+		uint16(wnd),
+	)
+	binary.LittleEndian.PutUint32(
+		buf[8:],
+		ts,
+	)
+	binary.LittleEndian.PutUint32(
+		buf[12:],
+		sn,
+	)
+	binary.LittleEndian.PutUint32(
+		buf[16:],
+		una,
+	)
+	binary.LittleEndian.PutUint32(
+		buf[20:],
+		0,
+	)
+	return buf[:gfcp.GfcpOverhead]
+}
+
+// benchSender returns a GFCP with wnd segments in flight.
+func benchSender(
+	wnd int,
+) *gfcp.GFCP {
+	GFcp := gfcp.NewGFCP(
+		1,
+		func(
+			buf []byte,
+			size int,
+		) {
+		})
+	GFcp.NoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	GFcp.WndSize(
+		wnd,
+		wnd,
+	)
+	// let the peer's window admit them all
+	GFcp.Input(
+		benchSegment(
+			make(
+				[]byte,
+				gfcp.GfcpOverhead,
+			),
+			gfcp.GfcpCmdWins,
+			wnd,
+			0,
+			0,
+			0,
+		),
+		true,
+		false,
+	)
+	msg := make(
+		[]byte,
+		64,
+	)
+	for k := 0; k < wnd; k++ {
+		GFcp.Send(
+			msg,
+		)
+	}
+	GFcp.Flush(
+		false,
+	)
+	return GFcp
+}
+
 func BenchmarkFlush(
 	b *testing.B,
 ) {
-	GFcp := gfcp.NewGFCP(
+	for _, wnd := range benchWindows {
+		b.Run(
+			fmt.Sprint(
+				wnd,
+			),
+			func(
+				b *testing.B,
+			) {
+				GFcp := benchSender(
+					wnd,
+				)
+				b.ResetTimer()
+				b.ReportAllocs()
+				var mu sync.Mutex
+				for i := 0; i < b.N; i++ {
+					mu.Lock()
+					GFcp.Flush(
+						false,
+					)
+					mu.Unlock()
+				}
+			},
+		)
+	}
+}
+
+// BenchmarkInput feeds one segment per iteration, in reverse order
+// across each window: acks to a sender with a full window in flight,
+// and data to a receiver, the worst cases for ack lookup and
+// out-of-order insertion.
+func BenchmarkInput(
+	b *testing.B,
+) {
+	for _, wnd := range benchWindows {
+		b.Run(
+			fmt.Sprintf(
+				"ack/%v",
+				wnd,
+			),
+			func(
+				b *testing.B,
+			) {
+				GFcp := benchSender(
+					wnd,
+				)
+				pkt := make(
+					[]byte,
+					gfcp.GfcpOverhead,
+				)
+				msg := make(
+					[]byte,
+					64,
+				)
+				var una uint32
+				b.ResetTimer()
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					j := i % wnd
+					GFcp.Input(
+						benchSegment(
+							pkt,
+							gfcp.GfcpCmdAck,
+							wnd,
+							0,
+							una+uint32(wnd-1-j),
+							una,
+						),
+						false,
+						false,
+					)
+					if j == wnd-1 {
+						// the window is acked; send the next
+						una += uint32(
+							wnd,
+						)
+						for k := 0; k < wnd; k++ {
+							GFcp.Send(
+								msg,
+							)
+						}
+						GFcp.Flush(
+							false,
+						)
+					}
+				}
+			},
+		)
+		b.Run(
+			fmt.Sprintf(
+				"data/%v",
+				wnd,
+			),
+			func(
+				b *testing.B,
+			) {
+				GFcp := gfcp.NewGFCP(
+					1,
+					func(
+						buf []byte,
+						size int,
+					) {
+					})
+				GFcp.WndSize(
+					wnd,
+					wnd,
+				)
+				pkt := make(
+					[]byte,
+					gfcp.GfcpOverhead,
+				)
+				buf := make(
+					[]byte,
+					gfcp.GfcpMtuDef,
+				)
+				var base uint32
+				b.ResetTimer()
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					j := i % wnd
+					GFcp.Input(
+						benchSegment(
+							pkt,
+							gfcp.GfcpCmdPush,
+							wnd,
+							0,
+							base+uint32(wnd-1-j),
+							0,
+						),
+						false,
+						false,
+					)
+					if j == wnd-1 {
+						// the window is complete; read it
+						base += uint32(
+							wnd,
+						)
+						for GFcp.Recv(
+							buf,
+						) >= 0 {
+						}
+						GFcp.Flush(
+							true,
+						)
+					}
+				}
+			},
+		)
+	}
+}
+
+// BenchmarkLoopback sends a segment between two GFCP instances per
+// iteration; in steady state it should not allocate.
+func BenchmarkLoopback(
+	b *testing.B,
+) {
+	var sender, receiver *gfcp.GFCP
+	sender = gfcp.NewGFCP(
 		1,
 		func(
 			buf []byte,
 			size int,
 		) {
-		})
-	GFcp.SndBuf = make(
-		[]gfcp.Segment,
-		2048,
+			receiver.Input(
+				buf[:size],
+				true,
+				false,
+			)
+		},
+	)
+	receiver = gfcp.NewGFCP(
+		1,
+		func(
+			buf []byte,
+			size int,
+		) {
+			sender.Input(
+				buf[:size],
+				true,
+				false,
+			)
+		},
 	)
-	for k := range GFcp.SndBuf {
-		GFcp.SndBuf[k].Kxmit = 1
-		GFcp.SndBuf[k].GFcpResendTs = gfcp.CurrentMs() + 1000
+	for _, g := range []*gfcp.GFCP{
+		sender,
+		receiver,
+	} {
+		g.NoDelay(
+			1,
+			10,
+			2,
+			1,
+		)
 	}
-	b.ResetTimer()
+	msg := make(
+		[]byte,
+		1024,
+	)
+	buf := make(
+		[]byte,
+		1024,
+	)
 	b.ReportAllocs()
-	var mu sync.Mutex
+	b.SetBytes(
+		int64(len(msg)),
+	)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		mu.Lock()
-		GFcp.Flush(
+		sender.Send(
+			msg,
+		)
+		sender.Flush(
+			false,
+		)
+		if receiver.Recv(
+			buf,
+		) < 0 {
+			b.Fatal(
+				"segment not received",
+			)
+		}
+		receiver.Flush(
 			false,
 		)
-		mu.Unlock()
 	}
 }
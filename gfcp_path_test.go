@@ -0,0 +1,80 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"testing"
+)
+
+// TestSetRemotePath checks that migrating a multipath session moves
+// its first path in place, so segments recorded as sent on it still
+// refer to a path of the session.
+func TestSetRemotePath(
+	t *testing.T,
+) {
+	network := NewMemNetwork()
+	conn, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s, err := NewConn(
+		"server",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	second, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if err := s.AddPath(
+		second,
+		"server",
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	first := s.sessionPaths()[0]
+	s.mu.Lock()
+	s.pathSent[1] = pathSend{
+		path: first,
+	}
+	s.mu.Unlock()
+	moved := conn.LocalAddr()
+	s.setRemote(
+		moved,
+	)
+	if p := s.sessionPaths()[0]; p != first || s.pathSent[1].path != p {
+		t.Fatal(
+			"path replaced",
+		)
+	}
+	if first.remoteAddr() != moved || s.PathStats()[0].RemoteAddr != moved {
+		t.Fatal(
+			"path not moved",
+		)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PollEvents is a set of readiness events of a session.
+type PollEvents uint32
+
+const (
+	// PollReadable means Read may return data without waiting.
+	PollReadable PollEvents = 1 << iota
+	// PollWritable means Write may queue data without waiting.
+	PollWritable
+	// PollError means the packet connection of the session failed, or
+	// the session was closed.
+	PollError
+)
+
+// PollHandler is called with the events that occurred on a session
+// since it was last called for it, and the error of PollError. Events
+// may be spurious: a read or write can still find nothing to do.
+type PollHandler func(
+	s *UDPSession,
+	events PollEvents,
+	err error,
+)
+
+// Poller delivers the readiness events of the sessions registered
+// with it to a handler, run by a fixed number of goroutines, so that
+// mostly idle sessions need no goroutine each. The handler is never
+// run for a session on two goroutines at once.
+type Poller struct {
+	handler PollHandler
+	mu      sync.Mutex
+	cond    sync.Cond
+	ready   []*pollEntry // sessions with events, in order
+	n       int          // sessions registered
+	closed  bool
+}
+
+// pollEntry is the registration of a session with a Poller.
+type pollEntry struct {
+	p       *Poller
+	s       *UDPSession
+	events  PollEvents // pending
+	err     error      // pending with PollError
+	queued  bool       // in ready, or being handled
+	removed bool
+}
+
+// NewPoller starts a Poller calling handler on the given number of
+// goroutines. If workers <= 0, runtime.GOMAXPROCS(0) are used.
+func NewPoller(
+	workers int,
+	handler PollHandler,
+) *Poller {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(
+			0,
+		)
+	}
+	p := &Poller{
+		handler: handler,
+	}
+	p.cond.L = &p.mu
+	for i := 0; i < workers; i++ {
+		go p.pollTask()
+	}
+	return p
+}
+
+// Add registers s, which makes it non-blocking: reads and writes that
+// would wait fail at once with a timeout error instead, and the handler
+// is called when they can make progress. Events already due are
+// delivered straight away. Closing s delivers PollReadable and
+// PollError, and unregisters it.
+func (
+	p *Poller,
+) Add(
+	s *UDPSession,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, _ := s.poll.Load().(*pollEntry); e != nil {
+		return errors.New(
+			errInvalidOperation,
+		)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errors.New(
+			errBrokenPipe,
+		)
+	}
+	p.n++
+	p.mu.Unlock()
+	e := &pollEntry{
+		p: p,
+		s: s,
+	}
+	s.poll.Store(
+		e,
+	)
+	s.nonblock = true
+	var events PollEvents
+	if len(
+		s.bufptr,
+	) > 0 || len(
+		s.blocks,
+	) > 0 || s.GFcp.PeekSize() > 0 || s.isClosed || s.rejected != nil {
+		events |= PollReadable
+	}
+	if s.sendAvailable() > 0 || s.isClosed || s.rejected != nil {
+		events |= PollWritable
+	}
+	if events != 0 {
+		e.post(
+			events,
+			nil,
+		)
+	}
+	return nil
+}
+
+// Remove unregisters s, and makes it blocking again. The handler may
+// still be running for s when Remove returns.
+func (
+	p *Poller,
+) Remove(
+	s *UDPSession,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, _ := s.poll.Load().(*pollEntry)
+	if e == nil || e.p != p {
+		return
+	}
+	s.poll.Store(
+		(*pollEntry)(nil),
+	)
+	s.nonblock = false
+	p.mu.Lock()
+	e.removed = true
+	p.n--
+	p.mu.Unlock()
+}
+
+// Len returns the number of sessions registered with the Poller.
+func (
+	p *Poller,
+) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+// Close stops the goroutines of the Poller. Sessions still registered
+// are no longer notified, and stay non-blocking; remove them first.
+func (
+	p *Poller,
+) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New(
+			errBrokenPipe,
+		)
+	}
+	p.closed = true
+	p.ready = nil
+	p.cond.Broadcast()
+	return nil
+}
+
+// pollTask runs the handler for sessions with events until Close.
+func (
+	p *Poller,
+) pollTask() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(
+			p.ready,
+		) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			return
+		}
+		e := p.ready[0]
+		p.ready[0] = nil
+		p.ready = p.ready[1:]
+		events, err := e.events, e.err
+		e.events, e.err = 0, nil
+		if !e.removed {
+			p.mu.Unlock()
+			p.handler(
+				e.s,
+				events,
+				err,
+			)
+			p.mu.Lock()
+		}
+		// events posted meanwhile wait for the handler to return
+		if e.events != 0 && !e.removed && !p.closed {
+			p.ready = append(
+				p.ready,
+				e,
+			)
+		} else {
+			e.queued = false
+		}
+	}
+}
+
+// post adds events to those pending for the session, and queues it
+// for the handler if it is not already.
+func (
+	e *pollEntry,
+) post(
+	events PollEvents,
+	err error,
+) {
+	p := e.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.removed || p.closed {
+		return
+	}
+	e.events |= events
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	if !e.queued {
+		e.queued = true
+		p.ready = append(
+			p.ready,
+			e,
+		)
+		p.cond.Signal()
+	}
+}
+
+// closePoll tells the Poller s is registered with, if any, that s was
+// closed, and unregisters s; s.mu must be held.
+func (
+	s *UDPSession,
+) closePoll() {
+	e, _ := s.poll.Load().(*pollEntry)
+	if e == nil {
+		return
+	}
+	s.poll.Store(
+		(*pollEntry)(nil),
+	)
+	e.post(
+		PollReadable|PollError,
+		errors.New(
+			errBrokenPipe,
+		),
+	)
+	e.p.mu.Lock()
+	e.p.n--
+	e.p.mu.Unlock()
+}
+
+// pollEvent passes events to the Poller s is registered with, if any.
+func (
+	s *UDPSession,
+) pollEvent(
+	events PollEvents,
+	err error,
+) {
+	if e, _ := s.poll.Load().(*pollEntry); e != nil {
+		e.post(
+			events,
+			err,
+		)
+	}
+}
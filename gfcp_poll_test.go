@@ -0,0 +1,453 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	u "github.com/johnsonjh/leaktestfe"
+)
+
+func TestPoller(
+	t *testing.T,
+) {
+	defer u.Leakplug(
+		t,
+	)
+	const clients = 200
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	// the handler echoes whatever can be read without waiting
+	var running sync.Map
+	var overlaps int32
+	p := gfcp.NewPoller(
+		2,
+		func(
+			s *gfcp.UDPSession,
+			events gfcp.PollEvents,
+			err error,
+		) {
+			v, _ := running.LoadOrStore(
+				s,
+				new(int32),
+			)
+			if atomic.AddInt32(
+				v.(*int32),
+				1,
+			) > 1 {
+				atomic.AddInt32(
+					&overlaps,
+					1,
+				)
+			}
+			defer atomic.AddInt32(
+				v.(*int32),
+				-1,
+			)
+			if events&gfcp.PollReadable == 0 {
+				return
+			}
+			buf := make(
+				[]byte,
+				1024,
+			)
+			for {
+				n, err := s.Read(
+					buf,
+				)
+				if err != nil {
+					return
+				}
+				s.Write(
+					buf[:n],
+				)
+			}
+		},
+	)
+	defer p.Close()
+	var sessions []*gfcp.UDPSession
+	var mu sync.Mutex
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range sessions {
+			p.Remove(
+				s,
+			)
+			s.Close()
+		}
+	}()
+	go func() {
+		for {
+			s, err := l.AcceptGFCP()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			sessions = append(
+				sessions,
+				s,
+			)
+			mu.Unlock()
+			if err := p.Add(
+				s,
+			); err != nil {
+				t.Error(
+					err,
+				)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(
+		chan error,
+		clients,
+	)
+	for i := 0; i < clients; i++ {
+		wg.Add(
+			1,
+		)
+		go func() {
+			defer wg.Done()
+			cli, err := network.Dial(
+				"server",
+				0,
+				0,
+			)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer cli.Close()
+			cli.SetDeadline(
+				time.Now().Add(
+					10 * time.Second,
+				),
+			)
+			errs <- echoTester(
+				cli,
+				1024,
+				16,
+			)
+		}()
+	}
+	wg.Wait()
+	close(
+		errs,
+	)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(
+				err,
+			)
+		}
+	}
+	if n := p.Len(); n != clients {
+		t.Fatalf(
+			"%v sessions registered, want %v",
+			n,
+			clients,
+		)
+	}
+	if n := atomic.LoadInt32(
+		&overlaps,
+	); n != 0 {
+		t.Fatalf(
+			"handler run %v times while already running",
+			n,
+		)
+	}
+}
+
+func TestPollerError(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	conn, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli, err := gfcp.NewConn(
+		"server",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	events := make(
+		chan gfcp.PollEvents,
+		16,
+	)
+	errs := make(
+		chan error,
+		1,
+	)
+	p := gfcp.NewPoller(
+		1,
+		func(
+			s *gfcp.UDPSession,
+			ev gfcp.PollEvents,
+			err error,
+		) {
+			events <- ev
+			if err != nil {
+				errs <- err
+			}
+		},
+	)
+	defer p.Close()
+	if err := p.Add(
+		cli,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if err := p.Add(
+		cli,
+	); err == nil {
+		t.Fatal(
+			"session registered twice",
+		)
+	}
+	select {
+	case ev := <-events:
+		if ev&gfcp.PollWritable == 0 {
+			t.Fatalf(
+				"events %b, want writable",
+				ev,
+			)
+		}
+	case <-time.After(
+		5 * time.Second,
+	):
+		t.Fatal(
+			"no initial events",
+		)
+	}
+	// nothing to read: a registered session does not wait
+	var ne net.Error
+	if _, err := cli.Read(
+		make(
+			[]byte,
+			16,
+		),
+	); !errors.As(
+		err,
+		&ne,
+	) || !ne.Timeout() {
+		t.Fatalf(
+			"Read: %v, want timeout",
+			err,
+		)
+	}
+	conn.Close()
+	select {
+	case <-errs:
+	case <-time.After(
+		5 * time.Second,
+	):
+		t.Fatal(
+			"no error event",
+		)
+	}
+	p.Remove(
+		cli,
+	)
+	if n := p.Len(); n != 0 {
+		t.Fatalf(
+			"%v sessions registered after Remove",
+			n,
+		)
+	}
+}
+
+// TestPollerClose checks that closing a registered session tells the
+// handler, and unregisters the session.
+func TestPollerClose(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	conn, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli, err := gfcp.NewConn(
+		"server",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	closed := make(
+		chan error,
+		1,
+	)
+	p := gfcp.NewPoller(
+		1,
+		func(
+			s *gfcp.UDPSession,
+			ev gfcp.PollEvents,
+			err error,
+		) {
+			if ev&gfcp.PollError != 0 {
+				if ev&gfcp.PollReadable == 0 {
+					err = errors.New(
+						"closed session not readable",
+					)
+				}
+				closed <- err
+			}
+		},
+	)
+	defer p.Close()
+	if err := p.Add(
+		cli,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli.Close()
+	select {
+	case err := <-closed:
+		if err == nil || err.Error() != "broken pipe" {
+			t.Fatalf(
+				"closed with %v",
+				err,
+			)
+		}
+	case <-time.After(
+		5 * time.Second,
+	):
+		t.Fatal(
+			"no event on close",
+		)
+	}
+	if n := p.Len(); n != 0 {
+		t.Fatalf(
+			"%v sessions registered after Close",
+			n,
+		)
+	}
+}
+
+// TestPollerSendBufferFull checks that a session whose send buffer
+// limit is reached is not reported writable when added.
+func TestPollerSendBufferFull(
+	t *testing.T,
+) {
+	network := gfcp.NewMemNetwork()
+	conn, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli, err := gfcp.NewConn(
+		"server",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetSendBufferLimit(
+		1000,
+	)
+	// nobody acknowledges it
+	if _, err := cli.Write(
+		make(
+			[]byte,
+			1000,
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	events := make(
+		chan gfcp.PollEvents,
+		16,
+	)
+	p := gfcp.NewPoller(
+		1,
+		func(
+			s *gfcp.UDPSession,
+			ev gfcp.PollEvents,
+			err error,
+		) {
+			events <- ev
+		},
+	)
+	defer p.Close()
+	if err := p.Add(
+		cli,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer p.Remove(
+		cli,
+	)
+	select {
+	case ev := <-events:
+		if ev&gfcp.PollWritable != 0 {
+			t.Fatalf(
+				"events %b: full session writable",
+				ev,
+			)
+		}
+	case <-time.After(
+		200 * time.Millisecond,
+	):
+	}
+}
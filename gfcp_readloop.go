@@ -0,0 +1,90 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"sync/atomic"
+)
+
+// defaultReadLoop reads one packet at a time with ReadFrom, and works
+// with any net.PacketConn.
+func (
+	s *UDPSession,
+) defaultReadLoop() {
+	buf := xmitBuf.Get(
+		GFcpMtuLimit,
+	)
+	defer xmitBuf.Put(
+		buf,
+	)
+	var src string
+	for {
+		if n, addr, err := s.conn.ReadFrom(
+			buf,
+		); err == nil {
+			if src == "" {
+				src = addr.String()
+			} else if addr.String() != src {
+				atomic.AddUint64(
+					&DefaultSnsi.GFcpInputErrors,
+					1,
+				)
+				continue
+			}
+			if n >= s.headerSize+GfcpOverhead {
+				s.packetInput(
+					buf[:n],
+				)
+			} else {
+				atomic.AddUint64(
+					&DefaultSnsi.GFcpInputErrors,
+					1,
+				)
+			}
+		} else {
+			s.notifyReadError(
+				err,
+			)
+			return
+		}
+	}
+}
+
+// defaultMonitor is the Listener counterpart of defaultReadLoop.
+func (
+	l *Listener,
+) defaultMonitor() {
+	buf := xmitBuf.Get(
+		GFcpMtuLimit,
+	)
+	defer xmitBuf.Put(
+		buf,
+	)
+	for {
+		if n, from, err := l.conn.ReadFrom(
+			buf,
+		); err == nil {
+			if n >= GfcpOverhead {
+				l.packetInput(
+					buf[:n],
+					from,
+				)
+			} else {
+				atomic.AddUint64(
+					&DefaultSnsi.GFcpInputErrors,
+					1,
+				)
+			}
+		} else {
+			return
+		}
+	}
+}
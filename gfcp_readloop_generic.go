@@ -13,72 +13,14 @@
 
 package gfcp
 
-import (
-	"sync/atomic"
-)
-
 func (
 	s *UDPSession,
 ) readLoop() {
-	buf := make(
-		[]byte,
-		GFcpMtuLimit,
-	)
-	var src string
-	for {
-		if n, addr, err := s.conn.ReadFrom(
-			buf,
-		); err == nil {
-			if src == "" {
-				src = addr.String()
-			} else if addr.String() != src {
-				atomic.AddUint64(
-					&DefaultSnsi.GFcpInputErrors,
-					1,
-				)
-				continue
-			}
-			if n >= s.headerSize+GfcpOverhead {
-				s.packetInput(
-					buf[:n],
-				)
-			} else {
-				atomic.AddUint64(
-					&DefaultSnsi.GFcpInputErrors,
-					1,
-				)
-			}
-		} else {
-			s.chReadError <- err
-			return
-		}
-	}
+	s.defaultReadLoop()
 }
 
 func (
 	l *Listener,
 ) monitor() {
-	buf := make(
-		[]byte,
-		GFcpMtuLimit,
-	)
-	for {
-		if n, from, err := l.conn.ReadFrom(
-			buf,
-		); err == nil {
-			if n >= l.headerSize+GfcpOverhead {
-				l.packetInput(
-					buf[:n],
-					from,
-				)
-			} else {
-				atomic.AddUint64(
-					&DefaultSnsi.GFcpInputErrors,
-					1,
-				)
-			}
-		} else {
-			return
-		}
-	}
+	l.defaultMonitor()
 }
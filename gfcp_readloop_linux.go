@@ -28,6 +28,10 @@ const (
 func (
 	s *UDPSession,
 ) readLoop() {
+	if s.xconn == nil {
+		s.defaultReadLoop()
+		return
+	}
 	addr, _ := net.ResolveUDPAddr(
 		"udp",
 		s.conn.LocalAddr().String(),
@@ -43,18 +47,9 @@ func (
 	s *UDPSession,
 ) readLoopIPv6() {
 	var src string
-	msgs := make(
-		[]ipv6.Message,
-		batchSize,
+	msgs := newReadBatch(
+		s.offload,
 	)
-	for k := range msgs {
-		msgs[k].Buffers = [][]byte{
-			make(
-				[]byte,
-				GFcpMtuLimit,
-			),
-		}
-	}
 	conn := ipv6.NewPacketConn(
 		s.conn,
 	)
@@ -74,19 +69,15 @@ func (
 					)
 					continue
 				}
-				if msg.N < s.headerSize+GfcpOverhead {
-					atomic.AddUint64(
-						&DefaultSnsi.GFcpInputErrors,
-						1,
-					)
-					continue
-				}
-				s.packetInput(
-					msg.Buffers[0][:msg.N],
+				groSplit(
+					msg,
+					s.rxPacket,
 				)
 			}
 		} else {
-			s.chReadError <- err
+			s.notifyReadError(
+				err,
+			)
 			return
 		}
 	}
@@ -96,16 +87,9 @@ func (
 	s *UDPSession,
 ) readLoopIPv4() {
 	var src string
-	msgs := make(
-		[]ipv4.Message,
-		batchSize,
+	msgs := newReadBatch(
+		s.offload,
 	)
-	for k := range msgs {
-		msgs[k].Buffers = [][]byte{make(
-			[]byte,
-			GFcpMtuLimit,
-		)}
-	}
 	conn := ipv4.NewPacketConn(
 		s.conn,
 	)
@@ -125,19 +109,15 @@ func (
 					)
 					continue
 				}
-				if msg.N < s.headerSize+GfcpOverhead {
-					atomic.AddUint64(
-						&DefaultSnsi.GFcpInputErrors,
-						1,
-					)
-					continue
-				}
-				s.packetInput(
-					msg.Buffers[0][:msg.N],
+				groSplit(
+					msg,
+					s.rxPacket,
 				)
 			}
 		} else {
-			s.chReadError <- err
+			s.notifyReadError(
+				err,
+			)
 			return
 		}
 	}
@@ -146,6 +126,10 @@ func (
 func (
 	l *Listener,
 ) monitor() {
+	if l.xconn == nil {
+		l.defaultMonitor()
+		return
+	}
 	addr, _ := net.ResolveUDPAddr(
 		"udp",
 		l.conn.LocalAddr().String(),
@@ -160,16 +144,9 @@ func (
 func (
 	l *Listener,
 ) monitorIPv4() {
-	msgs := make(
-		[]ipv4.Message,
-		batchSize,
+	msgs := newReadBatch(
+		l.offload,
 	)
-	for k := range msgs {
-		msgs[k].Buffers = [][]byte{make(
-			[]byte,
-			GFcpMtuLimit,
-		)}
-	}
 	conn := ipv4.NewPacketConn(
 		l.conn,
 	)
@@ -180,17 +157,17 @@ func (
 		); err == nil {
 			for i := 0; i < count; i++ {
 				msg := &msgs[i]
-				if msg.N >= l.headerSize+GfcpOverhead {
-					l.packetInput(
-						msg.Buffers[0][:msg.N],
-						msg.Addr,
-					)
-				} else {
-					atomic.AddUint64(
-						&DefaultSnsi.GFcpInputErrors,
-						1,
-					)
-				}
+				groSplit(
+					msg,
+					func(
+						data []byte,
+					) {
+						l.rxPacket(
+							data,
+							msg.Addr,
+						)
+					},
+				)
 			}
 		} else {
 			return
@@ -201,16 +178,9 @@ func (
 func (
 	l *Listener,
 ) monitorIPv6() {
-	msgs := make(
-		[]ipv6.Message,
-		batchSize,
+	msgs := newReadBatch(
+		l.offload,
 	)
-	for k := range msgs {
-		msgs[k].Buffers = [][]byte{make(
-			[]byte,
-			GFcpMtuLimit,
-		)}
-	}
 	conn := ipv4.NewPacketConn(
 		l.conn,
 	)
@@ -221,20 +191,60 @@ func (
 		); err == nil {
 			for i := 0; i < count; i++ {
 				msg := &msgs[i]
-				if msg.N >= l.headerSize+GfcpOverhead {
-					l.packetInput(
-						msg.Buffers[0][:msg.N],
-						msg.Addr,
-					)
-				} else {
-					atomic.AddUint64(
-						&DefaultSnsi.GFcpInputErrors,
-						1,
-					)
-				}
+				groSplit(
+					msg,
+					func(
+						data []byte,
+					) {
+						l.rxPacket(
+							data,
+							msg.Addr,
+						)
+					},
+				)
 			}
 		} else {
 			return
 		}
 	}
 }
+
+func (
+	s *UDPSession,
+) rxPacket(
+	data []byte,
+) {
+	if len(
+		data,
+	) < s.headerSize+GfcpOverhead {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpInputErrors,
+			1,
+		)
+		return
+	}
+	s.packetInput(
+		data,
+	)
+}
+
+func (
+	l *Listener,
+) rxPacket(
+	data []byte,
+	addr net.Addr,
+) {
+	if len(
+		data,
+	) < GfcpOverhead {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpInputErrors,
+			1,
+		)
+		return
+	}
+	l.packetInput(
+		data,
+		addr,
+	)
+}
@@ -0,0 +1,183 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+// segmentRing holds the segments of a send or receive window by
+// sequence number: segment sn sits in slot sn&mask, so that acks and
+// out-of-order data find their slot in O(1). The ring grows to span
+// the window, and keeps its size when the window shrinks.
+type segmentRing struct {
+	segs []Segment // length a power of two
+	used []bool
+	head uint32 // sequence number of the first segment held
+	span uint32 // sequence numbers from head through the last held
+	n    int    // segments held
+}
+
+// size returns the number of segments held.
+func (
+	r *segmentRing,
+) size() int {
+	return r.n
+}
+
+// slot returns segment head+i, or nil if it is not held.
+func (
+	r *segmentRing,
+) slot(
+	i uint32,
+) *Segment {
+	if i >= r.span {
+		return nil
+	}
+	k := (r.head + i) & uint32(
+		len(r.segs)-1,
+	)
+	if !r.used[k] {
+		return nil
+	}
+	return &r.segs[k]
+}
+
+// at returns segment sn, or nil if it is not held.
+func (
+	r *segmentRing,
+) at(
+	sn uint32,
+) *Segment {
+	if r.n == 0 || _itimediff(
+		sn,
+		r.head,
+	) < 0 {
+		return nil
+	}
+	return r.slot(
+		sn - r.head,
+	)
+}
+
+// front returns the first segment, or nil if the ring is empty.
+func (
+	r *segmentRing,
+) front() *Segment {
+	if r.n == 0 {
+		return nil
+	}
+	return r.slot(
+		0,
+	)
+}
+
+// insert adds seg, and reports false if segment seg.sn is already
+// held; the segments held must keep within 2^31 sequence numbers.
+func (
+	r *segmentRing,
+) insert(
+	seg Segment,
+) bool {
+	head, span := seg.sn, uint32(1)
+	if r.n > 0 {
+		if r.at(
+			seg.sn,
+		) != nil {
+			return false
+		}
+		head, span = r.head, r.span
+		if _itimediff(
+			seg.sn,
+			head,
+		) < 0 {
+			span += head - seg.sn
+			head = seg.sn
+		} else if seg.sn-head >= span {
+			span = seg.sn - head + 1
+		}
+	}
+	if int(
+		span,
+	) > len(
+		r.segs,
+	) {
+		r.grow(
+			span,
+		)
+	}
+	r.head, r.span = head, span
+	k := seg.sn & uint32(
+		len(r.segs)-1,
+	)
+	r.segs[k] = seg
+	r.used[k] = true
+	r.n++
+	return true
+}
+
+// popFront removes the first segment, without freeing its data.
+func (
+	r *segmentRing,
+) popFront() {
+	if r.n == 0 {
+		return
+	}
+	mask := uint32(
+		len(r.segs) - 1,
+	)
+	k := r.head & mask
+	r.segs[k] = Segment{}
+	r.used[k] = false
+	r.n--
+	if r.n == 0 {
+		r.span = 0
+		return
+	}
+	// skip to the next segment held
+	for {
+		r.head++
+		r.span--
+		if r.used[r.head&mask] {
+			return
+		}
+	}
+}
+
+// grow resizes the ring to hold span sequence numbers.
+func (
+	r *segmentRing,
+) grow(
+	span uint32,
+) {
+	size := 32
+	for size < int(
+		span,
+	) {
+		size <<= 1
+	}
+	segs := make(
+		[]Segment,
+		size,
+	)
+	used := make(
+		[]bool,
+		size,
+	)
+	mask := uint32(
+		size - 1,
+	)
+	for i := uint32(0); i < r.span; i++ {
+		if seg := r.slot(
+			i,
+		); seg != nil {
+			segs[seg.sn&mask] = *seg
+			used[seg.sn&mask] = true
+		}
+	}
+	r.segs, r.used = segs, used
+}
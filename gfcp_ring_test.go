@@ -0,0 +1,672 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ringCheck fails t unless r holds exactly the segments sns, in order.
+func ringCheck(
+	t *testing.T,
+	r *segmentRing,
+	sns []uint32,
+) {
+	t.Helper()
+	if r.size() != len(
+		sns,
+	) {
+		t.Fatalf(
+			"size %v, want %v",
+			r.size(),
+			len(sns),
+		)
+	}
+	held := make(
+		map[uint32]bool,
+	)
+	for _, sn := range sns {
+		held[sn] = true
+		if seg := r.at(
+			sn,
+		); seg == nil || seg.sn != sn {
+			t.Fatalf(
+				"segment %v not held",
+				sn,
+			)
+		}
+	}
+	if len(
+		sns,
+	) == 0 {
+		if r.front() != nil {
+			t.Fatal(
+				"front of an empty ring",
+			)
+		}
+		return
+	}
+	if r.front().sn != sns[0] || r.head != sns[0] ||
+		r.span != sns[len(sns)-1]-sns[0]+1 {
+		t.Fatalf(
+			"head %v span %v, want %v through %v",
+			r.head,
+			r.span,
+			sns[0],
+			sns[len(sns)-1],
+		)
+	}
+	for i := uint32(0); i < r.span; i++ {
+		if seg := r.slot(
+			i,
+		); seg != nil && !held[seg.sn] || seg == nil && held[r.head+i] {
+			t.Fatalf(
+				"slot %v wrong",
+				i,
+			)
+		}
+	}
+}
+
+// ringInsert inserts segments sns into r.
+func ringInsert(
+	t *testing.T,
+	r *segmentRing,
+	sns ...uint32,
+) {
+	t.Helper()
+	for _, sn := range sns {
+		if !r.insert(
+			Segment{
+				sn: sn,
+			},
+		) {
+			t.Fatalf(
+				"segment %v not inserted",
+				sn,
+			)
+		}
+	}
+}
+
+func TestSegmentRingWraparound(
+	t *testing.T,
+) {
+	var r segmentRing
+	var sns []uint32
+	for sn := uint32(0xFFFFFFF0); sn != 0x10; sn++ {
+		ringInsert(
+			t,
+			&r,
+			sn,
+		)
+		sns = append(
+			sns,
+			sn,
+		)
+	}
+	ringCheck(
+		t,
+		&r,
+		sns,
+	)
+	if r.at(
+		0xFFFFFFEF,
+	) != nil || r.at(
+		0x10,
+	) != nil {
+		t.Fatal(
+			"segment outside the window held",
+		)
+	}
+	for len(
+		sns,
+	) > 0 {
+		r.popFront()
+		sns = sns[1:]
+		ringCheck(
+			t,
+			&r,
+			sns,
+		)
+	}
+}
+
+func TestSegmentRingOutOfOrder(
+	t *testing.T,
+) {
+	var r segmentRing
+	ringInsert(
+		t,
+		&r,
+		5,
+		3,
+		9,
+		4,
+	)
+	ringCheck(
+		t,
+		&r,
+		[]uint32{
+			3,
+			4,
+			5,
+			9,
+		},
+	)
+	if r.insert(
+		Segment{
+			sn: 4,
+		},
+	) {
+		t.Fatal(
+			"duplicate inserted",
+		)
+	}
+	if r.at(
+		6,
+	) != nil {
+		t.Fatal(
+			"gap held",
+		)
+	}
+}
+
+func TestSegmentRingPopGaps(
+	t *testing.T,
+) {
+	var r segmentRing
+	ringInsert(
+		t,
+		&r,
+		10,
+		13,
+		20,
+	)
+	for _, sns := range [][]uint32{
+		{
+			13,
+			20,
+		},
+		{
+			20,
+		},
+		{},
+	} {
+		r.popFront()
+		ringCheck(
+			t,
+			&r,
+			sns,
+		)
+	}
+	r.popFront()
+	ringInsert(
+		t,
+		&r,
+		7,
+	)
+	ringCheck(
+		t,
+		&r,
+		[]uint32{
+			7,
+		},
+	)
+}
+
+func TestSegmentRingGrowWrapped(
+	t *testing.T,
+) {
+	var r segmentRing
+	var sns []uint32
+	for sn := uint32(100); sn < 132; sn++ {
+		ringInsert(
+			t,
+			&r,
+			sn,
+		)
+		sns = append(
+			sns,
+			sn,
+		)
+	}
+	for i := 0; i < 16; i++ {
+		r.popFront()
+	}
+	sns = sns[16:]
+	// slots wrap around the end of the array before it grows
+	for sn := uint32(132); sn < 160; sn++ {
+		ringInsert(
+			t,
+			&r,
+			sn,
+		)
+		sns = append(
+			sns,
+			sn,
+		)
+	}
+	if len(
+		r.segs,
+	) != 64 {
+		t.Fatalf(
+			"ring of %v slots",
+			len(r.segs),
+		)
+	}
+	ringCheck(
+		t,
+		&r,
+		sns,
+	)
+}
+
+// TestFastack checks the fastack counts applyFastacks defers against
+// counting each ack as it comes.
+func TestFastack(
+	t *testing.T,
+) {
+	rng := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	for round := 0; round < 100; round++ {
+		GFcp := NewGFCP(
+			1,
+			func(
+				buf []byte,
+				size int,
+			) {
+			},
+		)
+		base := uint32(0xFFFFFF00) + uint32(
+			rng.Intn(
+				512,
+			),
+		)
+		wnd := 1 + rng.Intn(
+			200,
+		)
+		want := make(
+			map[uint32]uint32,
+		)
+		for i := 0; i < wnd; i++ {
+			if rng.Intn(
+				4,
+			) == 0 {
+				continue
+			}
+			GFcp.sndBuf.insert(
+				Segment{
+					sn: base + uint32(i),
+					ts: uint32(
+						1000 + i + rng.Intn(
+							20,
+						),
+					),
+				},
+			)
+		}
+		GFcp.sndUna, GFcp.sndNxt = base, base+uint32(wnd)
+		for i := rng.Intn(
+			3 * wnd,
+		); i > 0; i-- {
+			sn := base + uint32(
+				rng.Intn(
+					wnd+4,
+				),
+			) - 2
+			ts := uint32(
+				1000 + rng.Intn(
+					wnd+20,
+				),
+			)
+			if sn-base < uint32(wnd) {
+				for k := uint32(0); k < sn-base; k++ {
+					if seg := GFcp.sndBuf.at(
+						base + k,
+					); seg != nil && _itimediff(
+						seg.ts,
+						ts,
+					) <= 0 {
+						want[seg.sn]++
+					}
+				}
+			}
+			GFcp.parseFastack(
+				sn,
+				ts,
+			)
+		}
+		GFcp.applyFastacks()
+		for k := uint32(0); k < GFcp.sndBuf.span; k++ {
+			if seg := GFcp.sndBuf.slot(
+				k,
+			); seg != nil && seg.fastack != want[seg.sn] {
+				t.Fatalf(
+					"round %v: segment %v fastack %v, want %v",
+					round,
+					seg.sn,
+					seg.fastack,
+					want[seg.sn],
+				)
+			}
+		}
+	}
+}
+
+// stepClock is a Clock that only moves when the test advances it.
+type stepClock struct {
+	now time.Time
+}
+
+func (
+	c *stepClock,
+) Now() time.Time {
+	return c.now
+}
+
+func (
+	c *stepClock,
+) NewTimer(
+	d time.Duration,
+) Timer {
+	return SystemClock.NewTimer(
+		d,
+	)
+}
+
+// fastackLink is a sender and receiver joined by a link that drops
+// the same pushes on every run, logging what the sender outputs.
+type fastackLink struct {
+	snd, rcv *GFCP
+	toRcv    [][]byte
+	toSnd    [][]byte
+	sent     [][]byte
+}
+
+func newFastackLink(
+	clock Clock,
+) *fastackLink {
+	l := new(
+		fastackLink,
+	)
+	drops := rand.New(
+		rand.NewSource(
+			1,
+		),
+	)
+	l.snd = NewGFCP(
+		1,
+		func(
+			buf []byte,
+			size int,
+		) {
+			pkt := append(
+				[]byte(nil),
+				buf[:size]...,
+			)
+			l.sent = append(
+				l.sent,
+				pkt,
+			)
+			if drops.Intn(
+				8,
+			) != 0 {
+				l.toRcv = append(
+					l.toRcv,
+					pkt,
+				)
+			}
+		},
+	)
+	l.rcv = NewGFCP(
+		1,
+		func(
+			buf []byte,
+			size int,
+		) {
+			l.toSnd = append(
+				l.toSnd,
+				append(
+					[]byte(nil),
+					buf[:size]...,
+				),
+			)
+		},
+	)
+	for _, GFcp := range []*GFCP{
+		l.snd,
+		l.rcv,
+	} {
+		GFcp.SetClock(
+			clock,
+		)
+		GFcp.NoDelay(
+			1,
+			10,
+			2,
+			1,
+		)
+		GFcp.WndSize(
+			256,
+			256,
+		)
+	}
+	return l
+}
+
+// step delivers the packets queued on the link, tops up the send
+// queue and updates both ends.
+func (
+	l *fastackLink,
+) step(
+	perAck bool,
+) {
+	for _, pkt := range l.toRcv {
+		l.rcv.Input(
+			pkt,
+			true,
+			false,
+		)
+	}
+	l.toRcv = l.toRcv[:0]
+	for _, pkt := range l.toSnd {
+		l.snd.Input(
+			pkt,
+			true,
+			false,
+		)
+		if perAck {
+			// count every ack in the packet, walking the window from
+			// its front the way parseFastack used to
+			l.snd.fastacks = l.snd.fastacks[:0]
+			for seg := pkt; len(
+				seg,
+			) >= GfcpOverhead; seg = seg[GfcpOverhead+binary.LittleEndian.Uint32(
+				seg[20:],
+			):] {
+				sn := binary.LittleEndian.Uint32(
+					seg[12:],
+				)
+				ts := binary.LittleEndian.Uint32(
+					seg[8:],
+				)
+				if seg[4] != GfcpCmdAck || _itimediff(
+					sn,
+					l.snd.sndNxt,
+				) >= 0 {
+					continue
+				}
+				for k := uint32(0); k < l.snd.sndBuf.span; k++ {
+					held := l.snd.sndBuf.slot(
+						k,
+					)
+					if held == nil {
+						continue
+					}
+					if _itimediff(
+						sn,
+						held.sn,
+					) <= 0 {
+						break
+					}
+					if _itimediff(
+						held.ts,
+						ts,
+					) <= 0 {
+						held.fastack++
+					}
+				}
+			}
+		}
+	}
+	l.toSnd = l.toSnd[:0]
+	buf := make(
+		[]byte,
+		1000,
+	)
+	for l.rcv.Recv(
+		buf,
+	) > 0 {
+	}
+	for l.snd.WaitSnd() < 512 {
+		l.snd.Send(
+			buf,
+		)
+	}
+	l.snd.Update()
+	l.rcv.Update()
+}
+
+// TestFastackTiming runs the same lossy transfer twice, once counting
+// fastacks at the next flush and once counting each ack as it arrives,
+// and checks that the sender puts out the same packets at the same
+// times, fast retransmits included.
+func TestFastackTiming(
+	t *testing.T,
+) {
+	clock := &stepClock{
+		now: time.Unix(
+			0,
+			0,
+		),
+	}
+	deferred := newFastackLink(
+		clock,
+	)
+	perAck := newFastackLink(
+		clock,
+	)
+	var fast uint64
+	for i := 0; i < 500; i++ {
+		before := atomic.LoadUint64(
+			&DefaultSnsi.FastGFcpRestransmittedSegments,
+		)
+		deferred.step(
+			false,
+		)
+		fast += atomic.LoadUint64(
+			&DefaultSnsi.FastGFcpRestransmittedSegments,
+		) - before
+		perAck.step(
+			true,
+		)
+		if len(
+			deferred.sent,
+		) != len(
+			perAck.sent,
+		) {
+			t.Fatalf(
+				"step %v: %v packets sent, want %v",
+				i,
+				len(deferred.sent),
+				len(perAck.sent),
+			)
+		}
+		for k := range perAck.sent {
+			if !bytes.Equal(
+				deferred.sent[k],
+				perAck.sent[k],
+			) {
+				t.Fatalf(
+					"step %v: packet %v differs",
+					i,
+					k,
+				)
+			}
+		}
+		clock.now = clock.now.Add(
+			10 * time.Millisecond,
+		)
+	}
+	if fast == 0 {
+		t.Fatal(
+			"no fast retransmits",
+		)
+	}
+}
+
+func TestSndBuf(
+	t *testing.T,
+) {
+	GFcp := NewGFCP(
+		1,
+		func(
+			buf []byte,
+			size int,
+		) {
+		},
+	)
+	ringInsert(
+		t,
+		&GFcp.sndBuf,
+		0xFFFFFFFE,
+		1,
+		0xFFFFFFFF,
+		3,
+	)
+	segs := GFcp.SndBuf()
+	want := []uint32{
+		0xFFFFFFFE,
+		0xFFFFFFFF,
+		1,
+		3,
+	}
+	if len(
+		segs,
+	) != len(
+		want,
+	) {
+		t.Fatalf(
+			"%v segments, want %v",
+			len(segs),
+			len(want),
+		)
+	}
+	for i, seg := range segs {
+		if seg.sn != want[i] {
+			t.Fatalf(
+				"segment %v is %v, want %v",
+				i,
+				seg.sn,
+				want[i],
+			)
+		}
+	}
+}
@@ -59,6 +59,9 @@ const (
 )
 
 // KxmitBuf ...
+//
+// Deprecated: sessions take their buffers from a size-classed
+// BufferPool, never from KxmitBuf.
 var KxmitBuf sync.Pool
 
 func init() {
@@ -70,10 +73,22 @@ func init() {
 	}
 }
 
+// xmitBuf holds the buffers of segments, FEC shards and outgoing
+// packets, sized for acknowledgements, Ethernet frames and jumbograms.
+var xmitBuf = NewBufferPool(
+	128,
+	512,
+	1536,
+	GFcpMtuLimit,
+)
+
 type (
 	// UDPSession ...
 	UDPSession struct {
 		updaterIdx int            // record slice index in updater
+		updater    *Updater       // the Updater flushing this session
+		umu        sync.Mutex     // protects updater
+		idleWait   bool           // parked by the updater with nothing to do
 		conn       net.PacketConn // the underlying packet connection
 		GFcp       *GFCP          // GFCP ARQ protocol
 		l          *Listener      // pointing to the Listener object if it's been accepted by a Listener
@@ -82,22 +97,75 @@ type (
 		// FecDecoder ...
 		FecDecoder *FecDecoder
 		// FecEncoder ...
-		FecEncoder   *FecEncoder
-		remote       net.Addr      // remote peer address
-		rd           time.Time     // read deadline
-		wd           time.Time     // write deadline
-		headerSize   int           // the header size additional to a GFCP frame
-		ackNoDelay   bool          // send ack immediately for each incoming packet(testing purpose)
-		writeDelay   bool          // delay GFcp.flush() for Write() for bulk transfer
-		dup          int           // duplicate udp packets(testing purpose)
-		die          chan struct{} // notify current session has Closed
-		chReadEvent  chan struct{} // notify Read() can be called without blocking
-		chWriteEvent chan struct{} // notify Write() can be called without blocking
-		chReadError  chan error    // notify PacketConn.Read() have an error
-		chWriteError chan error    // notify PacketConn.Write() have an error
-		nonce        Entropy
-		isClosed     bool // flag the session has Closed
-		mu           sync.Mutex
+		FecEncoder      *FecEncoder
+		remote          atomic.Value  // remote peer net.Addr, changed by migration
+		rd              time.Time     // read deadline
+		wd              time.Time     // write deadline
+		headerSize      int           // the header size additional to a GFCP frame
+		ackNoDelay      bool          // send ack immediately for each incoming packet(testing purpose)
+		writeDelay      bool          // delay GFcp.flush() for Write() for bulk transfer
+		dup             int           // duplicate udp packets(testing purpose)
+		die             chan struct{} // notify current session has Closed
+		chReadEvent     chan struct{} // notify Read() can be called without blocking
+		chWriteEvent    chan struct{} // notify Write() can be called without blocking
+		chReadError     chan error    // notify PacketConn.Read() have an error
+		chWriteError    chan error    // notify PacketConn.Write() have an error
+		nonce           Entropy
+		isClosed        bool                // flag the session has Closed
+		txqueue         []ipv4.Message      // outgoing packets, flushed by uncork()
+		xconn           batchConn           // for x/net batch I/O, nil if unsupported
+		offload         *offloadState       // UDP GSO/GRO availability of conn
+		paths           atomic.Value        // []*path of a multipath session
+		pathSent        map[uint32]pathSend // last path each unacknowledged segment was sent on
+		pathSeen        map[uint32]struct{} // segments received on some path, for Won
+		pathRedundant   bool                // send every datagram over all paths
+		pathKey         [pathTokenSize]byte // proves path responses, against conv collisions
+		pathKeyed       bool                // pathKey is known to both ends
+		pathKeySent     time.Time           // when the Listener last sent pathKey
+		pathKeyTries    int                 // how often the Listener has sent pathKey
+		fec             *FECConfig          // versioned FEC layout bounds, nil for version 0
+		fecAdapt        fecAdapter          // tunes parity of adaptive FEC
+		fecRecovered    uint64              // segments recovered by FEC, for fecAdapt
+		fecFlushAt      uint32              // when to flush partial FEC groups
+		fecFlushPending bool
+		fountain        *FountainDecoder // fountain coded blocks being received
+		blocks          []fountainResult // completed blocks, for ReadBlock
+		chBlockEvent    chan struct{}    // notify ReadBlock() can be called without blocking
+		rejected        error            // FEC settings refused by the Listener
+		heard           bool             // GFCP took a packet of the peer, FEC rejects are moot
+		poll            atomic.Value     // *pollEntry of the Poller notified of events
+		sndBufLimit     int              // bytes queued or unacknowledged at most, 0 for no limit
+		sndFull         bool             // a write waits for room, for onWritable
+		onWritable      func(int)        // called when a waiting write can go on
+		memHeld         MemoryUsage      // buffers counted against the memory budgets
+		inBucket        tokenBucket      // packet rate limit of the Listener, under mu
+		nonblock        bool             // registered with a Poller: fail rather than wait
+		mu              sync.Mutex
+	}
+
+	// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn
+	batchConn interface {
+		WriteBatch(
+			ms []ipv4.Message,
+			flags int,
+		) (
+			int,
+			error,
+		)
+		ReadBatch(
+			ms []ipv4.Message,
+			flags int,
+		) (
+			int,
+			error,
+		)
+	}
+
+	// offloadState records which UDP segmentation offloads a socket
+	// supports; it is shared by every session using the same socket.
+	offloadState struct {
+		gso int32 // UDP_SEGMENT usable, cleared on first failure
+		gro int32 // UDP_GRO enabled on the socket
 	}
 
 	setReadBuffer interface {
@@ -111,6 +179,17 @@ type (
 			bytes int,
 		) error
 	}
+
+	// addrResolver is implemented by packet connections with their own
+	// address space, such as MemConn, so NewConn can resolve raddr.
+	addrResolver interface {
+		ResolveAddr(
+			addr string,
+		) (
+			net.Addr,
+			error,
+		)
+	}
 )
 
 // newUDPSession creates a new UDP session (client or server)
@@ -118,6 +197,7 @@ func newUDPSession(
 	conv uint32,
 	dataShards,
 	parityShards int,
+	fec *FECConfig,
 	l *Listener,
 	conn net.PacketConn,
 	remote net.Addr,
@@ -140,6 +220,10 @@ func newUDPSession(
 		chan struct{},
 		1,
 	)
+	sess.chBlockEvent = make(
+		chan struct{},
+		1,
+	)
 	sess.chReadError = make(
 		chan error,
 		1,
@@ -148,26 +232,57 @@ func newUDPSession(
 		chan error,
 		1,
 	)
-	sess.remote = remote
+	sess.remote.Store(
+		remote,
+	)
 	sess.conn = conn
 	sess.l = l
+	if l != nil {
+		sess.xconn = l.xconn
+		sess.offload = l.offload
+		_, _ = rand.Read(
+			sess.pathKey[:],
+		)
+	} else {
+		sess.xconn,
+			sess.offload = newBatchConn(
+			conn,
+		)
+	}
 	sess.recvbuf = make(
 		[]byte,
 		GFcpMtuLimit,
 	)
-	sess.FecDecoder = NewFECDecoder(
-		rxFECMulti*(dataShards+parityShards),
-		dataShards,
-		parityShards,
-	)
-	sess.FecEncoder = NewFECEncoder(
-		dataShards,
-		parityShards,
-		0,
-	)
-	if sess.FecEncoder != nil {
-		sess.headerSize += fecHeaderSizePlus2
+	if fec != nil {
+		sess.fec = fec
+		sess.FecDecoder = NewFECDecoder(
+			rxFECMulti*(fec.DataShards+fec.MaxParityShards)*fec.Interleave,
+			fec.DataShards,
+			fec.ParityShards,
+		)
+		sess.FecEncoder = NewFECEncoderWithConfig(
+			fec,
+			0,
+		)
+		if sess.FecEncoder != nil {
+			sess.headerSize += fecHeaderSizeV1Plus2
+		}
+	} else {
+		sess.FecDecoder = NewFECDecoder(
+			rxFECMulti*(dataShards+parityShards),
+			dataShards,
+			parityShards,
+		)
+		sess.FecEncoder = NewFECEncoder(
+			dataShards,
+			parityShards,
+			0,
+		)
+		if sess.FecEncoder != nil {
+			sess.headerSize += fecHeaderSizePlus2
+		}
 	}
+	sess.initFECRxLimit()
 	sess.GFcp = NewGFCP(conv, func(
 		buf []byte,
 		size int,
@@ -181,7 +296,16 @@ func newUDPSession(
 	sess.GFcp.ReserveBytes(
 		sess.headerSize,
 	)
-	updater.addSession(
+	sess.updater = DefaultUpdater()
+	if l != nil {
+		if u, ok := l.updater.Load().(*Updater); ok {
+			sess.updater = u
+		}
+	}
+	sess.setClock(
+		sess.updater.clock,
+	)
+	sess.updater.addSession(
 		sess,
 	)
 	if sess.l == nil {
@@ -246,12 +370,23 @@ func (
 				errBrokenPipe,
 			)
 		}
+		if s.rejected != nil {
+			s.mu.Unlock()
+			return 0, s.rejected
+		}
 		if size := s.GFcp.PeekSize(); size > 0 {
 			if len(b) >= size {
 				s.GFcp.Recv(
 					b,
 				)
+				s.accountMemory()
+				wake := s.wakeup(
+					s.GFcp.WaitSnd(),
+				)
 				s.mu.Unlock()
+				s.reschedule(
+					wake,
+				)
 				atomic.AddUint64(
 					&DefaultSnsi.GFcpBytesReceived,
 					uint64(size),
@@ -275,13 +410,24 @@ func (
 				s.recvbuf,
 			)
 			s.bufptr = s.recvbuf[n:]
+			s.accountMemory()
+			wake := s.wakeup(
+				s.GFcp.WaitSnd(),
+			)
 			s.mu.Unlock()
+			s.reschedule(
+				wake,
+			)
 			atomic.AddUint64(
 				&DefaultSnsi.GFcpBytesReceived,
 				uint64(n),
 			)
 			return n, nil
 		}
+		if s.nonblock {
+			s.mu.Unlock()
+			return 0, errTimeout{}
+		}
 		var timeout *time.Timer
 		var c <-chan time.Time
 		if !s.rd.IsZero() {
@@ -339,55 +485,91 @@ func (
 	n int,
 	err error,
 ) {
+	off := 0 // of the data of v[0] written
 	for {
 		s.mu.Lock()
 		if s.isClosed {
 			s.mu.Unlock()
-			return 0,
+			return n,
 				errors.New(
 					errBrokenPipe,
 				)
 		}
+		if s.rejected != nil {
+			s.mu.Unlock()
+			return n, s.rejected
+		}
 
-		if s.GFcp.WaitSnd() < int(s.GFcp.sndWnd) {
-			for _, b := range v {
-				n += len(
-					b)
-				for {
-					if len(
-						b,
-					) <= int(
+		if s.GFcp.WaitSnd() < int(s.GFcp.sndWnd) && !s.sendBufferFull() {
+			queued := 0
+			for len(
+				v,
+			) > 0 && !s.sendBufferFull() {
+				size := len(
+					v[0],
+				) - off
+				if size > int(
+					s.GFcp.mss,
+				) {
+					size = int(
 						s.GFcp.mss,
-					) {
-						s.GFcp.Send(
-							b,
-						)
-						break
-					}
+					)
+				}
+				if size > 0 {
 					s.GFcp.Send(
-						b[:s.GFcp.mss],
+						v[0][off : off+size],
 					)
-					b = b[s.GFcp.mss:]
+				}
+				queued += size
+				off += size
+				if off == len(
+					v[0],
+				) {
+					v = v[1:]
+					off = 0
 				}
 			}
 
+			// a partial write waits for room, so send what it has
 			if s.GFcp.WaitSnd() >= int(
 				s.GFcp.sndWnd,
-			) || !s.writeDelay {
+			) || !s.writeDelay || len(v) > 0 {
 				s.GFcp.Flush(
 					false,
 				)
+				s.uncork()
 			}
+			s.sndFull = len(
+				v,
+			) > 0
+			s.accountMemory()
+			wake := s.wakeup(
+				s.GFcp.WaitSnd(),
+			)
 			s.mu.Unlock()
+			s.reschedule(
+				wake,
+			)
 			atomic.AddUint64(
 				&DefaultSnsi.GFcpBytesSent,
 				uint64(
-					n,
+					queued,
 				),
 			)
-			return n, nil
+			n += queued
+			if len(
+				v,
+			) == 0 {
+				return n, nil
+			}
+			continue
 		}
 
+		s.sndFull = true
+		if s.nonblock {
+			s.mu.Unlock()
+			return n, errTimeout{}
+		}
 		var timeout *time.Timer
 		var c <-chan time.Time
 		if !s.wd.IsZero() {
@@ -395,7 +577,7 @@ func (
 				s.wd,
 			) {
 				s.mu.Unlock()
-				return 0, errTimeout{}
+				return n, errTimeout{}
 			}
 			delay := time.Until(
 				s.wd,
@@ -428,12 +610,14 @@ func (
 func (
 	s *UDPSession,
 ) Close() error {
-	updater.removeSession(
+	s.umu.Lock()
+	s.updater.removeSession(
 		s,
 	)
+	s.umu.Unlock()
 	if s.l != nil {
 		s.l.CloseSession(
-			s.remote,
+			s.remoteAddr(),
 		)
 	}
 	s.mu.Lock()
@@ -447,6 +631,8 @@ func (
 		s.die,
 	)
 	s.isClosed = true
+	s.closePoll()
+	s.accountMemory()
 	atomic.AddUint64(
 		&DefaultSnsi.GFcpNowEstablished,
 		^uint64(
@@ -454,6 +640,11 @@ func (
 		),
 	)
 	if s.l == nil {
+		for _, p := range s.sessionPaths() {
+			if p.own {
+				p.conn.Close()
+			}
+		}
 		return s.conn.Close()
 	}
 	return nil
@@ -472,7 +663,7 @@ func (
 func (
 	s *UDPSession,
 ) RemoteAddr() net.Addr {
-	return s.remote
+	return s.remoteAddr()
 }
 
 // SetDeadline sets a deadline associated with the listener.
@@ -528,6 +719,38 @@ func (
 	s.writeDelay = delay
 }
 
+// SetUpdater moves the session onto another Updater, which allows
+// groups of sessions to be flushed by a private set of goroutines.
+func (
+	s *UDPSession,
+) SetUpdater(
+	u *Updater,
+) {
+	if u == nil {
+		return
+	}
+	s.umu.Lock()
+	defer s.umu.Unlock()
+	if u == s.updater {
+		return
+	}
+	s.updater.removeSession(
+		s,
+	)
+	s.updater = u
+	s.mu.Lock()
+	s.setClock(
+		u.clock,
+	)
+	closed := s.isClosed
+	s.mu.Unlock()
+	if !closed {
+		u.addSession(
+			s,
+		)
+	}
+}
+
 // SetWindowSize sets the maximum window size
 func (
 	s *UDPSession,
@@ -543,6 +766,78 @@ func (
 	)
 }
 
+// SetSendBufferLimit limits the data queued to be sent or not yet
+// acknowledged to the given number of bytes, beyond which writes wait
+// for room, and may be partial; writing can overshoot it by less than a
+// segment. The default, 0, limits only the number of segments queued.
+func (
+	s *UDPSession,
+) SetSendBufferLimit(
+	bytes int,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes < 0 {
+		bytes = 0
+	}
+	s.sndBufLimit = bytes
+	s.notifyWriteEvent()
+}
+
+// SendBufferAvailable returns how many bytes can be written without
+// waiting: the room left below the send buffer limit, or without one,
+// in the send window.
+func (
+	s *UDPSession,
+) SendBufferAvailable() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendAvailable()
+}
+
+// OnWritable sets fn to be called, on a goroutine of its own, when a
+// write that found the send buffer full could make progress again, with
+// the bytes available then. Applications can use it to resume upstream
+// reading instead of blocking in Write. A nil fn removes it.
+func (
+	s *UDPSession,
+) OnWritable(
+	fn func(
+		available int,
+	),
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onWritable = fn
+}
+
+// sendBufferFull reports whether the send buffer limit is reached.
+func (
+	s *UDPSession,
+) sendBufferFull() bool {
+	return s.sndBufLimit > 0 && s.GFcp.WaitSndBytes() >= s.sndBufLimit
+}
+
+// sendAvailable returns SendBufferAvailable, with s.mu held.
+func (
+	s *UDPSession,
+) sendAvailable() int {
+	if s.GFcp.WaitSnd() >= int(
+		s.GFcp.sndWnd,
+	) {
+		return 0
+	}
+	if s.sndBufLimit > 0 {
+		if s.sendBufferFull() {
+			return 0
+		}
+		return s.sndBufLimit - s.GFcp.WaitSndBytes()
+	}
+	return (int(s.GFcp.sndWnd) - s.GFcp.WaitSnd()) * int(
+		s.GFcp.mss,
+	)
+}
+
 // SetMtu sets the maximum transmission unit
 // This size does not including UDP header itself.
 func (
@@ -628,10 +923,15 @@ func (
 	defer s.mu.Unlock()
 	if s.l == nil {
 		if nc, ok := s.conn.(net.Conn); ok {
-			addr, _ := net.ResolveUDPAddr(
+			addr, err := net.ResolveUDPAddr(
 				"udp",
 				nc.LocalAddr().String(),
 			)
+			if err != nil || nc.LocalAddr().Network() != "udp" {
+				return errors.New(
+					errInvalidOperation,
+				)
+			}
 			if addr.IP.To4() != nil {
 				return ipv4.NewConn(
 					nc,
@@ -693,6 +993,8 @@ func (
 	)
 }
 
+// output queues a GFCP frame, plus any FEC parity it completes, for
+// transmission; the queue is written to the wire by uncork().
 func (
 	s *UDPSession,
 ) output(
@@ -703,26 +1005,100 @@ func (
 		ecc = s.FecEncoder.Encode(
 			buf,
 		)
+		s.fecFlushAfter()
 	}
-	nbytes := 0
-	npkts := 0
 	for i := 0; i < s.dup+1; i++ {
-		if n, err := s.conn.WriteTo(
+		s.queue(
 			buf,
-			s.remote,
-		); err == nil {
-			nbytes += n
-			npkts++
-		} else {
-			s.notifyWriteError(
-				err,
+		)
+	}
+	for k := range ecc {
+		s.queue(
+			ecc[k],
+		)
+	}
+}
+
+func (
+	s *UDPSession,
+) queue(
+	buf []byte,
+) {
+	if paths := s.sessionPaths(); paths != nil {
+		s.pathOutput(
+			paths,
+			buf,
+		)
+		return
+	}
+	bts := xmitBuf.Get(
+		len(buf),
+	)
+	copy(
+		bts,
+		buf,
+	)
+	// messages keep their Buffers across uncork, to be reused here
+	n := len(
+		s.txqueue,
+	)
+	if n < cap(
+		s.txqueue,
+	) {
+		s.txqueue = s.txqueue[:n+1]
+	} else {
+		s.txqueue = append(
+			s.txqueue,
+			ipv4.Message{},
+		)
+	}
+	msg := &s.txqueue[n]
+	if cap(
+		msg.Buffers,
+	) == 0 {
+		msg.Buffers = make(
+			[][]byte,
+			1,
+		)
+	}
+	msg.Buffers = msg.Buffers[:1]
+	msg.Buffers[0] = bts
+	msg.Addr = s.remoteAddr()
+}
+
+// uncork sends all queued packets; callers must hold s.mu.
+func (
+	s *UDPSession,
+) uncork() {
+	if len(
+		s.txqueue,
+	) > 0 {
+		s.tx(
+			s.txqueue,
+		)
+		for k := range s.txqueue {
+			xmitBuf.Put(
+				s.txqueue[k].Buffers[0],
 			)
+			s.txqueue[k].Buffers[0] = nil
+			s.txqueue[k].Addr = nil
 		}
+		s.txqueue = s.txqueue[:0]
 	}
-	for k := range ecc {
+}
+
+// defaultTx writes packets one at a time with WriteTo.
+func (
+	s *UDPSession,
+) defaultTx(
+	txqueue []ipv4.Message,
+) {
+	nbytes := 0
+	npkts := 0
+	for k := range txqueue {
 		if n, err := s.conn.WriteTo(
-			ecc[k],
-			s.remote,
+			txqueue[k].Buffers[0],
+			txqueue[k].Addr,
 		); err == nil {
 			nbytes += n
 			npkts++
@@ -730,6 +1106,7 @@ func (
 			s.notifyWriteError(
 				err,
 			)
+			break
 		}
 	}
 	atomic.AddUint64(
@@ -746,6 +1123,8 @@ func (
 	)
 }
 
+// update flushes the session when GFCP.Check() says it is due, and
+// returns how long the updater may wait before calling it again.
 func (
 	s *UDPSession,
 ) update() (
@@ -753,18 +1132,112 @@ func (
 ) {
 	s.mu.Lock()
 	waitsnd := s.GFcp.WaitSnd()
-	interval = time.Duration(
+	current := s.GFcp.currentMs()
+	if _itimediff(
+		s.GFcp.Check(),
+		current,
+	) <= 0 {
 		s.GFcp.Flush(
 			false,
-		),
-	) * time.Millisecond
+		)
+		s.GFcp.updated = 1
+		s.GFcp.tsFlush = current + s.GFcp.interval
+		s.uncork()
+	}
 	if s.GFcp.WaitSnd() < waitsnd {
 		s.notifyWriteEvent()
 	}
+	s.idleWait = s.GFcp.idle()
+	if s.idleWait {
+		interval = updateIdleInterval
+	} else {
+		interval = time.Duration(
+			_itimediff(
+				s.GFcp.Check(),
+				current,
+			),
+		) * time.Millisecond
+	}
+	if s.fec != nil && s.fec.Adaptive {
+		s.adaptFEC(
+			current,
+		)
+	}
+	if s.fecFlushPending {
+		if wait := s.fecFlush(
+			current,
+		); wait < interval {
+			interval = wait
+		}
+	}
+	if paths := s.sessionPaths(); paths != nil && s.l == nil {
+		s.probePaths(
+			paths,
+		)
+		if interval > pathProbeInterval {
+			interval = pathProbeInterval
+		}
+	}
+	if wait := s.sendPathKey(); wait > 0 && interval > wait {
+		interval = wait
+	}
 	s.mu.Unlock()
 	return
 }
 
+// wakeup decides, after input or a local read or write, whether the
+// session must be updated sooner than scheduled: at once when a window
+// update is owed or acknowledgements opened the send window, or when
+// Check() says so if the session was parked as idle. It returns -1 if
+// the current schedule is fine. Callers must hold s.mu.
+func (
+	s *UDPSession,
+) wakeup(
+	waitsnd int,
+) time.Duration {
+	if s.GFcp.probe != 0 || (s.GFcp.WaitSnd() < waitsnd && len(
+		s.GFcp.sndQueue,
+	) > 0) {
+		s.idleWait = false
+		return 0
+	}
+	if s.idleWait && !s.GFcp.idle() {
+		s.idleWait = false
+		if d := _itimediff(
+			s.GFcp.Check(),
+			s.GFcp.currentMs(),
+		); d > 0 {
+			return time.Duration(
+				d,
+			) * time.Millisecond
+		}
+		return 0
+	}
+	return -1
+}
+
+// reschedule asks the updater to update the session within d;
+// it must be called without holding s.mu.
+func (
+	s *UDPSession,
+) reschedule(
+	d time.Duration,
+) {
+	if d < 0 {
+		return
+	}
+	// umu is held across the heap update, so that SetUpdater cannot
+	// move the session to another heap in between
+	s.umu.Lock()
+	defer s.umu.Unlock()
+	s.updater.reschedule(
+		s,
+		s.updater.clock.Now().Add(
+			d,
+		),
+	)
+}
+
 // GetConv ...
 func (
 	s *UDPSession,
@@ -779,6 +1252,10 @@ func (
 	case s.chReadEvent <- struct{}{}:
 	default:
 	}
+	s.pollEvent(
+		PollReadable,
+		nil,
+	)
 }
 
 func (
@@ -788,6 +1265,18 @@ func (
 	case s.chWriteEvent <- struct{}{}:
 	default:
 	}
+	s.pollEvent(
+		PollWritable,
+		nil,
+	)
+	if s.sndFull && s.onWritable != nil {
+		if available := s.sendAvailable(); available > 0 {
+			s.sndFull = false
+			go s.onWritable(
+				available,
+			)
+		}
+	}
 }
 
 func (
@@ -799,6 +1288,22 @@ func (
 	case s.chWriteError <- err:
 	default:
 	}
+	s.pollEvent(
+		PollError,
+		err,
+	)
+}
+
+func (
+	s *UDPSession,
+) notifyReadError(
+	err error,
+) {
+	s.pollEvent(
+		PollError,
+		err,
+	)
+	s.chReadError <- err
 }
 
 func (
@@ -806,6 +1311,18 @@ func (
 ) packetInput(
 	data []byte,
 ) {
+	if paths := s.sessionPaths(); paths != nil {
+		s.pathInput(
+			paths[0],
+			data,
+		)
+		return
+	}
+	if s.pathControlInput(
+		data,
+	) {
+		return
+	}
 	s.GFcpInput(
 		data,
 	)
@@ -821,14 +1338,25 @@ func (
 		fecErrs,
 		fecRecovered,
 		fecParityShards uint64
+	if len(
+		data,
+	) > fountainHeaderSize && data[4] == KTypeFountain {
+		s.fountainInput(
+			data,
+		)
+		return
+	}
 	if s.FecDecoder != nil {
+		f := FecPacket(
+			data,
+		)
 		if len(
 			data,
-		) > fecHeaderSize {
-			f := FecPacket(
+		) > fecHeaderSize && f.headerLen() > 0 {
+			off := f.headerLen() + 2
+			if (f.flag() == KTypeData || f.flag() == KTypeParity) && len(
 				data,
-			)
-			if f.flag() == KTypeData || f.flag() == KTypeParity {
+			) >= off {
 				if f.flag() == KTypeParity {
 					fecParityShards++
 				}
@@ -839,11 +1367,13 @@ func (
 				waitsnd := s.GFcp.WaitSnd()
 				if f.flag() == KTypeData {
 					if ret := s.GFcp.Input(
-						data[fecHeaderSizePlus2:],
+						data[off:],
 						true,
 						s.ackNoDelay,
 					); ret != 0 {
 						GFcpInErrors++
+					} else {
+						s.heard = true
 					}
 				}
 				for _, r := range recovers {
@@ -864,6 +1394,7 @@ func (
 								s.ackNoDelay,
 							); ret == 0 {
 								fecRecovered++
+								s.heard = true
 							} else {
 								GFcpInErrors++
 							}
@@ -873,8 +1404,7 @@ func (
 					} else {
 						fecErrs++
 					}
-					// TODO(jhj): Switch to pointer to avoid allocation.
-					KxmitBuf.Put(
+					xmitBuf.Put(
 						r,
 					)
 				}
@@ -884,7 +1414,15 @@ func (
 				if s.GFcp.WaitSnd() < waitsnd {
 					s.notifyWriteEvent()
 				}
+				s.uncork()
+				s.accountMemory()
+				wake := s.wakeup(
+					waitsnd,
+				)
 				s.mu.Unlock()
+				s.reschedule(
+					wake,
+				)
 			} else {
 				atomic.AddUint64(
 					&DefaultSnsi.GFcpPreInputErrors,
@@ -906,6 +1444,8 @@ func (
 			s.ackNoDelay,
 		); ret != 0 {
 			GFcpInErrors++
+		} else {
+			s.heard = true
 		}
 		if n := s.GFcp.PeekSize(); n > 0 {
 			s.notifyReadEvent()
@@ -913,7 +1453,15 @@ func (
 		if s.GFcp.WaitSnd() < waitsnd {
 			s.notifyWriteEvent()
 		}
+		s.uncork()
+		s.accountMemory()
+		wake := s.wakeup(
+			waitsnd,
+		)
 		s.mu.Unlock()
+		s.reschedule(
+			wake,
+		)
 	}
 	atomic.AddUint64(
 		&DefaultSnsi.GFcpInputPackets,
@@ -950,25 +1498,40 @@ func (
 			&DefaultSnsi.GFcpFECRecovered,
 			fecRecovered,
 		)
+		atomic.AddUint64(
+			&s.fecRecovered,
+			fecRecovered,
+		)
 	}
 }
 
 type (
 	// Listener ...
 	Listener struct {
-		dataShards   int // FEC data shard
-		parityShards int // FEC parity shard
+		dataShards   int          // FEC data shard
+		parityShards int          // FEC parity shard
+		fec          *FECConfig   // bounds for adaptive FEC sessions, nil if not adaptive
+		fecRxLimit   int32        // FEC receive limit of accepted sessions, 0 for default
+		fecAutoRx    int32        // bound of their auto-sized receive limit
+		fecPolicy    atomic.Value // func(*FECConfig) error vetting client FEC settings
 		/// FecDecoder ...
-		FecDecoder      *FecDecoder            // FEC mock initialization
-		conn            net.PacketConn         // the underlying packet connection
-		sessions        map[string]*UDPSession // all sessions accepted by this Listener
+		FecDecoder      *FecDecoder               // FEC mock initialization
+		conn            net.PacketConn            // the underlying packet connection
+		sessions        map[string]*UDPSession    // all sessions accepted by this Listener
+		convs           map[uint32]*UDPSession    // the same sessions, by conversation ID
+		nsessions       int                       // distinct sessions, however many addresses each has
+		challenges      map[string]*pathChallenge // addresses being validated for migration
 		sessionLock     sync.Mutex
 		chAccepts       chan *UDPSession // Listen() backlog
 		chSessionClosed chan net.Addr    // session close queue
-		headerSize      int              // additional header for a GFcp frame
 		die             chan struct{}    // notify when the Listener has closed
 		rd              atomic.Value     // read deadline for Accept()
 		wd              atomic.Value
+		xconn           batchConn     // for x/net batch I/O, nil if unsupported
+		offload         *offloadState // UDP GSO/GRO availability of conn
+		updater         atomic.Value  // private *Updater for accepted sessions
+		memory          *MemoryBudget // buffers of accepted sessions
+		limiter         atomic.Value  // *listenerLimiter of SetLimits
 	}
 )
 
@@ -981,36 +1544,42 @@ func (
 	l.sessionLock.Lock()
 	s, ok := l.sessions[addr.String()]
 	l.sessionLock.Unlock()
+	if !ok && l.migrateInput(
+		data,
+		addr,
+	) {
+		return
+	}
 	if !ok {
 		if len(
 			l.chAccepts,
 		) < cap(
 			l.chAccepts,
 		) {
-			var conv uint32
-			convValid := false
-			if l.FecDecoder != nil {
-				isfec := binary.LittleEndian.Uint16(
-					data[4:],
-				)
-				if isfec == KTypeData {
-					conv = binary.LittleEndian.Uint32(
-						data[fecHeaderSizePlus2:],
-					)
-					convValid = true
+			conv, convValid := l.packetConv(
+				data,
+			)
+			ds, ps, fec, reject := l.negotiateFEC(
+				data,
+			)
+			if reject != 0 {
+				if !convValid {
+					return
 				}
-			} else {
-				conv = binary.LittleEndian.Uint32(
+				l.rejectFEC(
 					data,
+					conv,
+					reject,
+					addr,
 				)
-				convValid = true
-			}
-
-			if convValid {
+			} else if convValid && l.admitSession(
+				addr,
+			) {
 				s := newUDPSession(
 					conv,
-					l.dataShards,
-					l.parityShards,
+					ds,
+					ps,
+					fec,
 					l,
 					l.conn,
 					addr,
@@ -1020,17 +1589,48 @@ func (
 				)
 				l.sessionLock.Lock()
 				l.sessions[addr.String()] = s
+				l.nsessions++
+				if l.convs[conv] == nil {
+					// a colliding conv keeps migrating to the first
+					l.convs[conv] = s
+				}
 				l.sessionLock.Unlock()
 				l.chAccepts <- s
 			}
 		}
-	} else {
-		s.GFcpInput(
+	} else if l.admitPacket(
+		s,
+	) {
+		s.inputFrom(
 			data,
+			addr,
+		)
+	}
+}
+
+// SetUpdater makes sessions accepted from now on use a private
+// Updater, so that one Listener's load cannot delay another's.
+func (
+	l *Listener,
+) SetUpdater(
+	u *Updater,
+) {
+	if u != nil {
+		l.updater.Store(
+			u,
 		)
 	}
 }
 
+// MemoryBudget returns the budget the buffers of the sessions accepted
+// by the Listener count against, besides DefaultMemoryBudget. It has no
+// limit unless one is set.
+func (
+	l *Listener,
+) MemoryBudget() *MemoryBudget {
+	return l.memory
+}
+
 // SetReadBuffer sets the socket read buffer for the Listener.
 func (
 	l *Listener,
@@ -1070,10 +1670,15 @@ func (
 	dscp int,
 ) error {
 	if nc, ok := l.conn.(net.Conn); ok {
-		addr, _ := net.ResolveUDPAddr(
+		addr, err := net.ResolveUDPAddr(
 			"udp",
 			nc.LocalAddr().String(),
 		)
+		if err != nil || nc.LocalAddr().Network() != "udp" {
+			return errors.New(
+				errInvalidOperation,
+			)
+		}
 		if addr.IP.To4() != nil {
 			return ipv4.NewConn(
 				nc,
@@ -1113,7 +1718,7 @@ func (
 	var timeout <-chan time.Time
 	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
 		timeout = time.After(
-			time.Since(
+			time.Until(
 				tdeadline,
 			),
 		)
@@ -1209,11 +1814,34 @@ func (
 ) {
 	l.sessionLock.Lock()
 	defer l.sessionLock.Unlock()
-	if _, ok := l.sessions[remote.String()]; ok {
+	if s, ok := l.sessions[remote.String()]; ok {
 		delete(
 			l.sessions,
 			remote.String(),
 		)
+		l.nsessions--
+		for _, r := range s.pathRemotes() {
+			if l.sessions[r.String()] == s {
+				delete(
+					l.sessions,
+					r.String(),
+				)
+			}
+		}
+		if l.convs[s.GFcp.conv] == s {
+			delete(
+				l.convs,
+				s.GFcp.conv,
+			)
+		}
+		for key, pc := range l.challenges {
+			if pc.s == s {
+				delete(
+					l.challenges,
+					key,
+				)
+			}
+		}
 		return true
 	}
 	return false
@@ -1297,6 +1925,12 @@ func ServeConn(
 	l.sessions = make(
 		map[string]*UDPSession,
 	)
+	l.convs = make(
+		map[uint32]*UDPSession,
+	)
+	l.challenges = make(
+		map[string]*pathChallenge,
+	)
 	l.chAccepts = make(
 		chan *UDPSession,
 		acceptBacklog,
@@ -1309,18 +1943,53 @@ func ServeConn(
 	)
 	l.dataShards = dataShards
 	l.parityShards = parityShards
+	l.memory = NewMemoryBudget(
+		0,
+	)
+	l.xconn,
+		l.offload = newBatchConn(
+		conn,
+	)
 	l.FecDecoder = NewFECDecoder(
 		rxFECMulti*(dataShards+parityShards),
 		dataShards,
 		parityShards,
 	)
-	if l.FecDecoder != nil {
-		l.headerSize += fecHeaderSizePlus2
-	}
 	go l.monitor()
 	return l, nil
 }
 
+// ServeConnWithFEC serves the GFcp protocol with versioned FEC, which
+// lets sessions change their shard layout, within the bounds of cfg if
+// they are adaptive. Sessions mirror the layout their client starts
+// with; version 0 FEC clients get the data and parity shards of cfg.
+func ServeConnWithFEC(
+	cfg *FECConfig,
+	conn net.PacketConn,
+) (
+	*Listener,
+	error,
+) {
+	c, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	l, err := ServeConn(
+		c.DataShards,
+		c.ParityShards,
+		conn,
+	)
+	if err != nil {
+		return nil, err
+	}
+	l.fec = &c
+	l.SetFECRxLimit(
+		c.RxLimit,
+		c.AutoRxLimit,
+	)
+	return l, nil
+}
+
 // Dial connects to the remote address "raddr" via "udp"
 func Dial(
 	raddr string,
@@ -1343,6 +2012,52 @@ func DialWithOptions(
 ) (
 	*UDPSession,
 	error,
+) {
+	conn, err := dialUDP(
+		raddr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(
+		raddr,
+		dataShards,
+		parityShards,
+		conn,
+	)
+}
+
+// DialWithFEC connects to the remote address "raddr" via "udp" with
+// versioned FEC.
+func DialWithFEC(
+	raddr string,
+	cfg *FECConfig,
+) (
+	*UDPSession,
+	error,
+) {
+	if _, err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	conn, err := dialUDP(
+		raddr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnWithFEC(
+		raddr,
+		cfg,
+		conn,
+	)
+}
+
+// dialUDP opens an unconnected UDP socket suitable to reach raddr.
+func dialUDP(
+	raddr string,
+) (
+	net.PacketConn,
+	error,
 ) {
 	udpaddr, err := net.ResolveUDPAddr(
 		"udp",
@@ -1368,33 +2083,67 @@ func DialWithOptions(
 			"net.DialUDP",
 		)
 	}
-	return NewConn(
+	return conn, nil
+}
+
+// NewConn establishes a session, talking GFcp over a packet connection.
+func NewConn(
+	raddr string,
+	dataShards,
+	parityShards int,
+	conn net.PacketConn,
+) (
+	*UDPSession,
+	error,
+) {
+	return newConn(
 		raddr,
 		dataShards,
 		parityShards,
+		nil,
 		conn,
 	)
 }
 
-// NewConn establishes a session, talking GFcp over a packet connection.
-func NewConn(
+// NewConnWithFEC establishes a session with versioned FEC, talking
+// GFcp over a packet connection.
+func NewConnWithFEC(
+	raddr string,
+	cfg *FECConfig,
+	conn net.PacketConn,
+) (
+	*UDPSession,
+	error,
+) {
+	c, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(
+		raddr,
+		c.DataShards,
+		c.ParityShards,
+		&c,
+		conn,
+	)
+}
+
+func newConn(
 	raddr string,
 	dataShards,
 	parityShards int,
+	fec *FECConfig,
 	conn net.PacketConn,
 ) (
 	*UDPSession,
 	error,
 ) {
-	udpaddr, err := net.ResolveUDPAddr(
-		"udp",
+	remote, err := resolveAddr(
+		conn,
 		raddr,
 	)
 	if err != nil {
-		return nil, errors.Wrap(
-			err,
-			"net.ResolveUDPAddr",
-		)
+		return nil, err
 	}
 	var convid uint32
 	err = binary.Read(
@@ -1411,15 +2160,57 @@ func NewConn(
 		convid,
 		dataShards,
 		parityShards,
+		fec,
 		nil,
 		conn,
-		udpaddr,
+		remote,
 	), nil
 }
 
-var refTime = time.Now()
-
-// CurrentMs ...
-func CurrentMs() uint32 {
-	return uint32(time.Since(refTime) / time.Millisecond)
+// resolveAddr resolves raddr in the address space of conn; anything
+// that is neither a unixgram socket nor has its own resolver is
+// assumed to speak UDP.
+func resolveAddr(
+	conn net.PacketConn,
+	raddr string,
+) (
+	net.Addr,
+	error,
+) {
+	if r, ok := conn.(addrResolver); ok {
+		addr, err := r.ResolveAddr(
+			raddr,
+		)
+		if err != nil {
+			return nil, errors.Wrap(
+				err,
+				"ResolveAddr",
+			)
+		}
+		return addr, nil
+	}
+	if conn.LocalAddr().Network() == "unixgram" {
+		unixaddr, err := net.ResolveUnixAddr(
+			"unixgram",
+			raddr,
+		)
+		if err != nil {
+			return nil, errors.Wrap(
+				err,
+				"net.ResolveUnixAddr",
+			)
+		}
+		return unixaddr, nil
+	}
+	udpaddr, err := net.ResolveUDPAddr(
+		"udp",
+		raddr,
+	)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"net.ResolveUDPAddr",
+		)
+	}
+	return udpaddr, nil
 }
@@ -31,6 +31,7 @@ const (
 	portSink           = "127.0.0.1:19609"
 	portTinyBufferEcho = "127.0.0.1:29609"
 	portListerner      = "127.0.0.1:9078"
+	portUpdater        = "127.0.0.1:9077"
 )
 
 func init() {
@@ -1082,3 +1083,348 @@ func TestListenerClose(
 		t.Fail()
 	}
 }
+
+func TestPrivateUpdater(
+	t *testing.T,
+) {
+	defer u.Leakplug(
+		t,
+	)
+	updater := gfcp.NewUpdater(
+		2,
+	)
+	defer updater.Close()
+	if updater.Shards() != 2 {
+		t.Fatal(
+			updater.Shards(),
+		)
+	}
+	l, err := gfcp.ListenWithOptions(
+		portUpdater,
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	l.SetUpdater(
+		updater,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetDeadline(
+			time.Now().Add(
+				5 * time.Second,
+			),
+		)
+		buf := make(
+			[]byte,
+			64,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := gfcp.DialWithOptions(
+		portUpdater,
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli.SetUpdater(
+		updater,
+	)
+	if err := echoTester(
+		cli,
+		64,
+		16,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if updater.Len() != 2 {
+		t.Fatal(
+			updater.Len(),
+		)
+	}
+	cli.Close()
+}
+
+// TestSetUpdaterRace moves both ends of a connection between Updaters
+// while they exchange data; run it with -race.
+func TestSetUpdaterRace(
+	t *testing.T,
+) {
+	updaters := []*gfcp.Updater{
+		gfcp.NewUpdater(
+			1,
+		),
+		gfcp.NewUpdater(
+			3,
+		),
+	}
+	for _, updater := range updaters {
+		defer updater.Close()
+	}
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := make(
+		chan *gfcp.UDPSession,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			close(
+				accepted,
+			)
+			return
+		}
+		accepted <- s
+		defer s.Close()
+		buf := make(
+			[]byte,
+			1024,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(
+		1,
+		10,
+		2,
+		1,
+	)
+	cli.SetDeadline(
+		time.Now().Add(
+			20 * time.Second,
+		),
+	)
+	done := make(
+		chan struct{},
+	)
+	moved := make(
+		chan struct{},
+	)
+	go func() {
+		defer close(
+			moved,
+		)
+		srv := <-accepted
+		if srv == nil {
+			return
+		}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cli.SetUpdater(
+				updaters[i%2],
+			)
+			srv.SetUpdater(
+				updaters[(i+1)%2],
+			)
+		}
+	}()
+	if err := echoTester(
+		cli,
+		256,
+		2048,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	close(
+		done,
+	)
+	<-moved
+}
+
+func TestSendBufferLimit(
+	t *testing.T,
+) {
+	const limit = 16 * 1024
+	network := gfcp.NewMemNetwork()
+	l, err := network.Listen(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer l.Close()
+	accepted := make(
+		chan *gfcp.UDPSession,
+		1,
+	)
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err == nil {
+			accepted <- s
+		}
+	}()
+	cli, err := network.Dial(
+		"server",
+		0,
+		0,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer cli.Close()
+	cli.SetSendBufferLimit(
+		limit,
+	)
+	if n := cli.SendBufferAvailable(); n != limit {
+		t.Fatalf(
+			"%v bytes available, want %v",
+			n,
+			limit,
+		)
+	}
+	// more than the receive window: the server reads nothing, so the
+	// send buffer fills, and the write stops part way
+	data := make(
+		[]byte,
+		512*1024,
+	)
+	cli.SetWriteDeadline(
+		time.Now().Add(
+			time.Second,
+		),
+	)
+	n, err := cli.Write(
+		data,
+	)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || n == 0 || n >= len(data) {
+		t.Fatalf(
+			"Write: %v bytes, %v",
+			n,
+			err,
+		)
+	}
+	if avail := cli.SendBufferAvailable(); avail != 0 {
+		t.Fatalf(
+			"%v bytes available with the send buffer full",
+			avail,
+		)
+	}
+	writable := make(
+		chan int,
+		1,
+	)
+	cli.OnWritable(
+		func(
+			available int,
+		) {
+			writable <- available
+		},
+	)
+	s := <-accepted
+	defer s.Close()
+	s.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Second,
+		),
+	)
+	if _, err := io.ReadFull(
+		s,
+		make(
+			[]byte,
+			n,
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	select {
+	case available := <-writable:
+		if available <= 0 {
+			t.Fatalf(
+				"OnWritable with %v bytes available",
+				available,
+			)
+		}
+	case <-time.After(
+		10 * time.Second,
+	):
+		t.Fatal(
+			"OnWritable not called",
+		)
+	}
+	// once all is acknowledged, the whole buffer is free again
+	for deadline := time.Now().Add(
+		10 * time.Second,
+	); cli.SendBufferAvailable() != limit; time.Sleep(
+		10 * time.Millisecond,
+	) {
+		if time.Now().After(
+			deadline,
+		) {
+			t.Fatalf(
+				"%v bytes available, want %v",
+				cli.SendBufferAvailable(),
+				limit,
+			)
+		}
+	}
+}
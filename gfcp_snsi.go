@@ -41,6 +41,19 @@ type Snsi struct {
 	GFcpFailures                    uint64 // Incorrect packets recovered from FEC
 	GFcpFECParityShards             uint64 // FEC KSegments received
 	GFcpFECRuntShards               uint64 // Number of data shards insufficient for recovery
+	GFcpGSOPackets                  uint64 // Super-packets sent via UDP GSO
+	GFcpGROPackets                  uint64 // Super-packets received via UDP GRO
+	GFcpPathChallenges              uint64 // Path validation challenges sent to a new client address
+	GFcpMigrations                  uint64 // Sessions moved to a validated new client address
+	GFcpFECExpiredShards            uint64 // FEC data shards dropped for age
+	GFcpFECRejects                  uint64 // Clients refused for their FEC settings
+	GFcpSendBufferBytes             uint64 // Bytes held in send buffers
+	GFcpReceiveBufferBytes          uint64 // Bytes held in receive buffers
+	GFcpFECBufferBytes              uint64 // Bytes held in FEC receive buffers
+	GFcpMaxSessionsRejects          uint64 // New sessions refused at MaxSessions
+	GFcpSessionRateRejects          uint64 // New sessions refused by IP or subnet rate limits
+	GFcpPacketRateDrops             uint64 // Packets dropped by session rate limits
+	GFcpReplyRateDrops              uint64 // Replies to unknown addresses withheld by IP or subnet rate limits
 }
 
 func newSnsi() *Snsi {
@@ -78,6 +91,19 @@ func (
 		"GFcpFailures",
 		"GFcpFECRecovered",
 		"GFcpFECRuntShards",
+		"GFcpGSOPackets",
+		"GFcpGROPackets",
+		"GFcpPathChallenges",
+		"GFcpMigrations",
+		"GFcpFECExpiredShards",
+		"GFcpFECRejects",
+		"GFcpSendBufferBytes",
+		"GFcpReceiveBufferBytes",
+		"GFcpFECBufferBytes",
+		"GFcpMaxSessionsRejects",
+		"GFcpSessionRateRejects",
+		"GFcpPacketRateDrops",
+		"GFcpReplyRateDrops",
 	}
 }
 
@@ -159,6 +185,45 @@ func (
 		fmt.Sprint(
 			snsi.GFcpFECRuntShards,
 		),
+		fmt.Sprint(
+			snsi.GFcpGSOPackets,
+		),
+		fmt.Sprint(
+			snsi.GFcpGROPackets,
+		),
+		fmt.Sprint(
+			snsi.GFcpPathChallenges,
+		),
+		fmt.Sprint(
+			snsi.GFcpMigrations,
+		),
+		fmt.Sprint(
+			snsi.GFcpFECExpiredShards,
+		),
+		fmt.Sprint(
+			snsi.GFcpFECRejects,
+		),
+		fmt.Sprint(
+			snsi.GFcpSendBufferBytes,
+		),
+		fmt.Sprint(
+			snsi.GFcpReceiveBufferBytes,
+		),
+		fmt.Sprint(
+			snsi.GFcpFECBufferBytes,
+		),
+		fmt.Sprint(
+			snsi.GFcpMaxSessionsRejects,
+		),
+		fmt.Sprint(
+			snsi.GFcpSessionRateRejects,
+		),
+		fmt.Sprint(
+			snsi.GFcpPacketRateDrops,
+		),
+		fmt.Sprint(
+			snsi.GFcpReplyRateDrops,
+		),
 	}
 }
 
@@ -239,6 +304,45 @@ func (
 	d.GFcpFECRuntShards = atomic.LoadUint64(
 		&s.GFcpFECRuntShards,
 	)
+	d.GFcpGSOPackets = atomic.LoadUint64(
+		&s.GFcpGSOPackets,
+	)
+	d.GFcpGROPackets = atomic.LoadUint64(
+		&s.GFcpGROPackets,
+	)
+	d.GFcpPathChallenges = atomic.LoadUint64(
+		&s.GFcpPathChallenges,
+	)
+	d.GFcpMigrations = atomic.LoadUint64(
+		&s.GFcpMigrations,
+	)
+	d.GFcpFECExpiredShards = atomic.LoadUint64(
+		&s.GFcpFECExpiredShards,
+	)
+	d.GFcpFECRejects = atomic.LoadUint64(
+		&s.GFcpFECRejects,
+	)
+	d.GFcpSendBufferBytes = atomic.LoadUint64(
+		&s.GFcpSendBufferBytes,
+	)
+	d.GFcpReceiveBufferBytes = atomic.LoadUint64(
+		&s.GFcpReceiveBufferBytes,
+	)
+	d.GFcpFECBufferBytes = atomic.LoadUint64(
+		&s.GFcpFECBufferBytes,
+	)
+	d.GFcpMaxSessionsRejects = atomic.LoadUint64(
+		&s.GFcpMaxSessionsRejects,
+	)
+	d.GFcpSessionRateRejects = atomic.LoadUint64(
+		&s.GFcpSessionRateRejects,
+	)
+	d.GFcpPacketRateDrops = atomic.LoadUint64(
+		&s.GFcpPacketRateDrops,
+	)
+	d.GFcpReplyRateDrops = atomic.LoadUint64(
+		&s.GFcpReplyRateDrops,
+	)
 	return d
 }
 
@@ -340,6 +444,47 @@ func (s *Snsi) Reset() {
 		&s.GFcpFECRuntShards,
 		0,
 	)
+	atomic.StoreUint64(
+		&s.GFcpGSOPackets,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpGROPackets,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpPathChallenges,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpMigrations,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpFECExpiredShards,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpFECRejects,
+		0,
+	)
+	// the buffer gauges follow sessions, and are not reset
+	atomic.StoreUint64(
+		&s.GFcpMaxSessionsRejects,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpSessionRateRejects,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpPacketRateDrops,
+		0,
+	)
+	atomic.StoreUint64(
+		&s.GFcpReplyRateDrops,
+		0,
+	)
 }
 
 // DefaultSnsi is the GFCP default statistics collector
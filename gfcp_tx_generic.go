@@ -0,0 +1,40 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package gfcp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// newBatchConn reports no batch I/O or segmentation offload support.
+func newBatchConn(
+	conn net.PacketConn,
+) (
+	batchConn,
+	*offloadState,
+) {
+	return nil, nil
+}
+
+func (
+	s *UDPSession,
+) tx(
+	txqueue []ipv4.Message,
+) {
+	s.defaultTx(
+		txqueue,
+	)
+}
@@ -0,0 +1,438 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package gfcp
+
+import (
+	"net"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	gsoMaxSegments = 64    // UDP_MAX_SEGMENTS in the kernel
+	gsoMaxSize     = 65000 // keep super-packets below the UDP datagram limit
+	groBufSize     = 65535 // largest datagram GRO may hand us
+)
+
+// newBatchConn wraps conn for sendmmsg/recvmmsg, and probes the socket
+// for UDP_SEGMENT, enabling UDP_GRO where the kernel supports it.
+func newBatchConn(
+	conn net.PacketConn,
+) (
+	batchConn,
+	*offloadState,
+) {
+	udpconn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, nil
+	}
+	addr, _ := net.ResolveUDPAddr(
+		"udp",
+		udpconn.LocalAddr().String(),
+	)
+	var xconn batchConn
+	if addr.IP.To4() != nil {
+		xconn = ipv4.NewPacketConn(
+			udpconn,
+		)
+	} else {
+		xconn = ipv6.NewPacketConn(
+			udpconn,
+		)
+	}
+	offload := new(
+		offloadState,
+	)
+	rawconn, err := udpconn.SyscallConn()
+	if err != nil {
+		return xconn, offload
+	}
+	_ = rawconn.Control(
+		func(
+			fd uintptr,
+		) {
+			if _, err := unix.GetsockoptInt(
+				int(fd),
+				unix.IPPROTO_UDP,
+				unix.UDP_SEGMENT,
+			); err == nil {
+				offload.gso = 1
+			}
+			if err := unix.SetsockoptInt(
+				int(fd),
+				unix.IPPROTO_UDP,
+				unix.UDP_GRO,
+				1,
+			); err == nil {
+				offload.gro = 1
+			}
+		},
+	)
+	return xconn, offload
+}
+
+func (
+	o *offloadState,
+) gsoEnabled() bool {
+	return o != nil && atomic.LoadInt32(
+		&o.gso,
+	) == 1
+}
+
+func (
+	o *offloadState,
+) groEnabled() bool {
+	return o != nil && atomic.LoadInt32(
+		&o.gro,
+	) == 1
+}
+
+// isGSOError reports whether err means the kernel or the NIC refused
+// a segmented send, in which case we stop using GSO on the socket.
+func isGSOError(
+	err error,
+) bool {
+	var serr *net.OpError
+	if errors.As(
+		err,
+		&serr,
+	) {
+		var errno unix.Errno
+		if errors.As(
+			serr.Err,
+			&errno,
+		) {
+			return errno == unix.EIO || errno == unix.EINVAL ||
+				errno == unix.EOPNOTSUPP
+		}
+	}
+	return false
+}
+
+func (
+	s *UDPSession,
+) tx(
+	txqueue []ipv4.Message,
+) {
+	if s.xconn == nil {
+		s.defaultTx(
+			txqueue,
+		)
+		return
+	}
+	msgs := txqueue
+	if s.offload.gsoEnabled() {
+		msgs = gsoCoalesce(
+			txqueue,
+		)
+	}
+	nbytes := 0
+	npkts := 0
+	nsuper := 0
+	for len(
+		msgs,
+	) > 0 {
+		n, err := s.xconn.WriteBatch(
+			msgs,
+			0,
+		)
+		if n < 0 {
+			n = 0
+		}
+		for k := range msgs[:n] {
+			segs, size := gsoCount(
+				&msgs[k],
+			)
+			if segs > 1 {
+				nsuper++
+			}
+			npkts += segs
+			nbytes += size
+		}
+		msgs = msgs[n:]
+		if err != nil {
+			if len(
+				msgs,
+			) > 0 && len(
+				msgs[0].OOB,
+			) > 0 && isGSOError(
+				err,
+			) {
+				// msgs[0] failed; fall back to plain batched writes for
+				// it and the rest, as the first n went out
+				atomic.StoreInt32(
+					&s.offload.gso,
+					0,
+				)
+				msgs = gsoSplit(
+					msgs,
+				)
+				continue
+			}
+			s.notifyWriteError(
+				err,
+			)
+			break
+		}
+	}
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpOutputPackets,
+		uint64(
+			npkts,
+		),
+	)
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpOutputBytes,
+		uint64(
+			nbytes,
+		),
+	)
+	if nsuper > 0 {
+		atomic.AddUint64(
+			&DefaultSnsi.GFcpGSOPackets,
+			uint64(
+				nsuper,
+			),
+		)
+	}
+}
+
+// gsoCoalesce merges runs of same-sized packets bound for the same
+// address into super-packets carrying a UDP_SEGMENT control message.
+// Only the last packet of a run may be shorter than the others.
+func gsoCoalesce(
+	txqueue []ipv4.Message,
+) []ipv4.Message {
+	var out []ipv4.Message
+	for i := 0; i < len(
+		txqueue,
+	); {
+		first := txqueue[i].Buffers[0]
+		segsz := len(
+			first,
+		)
+		total := segsz
+		j := i + 1
+		for ; j < len(
+			txqueue,
+		) && j-i < gsoMaxSegments; j++ {
+			next := txqueue[j].Buffers[0]
+			if txqueue[j].Addr != txqueue[i].Addr ||
+				len(next) > segsz || total+len(next) > gsoMaxSize {
+				break
+			}
+			total += len(
+				next,
+			)
+			if len(
+				next,
+			) < segsz {
+				j++
+				break
+			}
+		}
+		msg := ipv4.Message{
+			Addr: txqueue[i].Addr,
+		}
+		if j-i == 1 {
+			msg.Buffers = txqueue[i].Buffers
+		} else {
+			msg.Buffers = make(
+				[][]byte,
+				0,
+				j-i,
+			)
+			for k := i; k < j; k++ {
+				msg.Buffers = append(
+					msg.Buffers,
+					txqueue[k].Buffers[0],
+				)
+			}
+			msg.OOB = gsoControl(
+				segsz,
+			)
+		}
+		out = append(
+			out,
+			msg,
+		)
+		i = j
+	}
+	return out
+}
+
+// gsoSplit undoes gsoCoalesce.
+func gsoSplit(
+	msgs []ipv4.Message,
+) []ipv4.Message {
+	var out []ipv4.Message
+	for k := range msgs {
+		for _, b := range msgs[k].Buffers {
+			out = append(
+				out,
+				ipv4.Message{
+					Buffers: [][]byte{
+						b,
+					},
+					Addr: msgs[k].Addr,
+				},
+			)
+		}
+	}
+	return out
+}
+
+func gsoCount(
+	msg *ipv4.Message,
+) (
+	segs,
+	size int,
+) {
+	for _, b := range msg.Buffers {
+		size += len(
+			b,
+		)
+	}
+	return len(
+		msg.Buffers,
+	), size
+}
+
+func gsoControl(
+	segsz int,
+) []byte {
+	oob := make(
+		[]byte,
+		unix.CmsgSpace(
+			2,
+		),
+	)
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(
+		unix.CmsgLen(
+			2,
+		),
+	)
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(
+		segsz,
+	)
+	return oob
+}
+
+// groSegmentSize returns the segment size of a GRO super-packet, or 0
+// when msg holds a single datagram.
+func groSegmentSize(
+	msg *ipv4.Message,
+) int {
+	if msg.NN == 0 {
+		return 0
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(
+		msg.OOB[:msg.NN],
+	)
+	if err != nil {
+		return 0
+	}
+	for k := range cmsgs {
+		if cmsgs[k].Header.Level == unix.IPPROTO_UDP &&
+			cmsgs[k].Header.Type == unix.UDP_GRO &&
+			len(cmsgs[k].Data) >= 4 {
+			return int(
+				*(*int32)(unsafe.Pointer(&cmsgs[k].Data[0])),
+			)
+		}
+	}
+	return 0
+}
+
+// groSplit calls fn once for every datagram carried by msg.
+func groSplit(
+	msg *ipv4.Message,
+	fn func(
+		[]byte,
+	),
+) {
+	buf := msg.Buffers[0][:msg.N]
+	segsz := groSegmentSize(
+		msg,
+	)
+	if segsz <= 0 || segsz >= len(
+		buf,
+	) {
+		fn(
+			buf,
+		)
+		return
+	}
+	atomic.AddUint64(
+		&DefaultSnsi.GFcpGROPackets,
+		1,
+	)
+	for len(
+		buf,
+	) > 0 {
+		n := segsz
+		if n > len(
+			buf,
+		) {
+			n = len(
+				buf,
+			)
+		}
+		fn(
+			buf[:n],
+		)
+		buf = buf[n:]
+	}
+}
+
+// newReadBatch allocates receive buffers, sized for GRO when enabled.
+func newReadBatch(
+	offload *offloadState,
+) []ipv4.Message {
+	size := GFcpMtuLimit
+	var oobsize int
+	if offload.groEnabled() {
+		size = groBufSize
+		oobsize = unix.CmsgSpace(
+			4,
+		)
+	}
+	msgs := make(
+		[]ipv4.Message,
+		batchSize,
+	)
+	for k := range msgs {
+		msgs[k].Buffers = [][]byte{
+			make(
+				[]byte,
+				size,
+			),
+		}
+		if oobsize > 0 {
+			msgs[k].OOB = make(
+				[]byte,
+				oobsize,
+			)
+		}
+	}
+	return msgs
+}
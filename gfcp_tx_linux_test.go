@@ -0,0 +1,528 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package gfcp
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	gsoAddrA = &net.UDPAddr{
+		IP: net.IPv4(
+			127,
+			0,
+			0,
+			1,
+		),
+		Port: 1,
+	}
+	gsoAddrB = &net.UDPAddr{
+		IP: net.IPv4(
+			127,
+			0,
+			0,
+			1,
+		),
+		Port: 2,
+	}
+)
+
+// gsoPacket is a packet of size bytes for addr; n repeats it.
+type gsoPacket struct {
+	addr net.Addr
+	size int
+	n    int
+}
+
+// gsoQueue builds a transmit queue of distinct buffers.
+func gsoQueue(
+	packets []gsoPacket,
+) []ipv4.Message {
+	var txqueue []ipv4.Message
+	for _, p := range packets {
+		for i := 0; i < p.n; i++ {
+			txqueue = append(
+				txqueue,
+				ipv4.Message{
+					Buffers: [][]byte{
+						make(
+							[]byte,
+							p.size,
+						),
+					},
+					Addr: p.addr,
+				},
+			)
+		}
+	}
+	return txqueue
+}
+
+// gsoSegmentSize returns the UDP_SEGMENT size of msg, or 0 without one.
+func gsoSegmentSize(
+	msg *ipv4.Message,
+) int {
+	if len(
+		msg.OOB,
+	) == 0 {
+		return 0
+	}
+	return int(
+		*(*uint16)(unsafe.Pointer(&msg.OOB[unix.CmsgLen(0)])),
+	)
+}
+
+func TestGSOCoalesce(
+	t *testing.T,
+) {
+	// want holds the segments of each message, and their size if the
+	// message carries UDP_SEGMENT
+	type want struct {
+		segs,
+		segsz int
+	}
+	for _, tc := range []struct {
+		name    string
+		packets []gsoPacket
+		want    []want
+	}{
+		{
+			"short tail",
+			[]gsoPacket{
+				{gsoAddrA, 1000, 3},
+				{gsoAddrA, 500, 1},
+			},
+			[]want{
+				{4, 1000},
+			},
+		},
+		{
+			"short middle",
+			[]gsoPacket{
+				{gsoAddrA, 1000, 2},
+				{gsoAddrA, 500, 1},
+				{gsoAddrA, 1000, 2},
+			},
+			[]want{
+				{3, 1000},
+				{2, 1000},
+			},
+		},
+		{
+			"longer after shorter",
+			[]gsoPacket{
+				{gsoAddrA, 500, 1},
+				{gsoAddrA, 1000, 1},
+			},
+			[]want{
+				{1, 0},
+				{1, 0},
+			},
+		},
+		{
+			"destination change",
+			[]gsoPacket{
+				{gsoAddrA, 1000, 2},
+				{gsoAddrB, 1000, 3},
+				{gsoAddrA, 1000, 1},
+			},
+			[]want{
+				{2, 1000},
+				{3, 1000},
+				{1, 0},
+			},
+		},
+		{
+			"segment limit",
+			[]gsoPacket{
+				{gsoAddrA, 100, gsoMaxSegments + 6},
+			},
+			[]want{
+				{gsoMaxSegments, 100},
+				{6, 100},
+			},
+		},
+		{
+			"size limit",
+			[]gsoPacket{
+				{gsoAddrA, 1400, 60},
+			},
+			[]want{
+				{gsoMaxSize / 1400, 1400},
+				{60 - gsoMaxSize/1400, 1400},
+			},
+		},
+	} {
+		t.Run(
+			tc.name,
+			func(
+				t *testing.T,
+			) {
+				txqueue := gsoQueue(
+					tc.packets,
+				)
+				msgs := gsoCoalesce(
+					txqueue,
+				)
+				if len(
+					msgs,
+				) != len(
+					tc.want,
+				) {
+					t.Fatalf(
+						"%v messages, want %v",
+						len(msgs),
+						len(tc.want),
+					)
+				}
+				for k := range msgs {
+					segs, size := gsoCount(
+						&msgs[k],
+					)
+					if segs != tc.want[k].segs || gsoSegmentSize(
+						&msgs[k],
+					) != tc.want[k].segsz {
+						t.Fatalf(
+							"message %v: %v segments of %v, want %v of %v",
+							k,
+							segs,
+							gsoSegmentSize(&msgs[k]),
+							tc.want[k].segs,
+							tc.want[k].segsz,
+						)
+					}
+					if size > gsoMaxSize {
+						t.Fatalf(
+							"message %v: %v bytes",
+							k,
+							size,
+						)
+					}
+				}
+				split := gsoSplit(
+					msgs,
+				)
+				if len(
+					split,
+				) != len(
+					txqueue,
+				) {
+					t.Fatalf(
+						"%v packets split, want %v",
+						len(split),
+						len(txqueue),
+					)
+				}
+				for k := range split {
+					if &split[k].Buffers[0][:1][0] != &txqueue[k].Buffers[0][:1][0] ||
+						split[k].Addr != txqueue[k].Addr {
+						t.Fatalf(
+							"packet %v split out of order",
+							k,
+						)
+					}
+				}
+			},
+		)
+	}
+}
+
+// groMessage returns a received message of size bytes, carrying a
+// UDP_GRO segment size unless segsz is 0.
+func groMessage(
+	size,
+	segsz int,
+) *ipv4.Message {
+	msg := &ipv4.Message{
+		Buffers: [][]byte{
+			make(
+				[]byte,
+				groBufSize,
+			),
+		},
+		N: size,
+	}
+	if segsz > 0 {
+		msg.OOB = make(
+			[]byte,
+			unix.CmsgSpace(
+				4,
+			),
+		)
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&msg.OOB[0]))
+		h.Level = unix.IPPROTO_UDP
+		h.Type = unix.UDP_GRO
+		h.SetLen(
+			unix.CmsgLen(
+				4,
+			),
+		)
+		*(*int32)(unsafe.Pointer(&msg.OOB[unix.CmsgLen(0)])) = int32(
+			segsz,
+		)
+		msg.NN = len(
+			msg.OOB,
+		)
+	}
+	return msg
+}
+
+func TestGROSplit(
+	t *testing.T,
+) {
+	for _, tc := range []struct {
+		name  string
+		size  int
+		segsz int
+		want  []int
+		super uint64
+	}{
+		{
+			"single",
+			1000,
+			0,
+			[]int{1000},
+			0,
+		},
+		{
+			"even",
+			3000,
+			1000,
+			[]int{1000, 1000, 1000},
+			1,
+		},
+		{
+			"short last",
+			2500,
+			1000,
+			[]int{1000, 1000, 500},
+			1,
+		},
+		{
+			"one segment",
+			800,
+			1000,
+			[]int{800},
+			0,
+		},
+	} {
+		t.Run(
+			tc.name,
+			func(
+				t *testing.T,
+			) {
+				gro := atomic.LoadUint64(
+					&DefaultSnsi.GFcpGROPackets,
+				)
+				var got []int
+				groSplit(
+					groMessage(
+						tc.size,
+						tc.segsz,
+					),
+					func(
+						data []byte,
+					) {
+						got = append(
+							got,
+							len(data),
+						)
+					},
+				)
+				if len(
+					got,
+				) != len(
+					tc.want,
+				) {
+					t.Fatalf(
+						"datagrams %v, want %v",
+						got,
+						tc.want,
+					)
+				}
+				for k := range got {
+					if got[k] != tc.want[k] {
+						t.Fatalf(
+							"datagrams %v, want %v",
+							got,
+							tc.want,
+						)
+					}
+				}
+				if d := atomic.LoadUint64(
+					&DefaultSnsi.GFcpGROPackets,
+				) - gro; d != tc.super {
+					t.Fatalf(
+						"GFcpGROPackets grew by %v, want %v",
+						d,
+						tc.super,
+					)
+				}
+			},
+		)
+	}
+}
+
+// gsoFailConn sends every message, except that it refuses the first
+// one carrying UDP_SEGMENT after fail messages, as a NIC without GSO
+// would.
+type gsoFailConn struct {
+	fail   int
+	failed bool
+	sent   [][]byte
+}
+
+func (
+	c *gsoFailConn,
+) WriteBatch(
+	ms []ipv4.Message,
+	flags int,
+) (
+	int,
+	error,
+) {
+	for k := range ms {
+		if len(
+			ms[k].OOB,
+		) > 0 && !c.failed && len(
+			c.sent,
+		) >= c.fail {
+			c.failed = true
+			return k, &net.OpError{
+				Op:  "write",
+				Net: "udp",
+				Err: os.NewSyscallError(
+					"sendmmsg",
+					unix.EIO,
+				),
+			}
+		}
+		c.sent = append(
+			c.sent,
+			ms[k].Buffers...,
+		)
+	}
+	return len(
+		ms,
+	), nil
+}
+
+func (
+	c *gsoFailConn,
+) ReadBatch(
+	ms []ipv4.Message,
+	flags int,
+) (
+	int,
+	error,
+) {
+	return 0, nil
+}
+
+func TestGSOFallback(
+	t *testing.T,
+) {
+	conn := &gsoFailConn{
+		fail: 1,
+	}
+	s := &UDPSession{
+		xconn: conn,
+		offload: &offloadState{
+			gso: 1,
+		},
+	}
+	// a lone packet sent as is, then a run refused as a super-packet
+	txqueue := gsoQueue(
+		[]gsoPacket{
+			{gsoAddrA, 500, 1},
+			{gsoAddrA, 1000, 4},
+		},
+	)
+	packets := atomic.LoadUint64(
+		&DefaultSnsi.GFcpOutputPackets,
+	)
+	gso := atomic.LoadUint64(
+		&DefaultSnsi.GFcpGSOPackets,
+	)
+	s.tx(
+		txqueue,
+	)
+	if s.offload.gsoEnabled() {
+		t.Fatal(
+			"GSO still enabled after a refused send",
+		)
+	}
+	if len(
+		conn.sent,
+	) != len(
+		txqueue,
+	) {
+		t.Fatalf(
+			"%v packets sent, want %v",
+			len(conn.sent),
+			len(txqueue),
+		)
+	}
+	for k := range conn.sent {
+		if &conn.sent[k][:1][0] != &txqueue[k].Buffers[0][:1][0] {
+			t.Fatalf(
+				"packet %v sent out of order, or twice",
+				k,
+			)
+		}
+	}
+	if d := atomic.LoadUint64(
+		&DefaultSnsi.GFcpOutputPackets,
+	) - packets; d != uint64(
+		len(txqueue),
+	) {
+		t.Fatalf(
+			"GFcpOutputPackets grew by %v, want %v",
+			d,
+			len(txqueue),
+		)
+	}
+	if d := atomic.LoadUint64(
+		&DefaultSnsi.GFcpGSOPackets,
+	) - gso; d != 0 {
+		t.Fatalf(
+			"GFcpGSOPackets grew by %v, want 0",
+			d,
+		)
+	}
+	// and sent as super-packets while GSO works
+	conn = &gsoFailConn{
+		fail: 1 << 30,
+	}
+	s.xconn = conn
+	s.offload.gso = 1
+	s.tx(
+		txqueue,
+	)
+	if d := atomic.LoadUint64(
+		&DefaultSnsi.GFcpGSOPackets,
+	) - gso; d != 1 {
+		t.Fatalf(
+			"GFcpGSOPackets grew by %v, want 1",
+			d,
+		)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// unixConn is a unixgram socket bound to a path we created; the path
+// is removed when the socket is closed.
+type unixConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (
+	c *unixConn,
+) Close() error {
+	err := c.UnixConn.Close()
+	os.Remove(
+		c.path,
+	)
+	return err
+}
+
+func listenUnixgram(
+	path string,
+) (
+	*unixConn,
+	error,
+) {
+	addr, err := net.ResolveUnixAddr(
+		"unixgram",
+		path,
+	)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"net.ResolveUnixAddr",
+		)
+	}
+	conn, err := net.ListenUnixgram(
+		"unixgram",
+		addr,
+	)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"net.ListenUnixgram",
+		)
+	}
+	return &unixConn{
+		UnixConn: conn,
+		path:     path,
+	}, nil
+}
+
+// ListenUnix listens for incoming GFcp packets on the unixgram socket
+// at path laddr, which is removed when the Listener is closed.
+func ListenUnix(
+	laddr string,
+	dataShards,
+	parityShards int,
+) (
+	*Listener,
+	error,
+) {
+	conn, err := listenUnixgram(
+		laddr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ServeConn(
+		dataShards,
+		parityShards,
+		conn,
+	)
+}
+
+// DialUnix connects to the unixgram socket at path raddr. Replies are
+// received on a socket bound to a temporary path, which is removed
+// when the session is closed.
+func DialUnix(
+	raddr string,
+	dataShards,
+	parityShards int,
+) (
+	*UDPSession,
+	error,
+) {
+	var rnd [8]byte
+	if _, err := rand.Read(
+		rnd[:],
+	); err != nil {
+		return nil, errors.Wrap(
+			err,
+			"rand.Read",
+		)
+	}
+	conn, err := listenUnixgram(
+		filepath.Join(
+			os.TempDir(),
+			"gfcp-"+strconv.Itoa(os.Getpid())+"-"+hex.EncodeToString(rnd[:])+".sock",
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := NewConn(
+		raddr,
+		dataShards,
+		parityShards,
+		conn,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
@@ -0,0 +1,109 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+func TestUnixgram(
+	t *testing.T,
+) {
+	if runtime.GOOS == "windows" {
+		t.Skip(
+			"unixgram is not supported on windows",
+		)
+	}
+	path := filepath.Join(
+		t.TempDir(),
+		"gfcp.sock",
+	)
+	l, err := gfcp.ListenUnix(
+		path,
+		10,
+		3,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	go func() {
+		s, err := l.AcceptGFCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		buf := make(
+			[]byte,
+			1024,
+		)
+		for {
+			n, err := s.Read(
+				buf,
+			)
+			if err != nil {
+				return
+			}
+			s.Write(
+				buf[:n],
+			)
+		}
+	}()
+	cli, err := gfcp.DialUnix(
+		path,
+		10,
+		3,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	cli.SetDeadline(
+		time.Now().Add(
+			5 * time.Second,
+		),
+	)
+	if err := echoTester(
+		cli,
+		1024,
+		128,
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	local := cli.LocalAddr().String()
+	cli.Close()
+	l.Close()
+	for _, p := range []string{
+		local,
+		path,
+	} {
+		if _, err := os.Stat(
+			p,
+		); !os.IsNotExist(
+			err,
+		) {
+			t.Fatal(
+				"socket not removed:",
+				p,
+			)
+		}
+	}
+}
@@ -12,15 +12,189 @@ package gfcp
 
 import (
 	"container/heap"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var updater updateHeap
+// updateIdleInterval is how often a session with nothing to send,
+// acknowledge or retransmit is updated; input and writes wake it early.
+const updateIdleInterval = 5 * time.Second
+
+var defaultUpdater atomic.Value
 
 func init() {
-	updater.init()
-	go updater.updateTask()
+	defaultUpdater.Store(
+		NewUpdater(
+			0,
+		),
+	)
+}
+
+// DefaultUpdater returns the Updater used by new sessions when none
+// has been set on their Listener.
+func DefaultUpdater() *Updater {
+	return defaultUpdater.Load().(*Updater)
+}
+
+// SetDefaultUpdater replaces the Updater used by sessions created
+// from now on. Existing sessions stay with the Updater they are on.
+func SetDefaultUpdater(
+	u *Updater,
+) {
+	if u != nil {
+		defaultUpdater.Store(
+			u,
+		)
+	}
+}
+
+// Updater schedules the periodic flushing of sessions. Sessions are
+// hashed by conversation ID across several shards, each of which is a
+// timer heap serviced by its own goroutine.
+type Updater struct {
+	shards  []*updateHeap
+	clock   Clock
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewUpdater starts an Updater with the given number of shards.
+// If shards <= 0, runtime.GOMAXPROCS(0) shards are used.
+func NewUpdater(
+	shards int,
+) *Updater {
+	return NewUpdaterWithClock(
+		shards,
+		SystemClock,
+	)
+}
+
+// NewUpdaterWithClock starts an Updater driven by clock; sessions
+// scheduled on it run their GFCP state machines on the same clock.
+func NewUpdaterWithClock(
+	shards int,
+	clock Clock,
+) *Updater {
+	if clock == nil {
+		clock = SystemClock
+	}
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(
+			0,
+		)
+	}
+	u := new(
+		Updater,
+	)
+	u.clock = clock
+	u.die = make(
+		chan struct{},
+	)
+	u.shards = make(
+		[]*updateHeap,
+		shards,
+	)
+	for k := range u.shards {
+		h := new(
+			updateHeap,
+		)
+		h.clock = clock
+		h.init()
+		u.shards[k] = h
+		go h.updateTask(
+			u.die,
+		)
+	}
+	return u
+}
+
+// Shards returns the number of shards.
+func (
+	u *Updater,
+) Shards() int {
+	return len(
+		u.shards,
+	)
+}
+
+// Len returns the number of sessions scheduled on the Updater.
+func (
+	u *Updater,
+) Len() (
+	n int,
+) {
+	for _, h := range u.shards {
+		h.mu.Lock()
+		n += h.Len()
+		h.mu.Unlock()
+	}
+	return
+}
+
+// Close stops all shard goroutines. Sessions still scheduled on the
+// Updater are no longer flushed; move or close them first.
+func (
+	u *Updater,
+) Close() error {
+	u.dieOnce.Do(
+		func() {
+			close(
+				u.die,
+			)
+		},
+	)
+	return nil
+}
+
+func (
+	u *Updater,
+) shard(
+	conv uint32,
+) *updateHeap {
+	// Fibonacci hashing spreads sequential conversation IDs.
+	return u.shards[uint64(
+		conv*2654435769,
+	)*uint64(len(u.shards))>>32]
+}
+
+func (
+	u *Updater,
+) addSession(
+	s *UDPSession,
+) {
+	u.shard(
+		s.GFcp.conv,
+	).addSession(
+		s,
+	)
+}
+
+func (
+	u *Updater,
+) removeSession(
+	s *UDPSession,
+) {
+	u.shard(
+		s.GFcp.conv,
+	).removeSession(
+		s,
+	)
+}
+
+func (
+	u *Updater,
+) reschedule(
+	s *UDPSession,
+	ts time.Time,
+) {
+	u.shard(
+		s.GFcp.conv,
+	).reschedule(
+		s,
+		ts,
+	)
 }
 
 type entry struct {
@@ -32,6 +206,7 @@ type updateHeap struct {
 	entries  []entry
 	mu       sync.Mutex
 	chWakeUp chan struct{}
+	clock    Clock
 }
 
 func (
@@ -110,7 +285,7 @@ func (
 	heap.Push(
 		h,
 		entry{
-			time.Now(),
+			h.clock.Now(),
 			s,
 		},
 	)
@@ -133,6 +308,33 @@ func (
 	h.mu.Unlock()
 }
 
+// reschedule moves the session's next update forward to ts.
+func (
+	h *updateHeap,
+) reschedule(
+	s *UDPSession,
+	ts time.Time,
+) {
+	h.mu.Lock()
+	idx := s.updaterIdx
+	if idx == -1 || !ts.Before(
+		h.entries[idx].ts,
+	) {
+		h.mu.Unlock()
+		return
+	}
+	h.entries[idx].ts = ts
+	heap.Fix(
+		h,
+		idx,
+	)
+	head := s.updaterIdx == 0
+	h.mu.Unlock()
+	if head {
+		h.wakeup()
+	}
+}
+
 func (
 	h *updateHeap,
 ) wakeup() {
@@ -144,23 +346,30 @@ func (
 
 func (
 	h *updateHeap,
-) updateTask() {
-	timer := time.NewTimer(0)
+) updateTask(
+	die <-chan struct{},
+) {
+	timer := h.clock.NewTimer(
+		0,
+	)
+	defer timer.Stop()
 	for {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 		case <-h.chWakeUp:
+		case <-die:
+			return
 		}
 
 		h.mu.Lock()
 		hlen := h.Len()
 		for i := 0; i < hlen; i++ {
 			entry := &h.entries[0]
-			if !time.Now().Before(
+			if !h.clock.Now().Before(
 				entry.ts,
 			) {
 				interval := entry.s.update()
-				entry.ts = time.Now().Add(
+				entry.ts = h.clock.Now().Add(
 					interval,
 				)
 				heap.Fix(
@@ -174,8 +383,8 @@ func (
 
 		if hlen > 0 {
 			timer.Reset(
-				time.Until(
-					h.entries[0].ts,
+				h.entries[0].ts.Sub(
+					h.clock.Now(),
 				),
 			)
 		}
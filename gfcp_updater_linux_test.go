@@ -0,0 +1,204 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+const portIdle = "127.0.0.1:9076"
+
+// cpuSeconds returns the CPU time consumed by the process so far.
+func cpuSeconds() float64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(
+		syscall.RUSAGE_SELF,
+		&ru,
+	); err != nil {
+		return 0
+	}
+	return time.Duration(
+		ru.Utime.Nano() + ru.Stime.Nano(),
+	).Seconds()
+}
+
+// idleSessions has a Listener accept n sessions, each opened by a
+// single window probe from its own short-lived client socket.
+func idleSessions(
+	b *testing.B,
+	n int,
+	updater *gfcp.Updater,
+) (
+	*gfcp.Listener,
+	[]*gfcp.UDPSession,
+) {
+	l, err := gfcp.ListenWithOptions(
+		portIdle,
+		0,
+		0,
+	)
+	if err != nil {
+		b.Fatal(
+			err,
+		)
+	}
+	l.SetUpdater(
+		updater,
+	)
+	l.SetReadBuffer(
+		16 * 1024 * 1024,
+	)
+	sessions := make(
+		chan *gfcp.UDPSession,
+		n,
+	)
+	go func() {
+		for {
+			s, err := l.AcceptGFCP()
+			if err != nil {
+				return
+			}
+			sessions <- s
+		}
+	}()
+	raddr, _ := net.ResolveUDPAddr(
+		"udp",
+		portIdle,
+	)
+	pkt := make(
+		[]byte,
+		gfcp.GfcpOverhead,
+	)
+	pkt[4] = gfcp.GfcpCmdWask
+	binary.LittleEndian.PutUint16(
+		pkt[6:],
+		gfcp.GfcpWndRcv,
+	)
+	accepted := make(
+		[]*gfcp.UDPSession,
+		0,
+		n,
+	)
+	seen := make(
+		map[uint32]bool,
+	)
+	deadline := time.Now().Add(
+		time.Minute,
+	)
+	for len(
+		accepted,
+	) < n {
+		if time.Now().After(
+			deadline,
+		) {
+			b.Fatalf(
+				"accepted %v of %v sessions",
+				len(accepted),
+				n,
+			)
+		}
+		// (re)send probes for every conversation not yet accepted,
+		// since some are lost to socket buffer overruns.
+		for conv := uint32(1); conv <= uint32(n); conv++ {
+			if seen[conv] {
+				continue
+			}
+			conn, err := net.DialUDP(
+				"udp",
+				nil,
+				raddr,
+			)
+			if err != nil {
+				b.Fatal(
+					err,
+				)
+			}
+			binary.LittleEndian.PutUint32(
+				pkt,
+				conv,
+			)
+			conn.Write(
+				pkt,
+			)
+			conn.Close()
+			if conv%256 == 0 {
+				time.Sleep(
+					time.Millisecond,
+				)
+			}
+		}
+		timeout := time.After(
+			time.Second,
+		)
+	drain:
+		for {
+			select {
+			case s := <-sessions:
+				if seen[s.GetConv()] {
+					s.Close()
+					continue
+				}
+				seen[s.GetConv()] = true
+				accepted = append(
+					accepted,
+					s,
+				)
+			case <-timeout:
+				break drain
+			}
+		}
+	}
+	return l, accepted
+}
+
+// BenchmarkIdleSessions10K reports the CPU time the updater spends on
+// 10000 idle sessions per millisecond of wall-clock time.
+func BenchmarkIdleSessions10K(
+	b *testing.B,
+) {
+	updater := gfcp.NewUpdater(
+		0,
+	)
+	defer updater.Close()
+	l, sessions := idleSessions(
+		b,
+		10000,
+		updater,
+	)
+	defer l.Close()
+	time.Sleep(
+		100 * time.Millisecond,
+	)
+	b.ResetTimer()
+	cpu := cpuSeconds()
+	time.Sleep(
+		time.Duration(
+			b.N,
+		) * time.Millisecond,
+	)
+	b.ReportMetric(
+		(cpuSeconds()-cpu)*1e9/float64(b.N),
+		"cpu-ns/op",
+	)
+	b.StopTimer()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
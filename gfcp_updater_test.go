@@ -0,0 +1,241 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcp_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+// resetClock is a ManualClock reporting the delay of every timer
+// Reset, which is when an Updater shard next runs.
+type resetClock struct {
+	*gfcptest.ManualClock
+	resets chan time.Duration
+}
+
+type resetTimer struct {
+	gfcp.Timer
+	resets chan time.Duration
+}
+
+func (
+	c *resetClock,
+) NewTimer(
+	d time.Duration,
+) gfcp.Timer {
+	return &resetTimer{
+		c.ManualClock.NewTimer(
+			d,
+		),
+		c.resets,
+	}
+}
+
+func (
+	t *resetTimer,
+) Reset(
+	d time.Duration,
+) bool {
+	t.resets <- d
+	return t.Timer.Reset(
+		d,
+	)
+}
+
+// schedule returns the delay the shard timer was last reset to, once
+// the Updater has settled.
+func (
+	c *resetClock,
+) schedule(
+	t *testing.T,
+) time.Duration {
+	var d time.Duration
+	select {
+	case d = <-c.resets:
+	case <-time.After(
+		5 * time.Second,
+	):
+		t.Fatal(
+			"updater not rescheduled",
+		)
+	}
+	for {
+		select {
+		case d = <-c.resets:
+		case <-time.After(
+			50 * time.Millisecond,
+		):
+			return d
+		}
+	}
+}
+
+// TestUpdateScheduling checks that an idle session is parked for
+// updateIdleInterval, and that input and writes bring it back when
+// GFCP.Check() says.
+func TestUpdateScheduling(
+	t *testing.T,
+) {
+	const (
+		idleInterval = 5 * time.Second
+		interval     = 40 * time.Millisecond
+	)
+	clock := &resetClock{
+		gfcptest.NewManualClock(
+			time.Now(),
+		),
+		make(
+			chan time.Duration,
+			64,
+		),
+	}
+	updater := gfcp.NewUpdaterWithClock(
+		1,
+		clock,
+	)
+	defer updater.Close()
+	network := gfcp.NewMemNetwork()
+	peer, err := network.ListenPacket(
+		"peer",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer peer.Close()
+	conn, err := network.ListenPacket(
+		"",
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	s, err := gfcp.NewConn(
+		"peer",
+		0,
+		0,
+		conn,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	defer s.Close()
+	s.SetNoDelay(
+		0,
+		int(interval/time.Millisecond),
+		0,
+		0,
+	)
+	s.SetUpdater(
+		updater,
+	)
+	if d := clock.schedule(
+		t,
+	); d != idleInterval {
+		t.Fatalf(
+			"idle session scheduled in %v, want %v",
+			d,
+			idleInterval,
+		)
+	}
+	// input owes an acknowledgement, flushed at the next interval
+	push := make(
+		[]byte,
+		gfcp.GfcpOverhead+4,
+	)
+	binary.LittleEndian.PutUint32(
+		push,
+		s.GetConv(),
+	)
+	push[4] = gfcp.GfcpCmdPush
+	binary.LittleEndian.PutUint16(
+		push[6:],
+		gfcp.GfcpWndRcv,
+	)
+	binary.LittleEndian.PutUint32(
+		push[20:],
+		4,
+	)
+	if _, err := peer.WriteTo(
+		push,
+		conn.LocalAddr(),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if d := clock.schedule(
+		t,
+	); d != interval {
+		t.Fatalf(
+			"session scheduled in %v after input, want %v",
+			d,
+			interval,
+		)
+	}
+	clock.Advance(
+		interval,
+	)
+	buf := make(
+		[]byte,
+		gfcp.GFcpMtuLimit,
+	)
+	peer.SetReadDeadline(
+		time.Now().Add(
+			5 * time.Second,
+		),
+	)
+	if n, _, err := peer.ReadFrom(
+		buf,
+	); err != nil || n < gfcp.GfcpOverhead || buf[4] != gfcp.GfcpCmdAck {
+		t.Fatalf(
+			"no acknowledgement: %v",
+			err,
+		)
+	}
+	if d := clock.schedule(
+		t,
+	); d != idleInterval {
+		t.Fatalf(
+			"session scheduled in %v once acknowledged, want %v",
+			d,
+			idleInterval,
+		)
+	}
+	// a write is sent at once, and checked on at the next interval
+	if _, err := s.Write(
+		[]byte(
+			"ping",
+		),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if d := clock.schedule(
+		t,
+	); d != interval {
+		t.Fatalf(
+			"session scheduled in %v after a write, want %v",
+			d,
+			interval,
+		)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+// Package gfcptest provides helpers for testing code built on gfcp.
+package gfcptest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/johnsonjh/gfcp"
+)
+
+// ManualClock is a gfcp.Clock that only moves when Advance or Set is
+// called, so that timing dependent behaviour can be tested exactly.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock returns a ManualClock reading start.
+func NewManualClock(
+	start time.Time,
+) *ManualClock {
+	return &ManualClock{
+		now: start,
+	}
+}
+
+// Now implements gfcp.Clock.
+func (
+	c *ManualClock,
+) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements gfcp.Clock.
+func (
+	c *ManualClock,
+) NewTimer(
+	d time.Duration,
+) gfcp.Timer {
+	t := &manualTimer{
+		clock: c,
+		ch: make(
+			chan time.Time,
+			1,
+		),
+	}
+	c.mu.Lock()
+	c.timers = append(
+		c.timers,
+		t,
+	)
+	c.mu.Unlock()
+	t.Reset(
+		d,
+	)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any expired timers.
+func (
+	c *ManualClock,
+) Advance(
+	d time.Duration,
+) {
+	c.mu.Lock()
+	t := c.now.Add(
+		d,
+	)
+	c.mu.Unlock()
+	c.Set(
+		t,
+	)
+}
+
+// Set moves the clock to t, firing any expired timers.
+func (
+	c *ManualClock,
+) Set(
+	t time.Time,
+) {
+	c.mu.Lock()
+	c.now = t
+	timers := append(
+		[]*manualTimer(nil),
+		c.timers...,
+	)
+	c.mu.Unlock()
+	for _, timer := range timers {
+		timer.fireIfDue(
+			t,
+		)
+	}
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	ch       chan time.Time
+	mu       sync.Mutex
+	deadline time.Time
+	active   bool
+}
+
+func (
+	t *manualTimer,
+) C() <-chan time.Time {
+	return t.ch
+}
+
+func (
+	t *manualTimer,
+) Reset(
+	d time.Duration,
+) bool {
+	now := t.clock.Now()
+	t.mu.Lock()
+	wasActive := t.active
+	t.deadline = now.Add(
+		d,
+	)
+	t.active = true
+	t.mu.Unlock()
+	t.fireIfDue(
+		now,
+	)
+	return wasActive
+}
+
+func (
+	t *manualTimer,
+) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (
+	t *manualTimer,
+) fireIfDue(
+	now time.Time,
+) {
+	t.mu.Lock()
+	if !t.active || now.Before(
+		t.deadline,
+	) {
+		t.mu.Unlock()
+		return
+	}
+	t.active = false
+	t.mu.Unlock()
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
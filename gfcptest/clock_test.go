@@ -0,0 +1,80 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcptest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+func TestManualClockTimer(
+	t *testing.T,
+) {
+	clock := gfcptest.NewManualClock(
+		time.Unix(
+			0,
+			0,
+		),
+	)
+	timer := clock.NewTimer(
+		time.Second,
+	)
+	clock.Advance(
+		999 * time.Millisecond,
+	)
+	select {
+	case <-timer.C():
+		t.Fatal(
+			"timer fired early",
+		)
+	default:
+	}
+	clock.Advance(
+		time.Millisecond,
+	)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(
+			time.Unix(
+				1,
+				0,
+			),
+		) {
+			t.Fatal(
+				now,
+			)
+		}
+	default:
+		t.Fatal(
+			"timer did not fire",
+		)
+	}
+	timer.Reset(
+		time.Second,
+	)
+	if !timer.Stop() {
+		t.Fatal(
+			"Stop on an active timer returned false",
+		)
+	}
+	clock.Advance(
+		time.Hour,
+	)
+	select {
+	case <-timer.C():
+		t.Fatal(
+			"stopped timer fired",
+		)
+	default:
+	}
+}
@@ -0,0 +1,636 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcptest
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnsonjh/gfcp/internal/packetqueue"
+)
+
+// LossModel decides whether each packet crossing a Link is lost.
+type LossModel interface {
+	Lost(
+		r *rand.Rand,
+	) bool
+}
+
+// Bernoulli loses every packet independently with probability P.
+type Bernoulli struct {
+	P float64
+}
+
+// Lost implements LossModel.
+func (
+	b Bernoulli,
+) Lost(
+	r *rand.Rand,
+) bool {
+	return r.Float64() < b.P
+}
+
+// GilbertElliott is the two-state burst loss model: the channel moves
+// between a good and a bad state before each packet, and loses it with
+// the loss probability of the state it is in.
+type GilbertElliott struct {
+	PGoodToBad float64 // probability of entering the bad state
+	PBadToGood float64 // probability of leaving the bad state
+	LossGood   float64 // loss probability in the good state
+	LossBad    float64 // loss probability in the bad state
+	bad        bool
+}
+
+// Lost implements LossModel.
+func (
+	g *GilbertElliott,
+) Lost(
+	r *rand.Rand,
+) bool {
+	if g.bad {
+		if r.Float64() < g.PBadToGood {
+			g.bad = false
+		}
+	} else if r.Float64() < g.PGoodToBad {
+		g.bad = true
+	}
+	if g.bad {
+		return r.Float64() < g.LossBad
+	}
+	return r.Float64() < g.LossGood
+}
+
+// Link describes the impairments applied to one direction of a pipe,
+// much like a Linux netem qdisc. The zero value is a perfect link.
+type Link struct {
+	Loss      LossModel     // nil loses nothing
+	Delay     time.Duration // fixed one-way delay
+	Jitter    time.Duration // uniform random extra delay in [0, Jitter)
+	Reorder   float64       // probability a packet skips Delay and Jitter
+	Duplicate float64       // probability a packet is delivered twice
+	Corrupt   float64       // probability one byte of a packet is flipped
+	Bandwidth int64         // bytes per second, 0 is unlimited
+	MTU       int           // larger packets are dropped, 0 is unlimited
+	Seed      int64         // seed for the random source
+}
+
+// LinkStats counts what happened to packets sent over a Link.
+type LinkStats struct {
+	Sent       uint64 // packets handed to the link
+	Lost       uint64 // packets dropped by the loss model
+	Oversize   uint64 // packets dropped for exceeding the MTU
+	Duplicated uint64 // extra copies delivered
+	Corrupted  uint64 // packets delivered with a flipped byte
+	Reordered  uint64 // packets that skipped the delay
+	Overflow   uint64 // packets dropped by a full receive queue
+	Delivered  uint64 // packets placed in the receive queue
+}
+
+// pipeQueueLen bounds each PacketConn's receive queue, like a socket
+// receive buffer.
+const pipeQueueLen = 4096
+
+var pipePort uint32 = 10000
+
+type packet struct {
+	data []byte
+	from net.Addr
+	due  time.Time
+	seq  uint64
+}
+
+type packetHeap []*packet
+
+func (
+	h packetHeap,
+) Len() int {
+	return len(
+		h,
+	)
+}
+
+func (
+	h packetHeap,
+) Less(
+	i,
+	j int,
+) bool {
+	if h[i].due.Equal(
+		h[j].due,
+	) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].due.Before(
+		h[j].due,
+	)
+}
+
+func (
+	h packetHeap,
+) Swap(
+	i,
+	j int,
+) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (
+	h *packetHeap,
+) Push(
+	x interface{},
+) {
+	*h = append(
+		*h,
+		x.(*packet),
+	)
+}
+
+func (
+	h *packetHeap,
+) Pop() interface{} {
+	old := *h
+	n := len(
+		old,
+	)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// link is the running state of one direction of a pipe.
+type link struct {
+	cfg       Link
+	mu        sync.Mutex
+	rnd       *rand.Rand
+	pending   packetHeap
+	seq       uint64
+	busyUntil time.Time
+	wake      chan struct{}
+	die       chan struct{}
+	dst       *PacketConn
+	stats     LinkStats
+}
+
+func newLink(
+	cfg *Link,
+	dst *PacketConn,
+) *link {
+	l := new(
+		link,
+	)
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	l.rnd = rand.New(
+		rand.NewSource(
+			l.cfg.Seed,
+		),
+	)
+	l.wake = make(
+		chan struct{},
+		1,
+	)
+	l.die = make(
+		chan struct{},
+	)
+	l.dst = dst
+	go l.deliver()
+	return l
+}
+
+func (
+	l *link,
+) send(
+	p []byte,
+	from net.Addr,
+) {
+	atomic.AddUint64(
+		&l.stats.Sent,
+		1,
+	)
+	if l.cfg.MTU > 0 && len(
+		p,
+	) > l.cfg.MTU {
+		atomic.AddUint64(
+			&l.stats.Oversize,
+			1,
+		)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.Loss != nil && l.cfg.Loss.Lost(
+		l.rnd,
+	) {
+		atomic.AddUint64(
+			&l.stats.Lost,
+			1,
+		)
+		return
+	}
+	now := time.Now()
+	departure := now
+	if l.cfg.Bandwidth > 0 {
+		if l.busyUntil.After(
+			departure,
+		) {
+			departure = l.busyUntil
+		}
+		departure = departure.Add(
+			time.Duration(
+				int64(len(p)) * int64(time.Second) / l.cfg.Bandwidth,
+			),
+		)
+		l.busyUntil = departure
+	}
+	due := departure
+	if l.cfg.Reorder > 0 && l.rnd.Float64() < l.cfg.Reorder {
+		atomic.AddUint64(
+			&l.stats.Reordered,
+			1,
+		)
+	} else {
+		due = due.Add(
+			l.cfg.Delay,
+		)
+		if l.cfg.Jitter > 0 {
+			due = due.Add(
+				time.Duration(
+					l.rnd.Int63n(
+						int64(l.cfg.Jitter),
+					),
+				),
+			)
+		}
+	}
+	copies := 1
+	if l.cfg.Duplicate > 0 && l.rnd.Float64() < l.cfg.Duplicate {
+		atomic.AddUint64(
+			&l.stats.Duplicated,
+			1,
+		)
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		data := append(
+			[]byte(nil),
+			p...,
+		)
+		if l.cfg.Corrupt > 0 && len(
+			data,
+		) > 0 && l.rnd.Float64() < l.cfg.Corrupt {
+			data[l.rnd.Intn(len(data))] ^= byte(
+				1 + l.rnd.Intn(255),
+			)
+			atomic.AddUint64(
+				&l.stats.Corrupted,
+				1,
+			)
+		}
+		l.seq++
+		heap.Push(
+			&l.pending,
+			&packet{
+				data: data,
+				from: from,
+				due:  due,
+				seq:  l.seq,
+			},
+		)
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver moves packets into the destination queue once they are due.
+func (
+	l *link,
+) deliver() {
+	timer := time.NewTimer(
+		time.Hour,
+	)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		for len(
+			l.pending,
+		) > 0 && !l.pending[0].due.After(
+			now,
+		) {
+			p := heap.Pop(
+				&l.pending,
+			).(*packet)
+			if l.dst.enqueue(
+				p,
+			) {
+				atomic.AddUint64(
+					&l.stats.Delivered,
+					1,
+				)
+			} else {
+				atomic.AddUint64(
+					&l.stats.Overflow,
+					1,
+				)
+			}
+		}
+		next := time.Hour
+		if len(
+			l.pending,
+		) > 0 {
+			next = l.pending[0].due.Sub(
+				now,
+			)
+		}
+		l.mu.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(
+			next,
+		)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.die:
+			return
+		}
+	}
+}
+
+// PacketConn is one end of an emulated network path. It implements
+// net.PacketConn, and only exchanges packets with its peer.
+type PacketConn struct {
+	local net.Addr
+	peer  *PacketConn
+	out   *link
+	queue *packetqueue.Queue
+	mu    sync.Mutex
+	wdl   time.Time
+}
+
+// NewPacketPipe returns two connected PacketConns. Packets written to
+// a travel over ab, and packets written to b over ba; nil is a
+// perfect link. Use a distinct Link for each direction.
+func NewPacketPipe(
+	ab,
+	ba *Link,
+) (
+	a,
+	b *PacketConn,
+) {
+	port := int(
+		atomic.AddUint32(
+			&pipePort,
+			1,
+		),
+	)
+	a = newPacketConn(
+		&net.UDPAddr{
+			IP: net.IPv4(
+				192,
+				0,
+				2,
+				1,
+			),
+			Port: port,
+		},
+	)
+	b = newPacketConn(
+		&net.UDPAddr{
+			IP: net.IPv4(
+				192,
+				0,
+				2,
+				2,
+			),
+			Port: port,
+		},
+	)
+	a.peer, b.peer = b, a
+	a.out = newLink(
+		ab,
+		b,
+	)
+	b.out = newLink(
+		ba,
+		a,
+	)
+	return a, b
+}
+
+func newPacketConn(
+	addr net.Addr,
+) *PacketConn {
+	return &PacketConn{
+		local: addr,
+		queue: packetqueue.New(
+			pipeQueueLen,
+		),
+	}
+}
+
+// Stats returns the counters of the link carrying this end's writes.
+func (
+	c *PacketConn,
+) Stats() LinkStats {
+	s := &c.out.stats
+	return LinkStats{
+		Sent: atomic.LoadUint64(
+			&s.Sent,
+		),
+		Lost: atomic.LoadUint64(
+			&s.Lost,
+		),
+		Oversize: atomic.LoadUint64(
+			&s.Oversize,
+		),
+		Duplicated: atomic.LoadUint64(
+			&s.Duplicated,
+		),
+		Corrupted: atomic.LoadUint64(
+			&s.Corrupted,
+		),
+		Reordered: atomic.LoadUint64(
+			&s.Reordered,
+		),
+		Overflow: atomic.LoadUint64(
+			&s.Overflow,
+		),
+		Delivered: atomic.LoadUint64(
+			&s.Delivered,
+		),
+	}
+}
+
+func (
+	c *PacketConn,
+) enqueue(
+	p *packet,
+) bool {
+	return c.queue.Push(
+		packetqueue.Packet{
+			Data: p.data,
+			From: p.from,
+		},
+	)
+}
+
+// ReadFrom implements net.PacketConn.
+func (
+	c *PacketConn,
+) ReadFrom(
+	b []byte,
+) (
+	int,
+	net.Addr,
+	error,
+) {
+	n, from, err := c.queue.Pop(
+		b,
+	)
+	if err != nil {
+		return 0, nil, c.opError(
+			"read",
+			err,
+		)
+	}
+	return n, from, nil
+}
+
+// WriteTo implements net.PacketConn. Packets addressed to anyone
+// other than the peer are silently discarded.
+func (
+	c *PacketConn,
+) WriteTo(
+	b []byte,
+	addr net.Addr,
+) (
+	int,
+	error,
+) {
+	select {
+	case <-c.queue.Done():
+		return 0, c.opError(
+			"write",
+			net.ErrClosed,
+		)
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.wdl
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(
+		deadline,
+	) {
+		return 0, c.opError(
+			"write",
+			os.ErrDeadlineExceeded,
+		)
+	}
+	if addr != nil && addr.String() == c.peer.local.String() {
+		c.out.send(
+			b,
+			c.local,
+		)
+	}
+	return len(
+		b,
+	), nil
+}
+
+// Close implements net.PacketConn.
+func (
+	c *PacketConn,
+) Close() error {
+	if !c.queue.Close() {
+		return c.opError(
+			"close",
+			net.ErrClosed,
+		)
+	}
+	close(
+		c.out.die,
+	)
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (
+	c *PacketConn,
+) LocalAddr() net.Addr {
+	return c.local
+}
+
+// SetDeadline implements net.PacketConn.
+func (
+	c *PacketConn,
+) SetDeadline(
+	t time.Time,
+) error {
+	c.mu.Lock()
+	c.wdl = t
+	c.mu.Unlock()
+	c.queue.SetDeadline(
+		t,
+	)
+	return nil
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (
+	c *PacketConn,
+) SetReadDeadline(
+	t time.Time,
+) error {
+	c.queue.SetDeadline(
+		t,
+	)
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (
+	c *PacketConn,
+) SetWriteDeadline(
+	t time.Time,
+) error {
+	c.mu.Lock()
+	c.wdl = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (
+	c *PacketConn,
+) opError(
+	op string,
+	err error,
+) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "udp",
+		Source: c.local,
+		Err:    err,
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+package gfcptest_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/johnsonjh/gfcp/gfcptest"
+)
+
+func TestPacketPipeDelay(
+	t *testing.T,
+) {
+	a, b := gfcptest.NewPacketPipe(
+		&gfcptest.Link{
+			Delay: 50 * time.Millisecond,
+		},
+		nil,
+	)
+	defer a.Close()
+	defer b.Close()
+	start := time.Now()
+	if _, err := a.WriteTo(
+		[]byte("ping"),
+		b.LocalAddr(),
+	); err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	buf := make(
+		[]byte,
+		16,
+	)
+	n, from, err := b.ReadFrom(
+		buf,
+	)
+	if err != nil {
+		t.Fatal(
+			err,
+		)
+	}
+	if string(buf[:n]) != "ping" || from.String() != a.LocalAddr().String() {
+		t.Fatal(
+			string(buf[:n]),
+			from,
+		)
+	}
+	if elapsed := time.Since(
+		start,
+	); elapsed < 50*time.Millisecond {
+		t.Fatal(
+			"delivered early:",
+			elapsed,
+		)
+	}
+}
+
+func TestPacketPipeImpairments(
+	t *testing.T,
+) {
+	const count = 2000
+	a, b := gfcptest.NewPacketPipe(
+		&gfcptest.Link{
+			Loss: &gfcptest.GilbertElliott{
+				PGoodToBad: 0.05,
+				PBadToGood: 0.3,
+				LossBad:    0.8,
+			},
+			Duplicate: 0.1,
+			MTU:       100,
+			Seed:      1,
+		},
+		nil,
+	)
+	defer a.Close()
+	defer b.Close()
+	payload := make(
+		[]byte,
+		64,
+	)
+	for i := 0; i < count; i++ {
+		a.WriteTo(
+			payload,
+			b.LocalAddr(),
+		)
+	}
+	a.WriteTo(
+		make(
+			[]byte,
+			101,
+		),
+		b.LocalAddr(),
+	)
+	buf := make(
+		[]byte,
+		256,
+	)
+	received := 0
+	for {
+		b.SetReadDeadline(
+			time.Now().Add(
+				100 * time.Millisecond,
+			),
+		)
+		if _, _, err := b.ReadFrom(
+			buf,
+		); err != nil {
+			if !errors.Is(
+				err,
+				os.ErrDeadlineExceeded,
+			) {
+				t.Fatal(
+					err,
+				)
+			}
+			break
+		}
+		received++
+	}
+	stats := a.Stats()
+	if stats.Sent != count+1 || stats.Oversize != 1 {
+		t.Fatalf(
+			"%+v",
+			stats,
+		)
+	}
+	if stats.Lost == 0 || stats.Duplicated == 0 {
+		t.Fatalf(
+			"%+v",
+			stats,
+		)
+	}
+	if uint64(received) != stats.Delivered ||
+		stats.Delivered != count-stats.Lost+stats.Duplicated {
+		t.Fatalf(
+			"received %v, %+v",
+			received,
+			stats,
+		)
+	}
+}
+
+func TestPacketPipeClose(
+	t *testing.T,
+) {
+	a, b := gfcptest.NewPacketPipe(
+		nil,
+		nil,
+	)
+	defer b.Close()
+	done := make(
+		chan error,
+		1,
+	)
+	go func() {
+		_, _, err := a.ReadFrom(
+			make(
+				[]byte,
+				16,
+			),
+		)
+		done <- err
+	}()
+	a.Close()
+	if err := <-done; err == nil {
+		t.Fatal(
+			"read after close succeeded",
+		)
+	}
+	if _, err := a.WriteTo(
+		nil,
+		b.LocalAddr(),
+	); err == nil {
+		t.Fatal(
+			"write after close succeeded",
+		)
+	}
+}
+
+// TestPacketPipeDeadlineChange sets a read deadline while a read with
+// none is waiting.
+func TestPacketPipeDeadlineChange(
+	t *testing.T,
+) {
+	a, b := gfcptest.NewPacketPipe(
+		nil,
+		nil,
+	)
+	defer a.Close()
+	defer b.Close()
+	done := make(
+		chan error,
+		1,
+	)
+	go func() {
+		_, _, err := a.ReadFrom(
+			make(
+				[]byte,
+				16,
+			),
+		)
+		done <- err
+	}()
+	time.Sleep(
+		10 * time.Millisecond,
+	)
+	a.SetReadDeadline(
+		time.Now().Add(
+			10 * time.Millisecond,
+		),
+	)
+	select {
+	case err := <-done:
+		if !errors.Is(
+			err,
+			os.ErrDeadlineExceeded,
+		) {
+			t.Fatalf(
+				"read failed with %v, want a deadline error",
+				err,
+			)
+		}
+	case <-time.After(
+		5 * time.Second,
+	):
+		t.Fatal(
+			"read outlived its deadline",
+		)
+	}
+}
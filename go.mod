@@ -1,6 +1,7 @@
 module github.com/johnsonjh/gfcp
 
-go 1.21
+go 1.23.0
+
 toolchain go1.24.1
 
 require (
@@ -9,10 +10,10 @@ require (
 	github.com/pkg/errors v0.9.2-0.20201214064552-5dd12d0cfe7f
 	go4.org v0.0.0-20230225012048-214862532bf5
 	golang.org/x/net v0.38.0
+	golang.org/x/sys v0.31.0
 )
 
 require (
 	github.com/klauspost/cpuid/v2 v2.2.10-0.20241128153506-78c3c03144af // indirect
 	go.uber.org/goleak v1.3.1-0.20241121203838-4ff5fa6529ee // indirect
-	golang.org/x/sys v0.31.0 // indirect
 )
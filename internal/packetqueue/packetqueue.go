@@ -0,0 +1,170 @@
+// Copyright © 2021 Jeffrey H. Johnson <trnsz@pobox.com>.
+// Copyright © 2015 Daniel Fu <daniel820313@gmail.com>.
+// Copyright © 2019 Loki 'l0k18' Verloren <stalker.loki@protonmail.ch>.
+// Copyright © 2021 Gridfinity, LLC. <admin@gridfinity.com>.
+//
+// All rights reserved.
+//
+// All use of this code is governed by the MIT license.
+// The complete license is available in the LICENSE file.
+
+// Package packetqueue implements the receive side of in-memory packet
+// conns: a bounded queue of datagrams, read with a deadline.
+package packetqueue
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packet is a datagram, and the address it came from.
+type Packet struct {
+	Data []byte
+	From net.Addr
+}
+
+// Queue is a bounded queue of datagrams. Pop waits for one until the
+// read deadline, which may be changed while it waits.
+type Queue struct {
+	ch       chan Packet
+	die      chan struct{}
+	dieOnce  sync.Once
+	mu       sync.Mutex
+	deadline time.Time
+	changed  chan struct{} // closed when deadline changes
+}
+
+// New returns a Queue holding up to size datagrams.
+func New(
+	size int,
+) *Queue {
+	return &Queue{
+		ch: make(
+			chan Packet,
+			size,
+		),
+		die: make(
+			chan struct{},
+		),
+		changed: make(
+			chan struct{},
+		),
+	}
+}
+
+// Push queues p without waiting, and reports whether there was room.
+func (
+	q *Queue,
+) Push(
+	p Packet,
+) bool {
+	select {
+	case <-q.die:
+		return false
+	default:
+	}
+	select {
+	case q.ch <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pop copies the next datagram into b, waiting for one until the read
+// deadline. It fails with os.ErrDeadlineExceeded, or net.ErrClosed once
+// the queue is closed; callers wrap these in a net.OpError.
+func (
+	q *Queue,
+) Pop(
+	b []byte,
+) (
+	int,
+	net.Addr,
+	error,
+) {
+	for {
+		q.mu.Lock()
+		deadline := q.deadline
+		changed := q.changed
+		q.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(
+				deadline,
+			)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(
+				d,
+			)
+			timeout = timer.C
+		}
+		select {
+		case p := <-q.ch:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(
+				b,
+				p.Data,
+			), p.From, nil
+		case <-q.die:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// SetDeadline sets the read deadline, waking any Pop waiting.
+func (
+	q *Queue,
+) SetDeadline(
+	t time.Time,
+) {
+	q.mu.Lock()
+	q.deadline = t
+	close(
+		q.changed,
+	)
+	q.changed = make(
+		chan struct{},
+	)
+	q.mu.Unlock()
+}
+
+// Close wakes any Pop waiting, and makes Push fail. It reports whether
+// the queue was open.
+func (
+	q *Queue,
+) Close() (
+	closed bool,
+) {
+	q.dieOnce.Do(
+		func() {
+			closed = true
+			close(
+				q.die,
+			)
+		},
+	)
+	return
+}
+
+// Done returns a channel closed once the queue is.
+func (
+	q *Queue,
+) Done() <-chan struct{} {
+	return q.die
+}